@@ -20,6 +20,10 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/DITAS-Project/VDC-Request-Monitor/monitor"
 	"github.com/sirupsen/logrus"
@@ -57,22 +61,135 @@ func main() {
 	//setup defaults
 	viper.SetDefault("Endpoint", "http://localhost:8080")
 	viper.SetDefault("ElasticSearchURL", "http://localhost:9200")
+	viper.SetDefault("ElasticIndex", "")
+	viper.SetDefault("ElasticIndexDateFormat", "2006-01-02")
+	viper.SetDefault("ElasticRollover", false)
+	viper.SetDefault("ElasticTemplate", true)
+	viper.SetDefault("ElasticILMPolicy", "")
+	viper.SetDefault("ElasticILMRolloverMaxAge", "1d")
+	viper.SetDefault("ElasticILMRolloverMaxSize", "50gb")
+	viper.SetDefault("ElasticILMRetention", "")
+	viper.SetDefault("ElasticDocumentType", "")
+	viper.SetDefault("ElasticUsername", "")
+	viper.SetDefault("ElasticPassword", "")
+	viper.SetDefault("ElasticPasswordFile", "")
+	viper.SetDefault("ElasticAPIKey", "")
+	viper.SetDefault("ElasticAPIKeyFile", "")
+	viper.SetDefault("ElasticCAFile", "")
+	viper.SetDefault("ElasticClientCert", "")
+	viper.SetDefault("ElasticClientKey", "")
+	viper.SetDefault("ElasticBufferSize", 10000)
+	viper.SetDefault("ElasticRetryInterval", "5s")
 	viper.SetDefault("VDCName", "dummyVDC")
 	viper.SetDefault("Opentracing", false)
 	viper.SetDefault("ZipkinEndpoint", "")
+	viper.SetDefault("TracingBackend", "zipkin")
+	viper.SetDefault("OTLPEndpoint", "http://localhost:4318")
+	viper.SetDefault("OTLPExportInterval", "5s")
+	viper.SetDefault("OTLPMetrics", false)
+	viper.SetDefault("TracingPropagation", []string{"w3c", "b3"})
+	viper.SetDefault("TracingSampleRatio", 1.0)
+	viper.SetDefault("TracingFromBlueprint", true)
 	viper.SetDefault("UseACME", false)
+	viper.SetDefault("ACMEEmail", "")
+	viper.SetDefault("ACMEHosts", []string{})
+	viper.SetDefault("ACMECacheDir", ".certs")
+	viper.SetDefault("ACMEDirectoryURL", "")
+	viper.SetDefault("ACMECAFile", "")
 	viper.SetDefault("UseSelfSigned", true)
+	viper.SetDefault("CertReloadInterval", "1m")
+	viper.SetDefault("CertExpiryWarning", "720h")
+	viper.SetDefault("CertDNSNames", []string{})
+	viper.SetDefault("CertIPAddresses", []string{})
+	viper.SetDefault("CertValidity", "8760h")
+	viper.SetDefault("CertKeyType", "ecdsa")
+	viper.SetDefault("AdminAddress", "")
 	viper.SetDefault("ForwardTraffic", false)
 	viper.SetDefault("ExchangeReporterURL", "")
+	viper.SetDefault("ExchangeTimeout", "10s")
+	viper.SetDefault("ExchangeRetries", 3)
+	viper.SetDefault("ExchangeBatchSize", 1)
+	viper.SetDefault("ExchangeFlushInterval", "1s")
+	viper.SetDefault("ExchangeGzip", false)
+	viper.SetDefault("ExchangeBearerToken", "")
+	viper.SetDefault("ExchangeCAFile", "")
+	viper.SetDefault("ExchangeClientCert", "")
+	viper.SetDefault("ExchangeClientKey", "")
+	viper.SetDefault("UpstreamCAFile", "")
+	viper.SetDefault("UpstreamClientCert", "")
+	viper.SetDefault("UpstreamClientKey", "")
+	viper.SetDefault("UpstreamServerName", "")
+	viper.SetDefault("UpstreamMinTLSVersion", "")
+	viper.SetDefault("AccessLogOutput", "")
+	viper.SetDefault("AccessLogFormat", "ecs")
+	viper.SetDefault("AccessLogMaxSize", 100)
+	viper.SetDefault("AccessLogMaxBackups", 5)
+	viper.SetDefault("RecordOutput", "")
+	viper.SetDefault("RecordFormat", "ndjson")
+	viper.SetDefault("RecordOperations", []string{})
+	viper.SetDefault("RecordCredentials", false)
+	viper.SetDefault("MirrorEndpoint", "")
+	viper.SetDefault("MirrorOperations", []string{})
+	viper.SetDefault("MirrorPercentage", 100.0)
+	viper.SetDefault("MirrorTimeout", "10s")
+	viper.SetDefault("MirrorMaxConcurrent", 100)
+	viper.SetDefault("MirrorIgnore", []string{})
+	viper.SetDefault("CanaryEndpoint", "")
+	viper.SetDefault("CanaryWeight", 0.0)
+	viper.SetDefault("CanaryHeader", "")
+	viper.SetDefault("CanaryCookie", "")
+	viper.SetDefault("CanaryVersion", "canary")
+	viper.SetDefault("EndpointVersion", "")
+	viper.SetDefault("CacheTTL", map[string]string{})
+	viper.SetDefault("CacheMaxEntries", 1000)
+	viper.SetDefault("CacheDir", "")
+	viper.SetDefault("CacheMaxBodySize", 1)
+	viper.SetDefault("CoalesceOperations", []string{})
+	viper.SetDefault("CoalesceMaxBodySize", 10)
+	viper.SetDefault("CompressResponses", false)
+	viper.SetDefault("CompressMinSize", 1024)
+	viper.SetDefault("CompressTypes", []string{"text/", "application/json", "application/xml", "application/javascript"})
+	viper.SetDefault("MessageBusType", "")
+	viper.SetDefault("MessageBusURL", "nats://localhost:4222")
+	viper.SetDefault("MessageBusTopic", "ditas.{vdc}.{kind}")
+	viper.SetDefault("MessageBusBatchSize", 100)
+	viper.SetDefault("MessageBusFlushInterval", "1s")
+	viper.SetDefault("MessageBusDelivery", "at-most-once")
+	viper.SetDefault("MessageBusRetries", 5)
+	viper.SetDefault("QueueSize", 10)
+	viper.SetDefault("QueueSizes", map[string]int{})
+	viper.SetDefault("QueueOverflowPolicy", "block")
+	viper.SetDefault("QueueSpillDir", "")
+	viper.SetDefault("QueueSpillMaxSize", 100)
+	viper.SetDefault("ReporterWorkers", 1)
+	viper.SetDefault("ReporterWorkerCounts", map[string]int{})
+	viper.SetDefault("ReporterDelivery", "ordered")
+	viper.SetDefault("AuthMethods", []string{})
+	viper.SetDefault("AuthJWKSFile", "jwks.json")
+	viper.SetDefault("AuthJWTIssuer", "")
+	viper.SetDefault("AuthJWTAudience", "")
+	viper.SetDefault("AuthRolesClaim", "roles")
+	viper.SetDefault("AuthAPIKeysFile", "apikeys.json")
+	viper.SetDefault("AuthAPIKeyHeader", "X-API-Key")
+	viper.SetDefault("AuthUsersFile", "users.json")
+	viper.SetDefault("AuthRulesFromBlueprint", true)
 
 	//setup cmd interface
 	flag.String("elastic", viper.GetString("ElasticSearchURL"), "used to define the elasticURL")
 	flag.Bool("verbose", false, "for verbose logging")
+	configFile := flag.String("config", "", "path of the config file, by default monitor.json is searched in the config paths")
+	replayTarget := flag.String("target", "", "replay: VDC the recorded requests are send to, by default they are fed through the monitor")
+	replayIgnore := flag.String("ignore", "", "replay: comma separated JSON paths that are not compared, e.g., $.meta.created,items[*].id")
+	replayTimeout := flag.Duration("timeout", 30*time.Second, "replay: timeout of a request to the target")
 
 	pflag.CommandLine.AddGoFlagSet(flag.CommandLine)
 	pflag.Parse()
 	viper.BindPFlags(pflag.CommandLine)
 
+	if *configFile != "" {
+		viper.SetConfigFile(*configFile)
+	}
+
 	if viper.GetBool("verbose") {
 		logger.SetLevel(logrus.DebugLevel)
 	}
@@ -80,7 +197,54 @@ func main() {
 	monitor.SetLogger(logger)
 	monitor.SetLog(log)
 
-	//
+	switch pflag.Arg(0) {
+	case "", "serve":
+		serve()
+	case "validate":
+		//checks the config and the blueprint and exits
+		err := monitor.ValidateConfig()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Println("configuration is valid")
+	case "match":
+		if pflag.NArg() != 3 {
+			usage()
+		}
+		operationID, err := monitor.MatchOperation(pflag.Arg(1), pflag.Arg(2))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Println(operationID)
+	case "replay":
+		if pflag.NArg() != 2 {
+			usage()
+		}
+		opts := monitor.ReplayOptions{
+			Target:  *replayTarget,
+			Timeout: *replayTimeout,
+		}
+		if *replayIgnore != "" {
+			opts.Ignore = strings.Split(*replayIgnore, ",")
+		}
+		differing, err := monitor.Replay(pflag.Arg(1), opts, os.Stdout)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if differing > 0 {
+			os.Exit(1)
+		}
+	case "version":
+		fmt.Println(Build)
+	default:
+		usage()
+	}
+}
+
+func serve() {
 	mon, err := monitor.NewManger()
 
 	if err != nil {
@@ -89,3 +253,19 @@ func main() {
 
 	mon.Listen()
 }
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `usage: %s [flags] [command]
+
+commands:
+  serve                 run the request monitor (default)
+  validate              check the configuration and the blueprint
+  match <method> <path> print the blueprint operation a request resolves to
+  replay <file>         re-send recorded exchanges (NDJSON or HAR) and compare the responses
+  version               print the build
+
+flags:
+`, os.Args[0])
+	pflag.PrintDefaults()
+	os.Exit(2)
+}
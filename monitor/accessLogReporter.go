@@ -0,0 +1,307 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+package monitor
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+//accessLogEntry describes a completed exchange
+type accessLogEntry struct {
+	MeterMessage
+	Protocol  string
+	Host      string
+	URI       string
+	Referer   string
+	UserAgent string
+}
+
+type accessLogReporter struct {
+	Queue   chan accessLogEntry
+	Format  string
+	VDCName string
+	Output  io.WriteCloser
+	pool    *workerPool
+}
+
+//newAccessLogEntry collects the access log information of a request and its response
+func newAccessLogEntry(req *http.Request, meter MeterMessage, statusCode int, written int64) accessLogEntry {
+	meter.ResponseCode = statusCode
+	meter.ResponseLength = written
+	meter.Timestamp = time.Now()
+
+	return accessLogEntry{
+		MeterMessage: meter,
+		Protocol:     req.Proto,
+		Host:         req.Host,
+		URI:          req.RequestURI,
+		Referer:      req.Referer(),
+		UserAgent:    req.UserAgent(),
+	}
+}
+
+//newAccessLogReporter creates a reporter that writes one JSON line per exchange
+//to stdout or a rotating file
+func newAccessLogReporter(conf Configuration, queue chan accessLogEntry) (accessLogReporter, error) {
+	var output io.WriteCloser
+	switch conf.AccessLogOutput {
+	case "stdout", "-":
+		output = nopCloser{os.Stdout}
+	default:
+		file, err := newRotatingFile(conf.configPath(conf.AccessLogOutput), conf.AccessLogMaxSize, conf.AccessLogMaxBackups)
+		if err != nil {
+			log.Errorf("could not open access log %+v", err)
+			return accessLogReporter{}, err
+		}
+		output = file
+	}
+
+	format := strings.ToLower(conf.AccessLogFormat)
+	switch format {
+	case "", "ecs":
+		format = "ecs"
+	case "common", "combined":
+	default:
+		return accessLogReporter{}, fmt.Errorf("unknown access log format %s", conf.AccessLogFormat)
+	}
+
+	pool, err := newWorkerPool(conf, "accesslog")
+	if err != nil {
+		output.Close()
+		return accessLogReporter{}, err
+	}
+
+	return accessLogReporter{
+		Queue:   queue,
+		Format:  format,
+		VDCName: conf.VDCName,
+		Output:  output,
+		pool:    pool,
+	}, nil
+}
+
+//Start creates the worker processes that write the access log,
+//the output is closed once all workers stopped
+func (ar *accessLogReporter) Start() {
+	ar.pool.Start(ar.Queue, func(queue interface{}, wlog *logrus.Entry) {
+		ar.work(queue.(chan accessLogEntry), wlog)
+	}, func() {
+		ar.Output.Close()
+	})
+}
+
+func (ar *accessLogReporter) work(queue chan accessLogEntry, wlog *logrus.Entry) {
+	//each entry is written with a single Write call, so lines of different workers do not interleave
+	encoder := json.NewEncoder(ar.Output)
+	for {
+		select {
+		case entry := <-queue:
+			err := encoder.Encode(ar.fields(entry))
+			if err != nil {
+				wlog.Debugf("failed to write access log %+v", err)
+			}
+		case <-ar.pool.Done():
+			wlog.Info("access log worker stopping")
+			return
+		}
+	}
+}
+
+//Stop terminates this Worker
+func (ar *accessLogReporter) Stop() {
+	ar.pool.Stop()
+}
+
+//fields returns the field set of the configured format
+func (ar *accessLogReporter) fields(entry accessLogEntry) map[string]interface{} {
+	switch ar.Format {
+	case "common", "combined":
+		fields := map[string]interface{}{
+			"remote_host": remoteHost(entry.Client),
+			"ident":       "-",
+			"auth_user":   orDash(entry.Principal),
+			"timestamp":   entry.Timestamp.Format("02/Jan/2006:15:04:05 -0700"),
+			"request":     fmt.Sprintf("%s %s %s", entry.Kind, entry.URI, entry.Protocol),
+			"status":      entry.ResponseCode,
+			"bytes":       entry.ResponseLength,
+		}
+		if ar.Format == "combined" {
+			fields["referer"] = orDash(entry.Referer)
+			fields["user_agent"] = orDash(entry.UserAgent)
+		}
+		return fields
+	}
+
+	fields := map[string]interface{}{
+		"@timestamp": entry.Timestamp.Format(time.RFC3339Nano),
+		"event": map[string]interface{}{
+			"dataset":  "request-monitor.access",
+			"duration": entry.RequestTime.Nanoseconds(),
+			"id":       entry.RequestID,
+		},
+		"http": map[string]interface{}{
+			"version": strings.TrimPrefix(entry.Protocol, "HTTP/"),
+			"request": map[string]interface{}{
+				"method": entry.Kind,
+				"bytes":  entry.RequestLenght,
+			},
+			"response": map[string]interface{}{
+				"status_code": entry.ResponseCode,
+				"bytes":       entry.ResponseLength,
+			},
+		},
+		"url": map[string]interface{}{
+			"path":     entry.Method,
+			"original": entry.URI,
+			"domain":   entry.Host,
+		},
+		"source": map[string]interface{}{
+			"address": entry.Client,
+			"ip":      remoteHost(entry.Client),
+		},
+		"service": map[string]interface{}{
+			"name": ar.VDCName,
+		},
+		"labels": map[string]interface{}{
+			"operation_id": entry.OperationID,
+		},
+	}
+
+	if entry.Principal != "" {
+		fields["user"] = map[string]interface{}{"name": entry.Principal}
+	}
+	if entry.UserAgent != "" {
+		fields["user_agent"] = map[string]interface{}{"original": entry.UserAgent}
+	}
+	if entry.TraceID != "" {
+		fields["trace"] = map[string]interface{}{"id": entry.TraceID}
+	}
+	if entry.Version != "" {
+		fields["service"].(map[string]interface{})["version"] = entry.Version
+	}
+	return fields
+}
+
+func remoteHost(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+//rotatingFile is a file that is rotated once it reaches maxSize megabytes,
+//keeping maxBackups old files as file.1 ... file.n
+type rotatingFile struct {
+	lock       sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+func newRotatingFile(path string, maxSize int, maxBackups int) (*rotatingFile, error) {
+	rf := &rotatingFile{
+		path:       path,
+		maxSize:    int64(maxSize) * 1024 * 1024,
+		maxBackups: maxBackups,
+	}
+	return rf, rf.open()
+}
+
+func (rf *rotatingFile) open() error {
+	file, err := os.OpenFile(rf.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	rf.file = file
+	rf.size = info.Size()
+	return nil
+}
+
+func (rf *rotatingFile) Write(data []byte) (int, error) {
+	rf.lock.Lock()
+	defer rf.lock.Unlock()
+
+	if rf.maxSize > 0 && rf.size+int64(len(data)) > rf.maxSize && rf.size > 0 {
+		err := rf.rotate()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := rf.file.Write(data)
+	rf.size += int64(n)
+	return n, err
+}
+
+func (rf *rotatingFile) rotate() error {
+	err := rf.file.Close()
+	if err != nil {
+		return err
+	}
+
+	if rf.maxBackups > 0 {
+		for i := rf.maxBackups - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", rf.path, i), fmt.Sprintf("%s.%d", rf.path, i+1))
+		}
+		os.Rename(rf.path, rf.path+".1")
+	} else {
+		os.Remove(rf.path)
+	}
+
+	return rf.open()
+}
+
+func (rf *rotatingFile) Close() error {
+	rf.lock.Lock()
+	defer rf.lock.Unlock()
+	return rf.file.Close()
+}
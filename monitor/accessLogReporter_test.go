@@ -0,0 +1,105 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+package monitor
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessLogFields(t *testing.T) {
+	req := httptest.NewRequest("GET", "/patient/1?full=true", nil)
+	req.Header.Set("User-Agent", "curl/7.58")
+
+	entry := newAccessLogEntry(req, MeterMessage{
+		RequestID:   "req-1",
+		OperationID: "getPatientBiographicalData",
+		Client:      "10.0.0.3:51234",
+		Method:      "/patient/1",
+		Kind:        "GET",
+		RequestTime: 42 * time.Millisecond,
+		Principal:   "alice",
+	}, 200, 512)
+
+	ar := accessLogReporter{Format: "combined", VDCName: "tubvdc"}
+	fields := ar.fields(entry)
+	if fields["request"] != "GET /patient/1?full=true HTTP/1.1" || fields["remote_host"] != "10.0.0.3" {
+		t.Fatalf("unexpected combined fields %v", fields)
+	}
+	if fields["auth_user"] != "alice" || fields["user_agent"] != "curl/7.58" || fields["referer"] != "-" {
+		t.Fatalf("unexpected combined fields %v", fields)
+	}
+
+	ar.Format = "common"
+	if _, ok := ar.fields(entry)["user_agent"]; ok {
+		t.Fatal("common format must not contain the user agent")
+	}
+
+	ar.Format = "ecs"
+	fields = ar.fields(entry)
+	response := fields["http"].(map[string]interface{})["response"].(map[string]interface{})
+	if response["status_code"] != 200 || response["bytes"] != int64(512) {
+		t.Fatalf("unexpected ecs response %v", response)
+	}
+	if fields["labels"].(map[string]interface{})["operation_id"] != "getPatientBiographicalData" {
+		t.Fatalf("unexpected ecs labels %v", fields["labels"])
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "accesslog")
+	if err != nil {
+		t.Fatalf("could not prepare test %+v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "access.log")
+	rf, err := newRotatingFile(path, 1, 2)
+	if err != nil {
+		t.Fatalf("could not open file %+v", err)
+	}
+
+	line := []byte(strings.Repeat("x", 400*1024) + "\n")
+	for i := 0; i < 10; i++ {
+		_, err = rf.Write(line)
+		if err != nil {
+			t.Fatalf("write failed %+v", err)
+		}
+	}
+	rf.Close()
+
+	for _, name := range []string{"access.log", "access.log.1", "access.log.2"} {
+		info, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("missing %s", name)
+		}
+		if info.Size() > 1024*1024 {
+			t.Fatalf("%s exceeds the max size", name)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "access.log.3")); err == nil {
+		t.Fatal("kept more backups than configured")
+	}
+}
@@ -0,0 +1,81 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+package monitor
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+//acmeHosts returns the host whitelist, either from the config or,
+//if none are configured, from the servers listed in the blueprint
+func (mon *RequestMonitor) acmeHosts() []string {
+	if len(mon.conf.ACMEHosts) > 0 {
+		return mon.conf.ACMEHosts
+	}
+	return mon.rawBlueprint.Hosts()
+}
+
+//newACMEManager creates the autocert manager used if UseACME is set
+func (mon *RequestMonitor) newACMEManager() (*autocert.Manager, error) {
+	hosts := mon.acmeHosts()
+	if len(hosts) == 0 {
+		log.Warn("no ACME hosts configured - all certificate requests will be rejected")
+	} else {
+		log.Infof("accepting ACME certificate requests for %v", hosts)
+	}
+
+	client := &acme.Client{
+		DirectoryURL: mon.conf.ACMEDirectoryURL,
+	}
+
+	if mon.conf.ACMECAFile != "" {
+		pem, err := ioutil.ReadFile(mon.conf.configPath(mon.conf.ACMECAFile))
+		if err != nil {
+			log.Errorf("could not read ACME CA file %+v", err)
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", mon.conf.ACMECAFile)
+		}
+
+		client.HTTPClient = &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{RootCAs: pool},
+			},
+		}
+	}
+
+	return &autocert.Manager{
+		Email:      mon.conf.ACMEEmail,
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(hosts...),
+		Cache:      autocert.DirCache(mon.conf.ACMECacheDir),
+		Client:     client,
+	}, nil
+}
@@ -0,0 +1,142 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+package monitor
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+func TestACMEManager(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acme")
+	if err != nil {
+		t.Fatalf("could not prepare test %+v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	blueprint := filepath.Join(dir, "blueprint.json")
+	err = ioutil.WriteFile(blueprint, []byte(`{"EXPOSED_API": {"servers": [
+		{"url": "https://vdc.example.com:8443/api"},
+		{"url": "http://10.0.0.12"},
+		{"url": "/relative"}
+	]}}`), 0644)
+	if err != nil {
+		t.Fatalf("could not prepare test %+v", err)
+	}
+	raw, err := readRawBlueprint(blueprint)
+	if err != nil {
+		t.Fatalf("could not read blueprint %+v", err)
+	}
+
+	conf := Configuration{
+		configDir:        dir,
+		ACMEEmail:        "ops@example.com",
+		ACMEDirectoryURL: "https://pebble:14000/dir",
+		ACMECacheDir:     filepath.Join(dir, ".certs"),
+	}
+	mon := RequestMonitor{conf: conf, rawBlueprint: raw}
+
+	manager, err := mon.newACMEManager()
+	if err != nil {
+		t.Fatalf("could not create manager %+v", err)
+	}
+	if manager.Email != conf.ACMEEmail {
+		t.Fatalf("expected the email %s got %s", conf.ACMEEmail, manager.Email)
+	}
+	if manager.Client.DirectoryURL != conf.ACMEDirectoryURL {
+		t.Fatalf("expected the directory %s got %s", conf.ACMEDirectoryURL, manager.Client.DirectoryURL)
+	}
+	if manager.Cache != autocert.DirCache(conf.ACMECacheDir) {
+		t.Fatalf("expected the cache %s got %v", conf.ACMECacheDir, manager.Cache)
+	}
+	if manager.Client.HTTPClient != nil {
+		t.Fatal("expected the default http client without an ACME CA file")
+	}
+
+	//the hosts of the servers in the blueprint are allowed
+	for host, allowed := range map[string]bool{
+		"vdc.example.com":   true,
+		"10.0.0.12":         true,
+		"example.com":       false,
+		"evil.example.com":  false,
+		"vdc.example.com.x": false,
+	} {
+		err := manager.HostPolicy(context.Background(), host)
+		if allowed != (err == nil) {
+			t.Fatalf("%s: expected allowed to be %t got %v", host, allowed, err)
+		}
+	}
+
+	//configured hosts replace the ones of the blueprint
+	mon.conf.ACMEHosts = []string{"api.example.com"}
+	manager, err = mon.newACMEManager()
+	if err != nil {
+		t.Fatalf("could not create manager %+v", err)
+	}
+	if err := manager.HostPolicy(context.Background(), "api.example.com"); err != nil {
+		t.Fatalf("expected the configured host to be allowed %+v", err)
+	}
+	if err := manager.HostPolicy(context.Background(), "vdc.example.com"); err == nil {
+		t.Fatal("expected the hosts of the blueprint to be rejected")
+	}
+}
+
+func TestACMEManagerWithoutHosts(t *testing.T) {
+	mon := RequestMonitor{conf: Configuration{ACMECacheDir: ".certs"}}
+
+	manager, err := mon.newACMEManager()
+	if err != nil {
+		t.Fatalf("could not create manager %+v", err)
+	}
+	if err := manager.HostPolicy(context.Background(), "vdc.example.com"); err == nil {
+		t.Fatal("expected all hosts to be rejected")
+	}
+}
+
+func TestACMECAFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acme")
+	if err != nil {
+		t.Fatalf("could not prepare test %+v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	err = generateCertificate(filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem"), certificateOptions{KeyType: "ecdsa"})
+	if err != nil {
+		t.Fatalf("could not prepare test %+v", err)
+	}
+
+	mon := RequestMonitor{conf: Configuration{configDir: dir, ACMECAFile: "ca.pem"}}
+	manager, err := mon.newACMEManager()
+	if err != nil {
+		t.Fatalf("could not create manager %+v", err)
+	}
+	if manager.Client.HTTPClient == nil {
+		t.Fatal("expected a http client that trusts the ACME CA")
+	}
+
+	mon.conf.ACMECAFile = "ca-key.pem"
+	if _, err := mon.newACMEManager(); err == nil {
+		t.Fatal("expected an error for a CA file without certificates")
+	}
+}
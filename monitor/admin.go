@@ -0,0 +1,153 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+package monitor
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+//states of the sinks the reporters deliver to
+const (
+	sinkConnecting = "connecting"
+	sinkUp         = "up"
+	sinkDegraded   = "degraded"
+)
+
+//sinkRegistry tracks the state of the reporter sinks for the readiness endpoint
+type sinkRegistry struct {
+	lock   sync.Mutex
+	states map[string]string
+}
+
+var sinks = &sinkRegistry{states: make(map[string]string)}
+
+//Set updates the state of a sink
+func (sr *sinkRegistry) Set(name string, state string) {
+	sr.lock.Lock()
+	sr.states[name] = state
+	sr.lock.Unlock()
+
+	up := 0.0
+	if state == sinkUp {
+		up = 1
+	}
+	metrics.Set(fmt.Sprintf("request_monitor_sink_up{sink=%q}", name), up)
+}
+
+//States returns a copy of all sink states
+func (sr *sinkRegistry) States() map[string]string {
+	sr.lock.Lock()
+	defer sr.lock.Unlock()
+
+	states := make(map[string]string, len(sr.states))
+	for name, state := range sr.states {
+		states[name] = state
+	}
+	return states
+}
+
+//Degraded returns the sorted names of all sinks that are not up
+func (sr *sinkRegistry) Degraded() []string {
+	degraded := make([]string, 0)
+	for name, state := range sr.States() {
+		if state != sinkUp {
+			degraded = append(degraded, name)
+		}
+	}
+	sort.Strings(degraded)
+	return degraded
+}
+
+//startAdmin serves the internal endpoints of the monitor on the AdminAddress,
+//it is kept separate from the proxied traffic
+func (mon *RequestMonitor) startAdmin() {
+	if mon.conf.AdminAddress == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		metrics.WriteTo(w)
+	})
+	mux.HandleFunc("/certificate", mon.serveCertificate)
+	mux.HandleFunc("/ready", serveReadiness)
+	mux.HandleFunc("/config", mon.serveConfig)
+
+	adminServer := &http.Server{
+		Addr:    mon.conf.AdminAddress,
+		Handler: mux,
+	}
+
+	go func() {
+		log.Infof("admin endpoint listening on %s", mon.conf.AdminAddress)
+		err := adminServer.ListenAndServe()
+		if err != nil {
+			log.Errorf("admin endpoint failed with %s", err)
+		}
+	}()
+}
+
+//serveCertificate exports the certificate used for https so that clients can pin it
+func (mon *RequestMonitor) serveCertificate(w http.ResponseWriter, req *http.Request) {
+	if mon.certificates == nil {
+		http.Error(w, "no self signed certificate in use", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.Header().Set("X-Certificate-SHA256", mon.certificates.Fingerprint())
+	w.Write(mon.certificates.PEM())
+}
+
+//serveReadiness reports the state of the sinks. The proxy serves requests while sinks are degraded,
+//so the endpoint only fails with ?strict if any sink is not up
+func serveReadiness(w http.ResponseWriter, req *http.Request) {
+	degraded := sinks.Degraded()
+
+	status := "ready"
+	if len(degraded) > 0 {
+		status = "degraded"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if len(degraded) > 0 {
+		if _, strict := req.URL.Query()["strict"]; strict {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":   status,
+		"sinks":    sinks.States(),
+		"degraded": degraded,
+	})
+}
+
+//serveConfig returns the configuration in use, without secrets
+func (mon *RequestMonitor) serveConfig(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(mon.conf.redacted())
+}
@@ -0,0 +1,253 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+package monitor
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var errUnauthenticated = errors.New("no valid credentials")
+
+//principal is the authenticated caller of a request
+type principal struct {
+	Name  string
+	Roles []string
+}
+
+//HasAnyRole checks if the principal has at least one of the given roles
+func (p *principal) HasAnyRole(roles []string) bool {
+	for _, required := range roles {
+		for _, role := range p.Roles {
+			if role == required {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//authenticator extracts a principal from a request, it returns errUnauthenticated
+//if the request does not carry credentials for this method
+type authenticator interface {
+	Authenticate(req *http.Request) (*principal, error)
+	Challenge() string
+}
+
+//authGateway authenticates requests and enforces the role rules of each operation
+type authGateway struct {
+	authenticators []authenticator
+	rules          map[string][]string
+}
+
+//credential is an entry of the AuthUsersFile or AuthAPIKeysFile
+type credential struct {
+	Name     string   `json:"name"`
+	Password string   `json:"password"`
+	Roles    []string `json:"roles"`
+}
+
+//newAuthGateway creates the gateway for the configured AuthMethods,
+//returns nil if authentication is disabled
+func newAuthGateway(conf Configuration, blueprint *rawBlueprint) (*authGateway, error) {
+	if len(conf.AuthMethods) == 0 {
+		return nil, nil
+	}
+
+	gateway := &authGateway{
+		authenticators: make([]authenticator, 0),
+		rules:          make(map[string][]string),
+	}
+
+	for _, method := range conf.AuthMethods {
+		var auth authenticator
+		var err error
+		switch strings.ToLower(method) {
+		case "jwt":
+			auth, err = newJWTAuthenticator(conf)
+		case "apikey":
+			auth, err = newAPIKeyAuthenticator(conf)
+		case "basic":
+			auth, err = newBasicAuthenticator(conf)
+		default:
+			err = fmt.Errorf("unknown auth method %s", method)
+		}
+		if err != nil {
+			return nil, err
+		}
+		gateway.authenticators = append(gateway.authenticators, auth)
+	}
+
+	//viper lowercases the keys of AuthRules, so the rules are matched case-insensitively
+	if conf.AuthRulesFromBlueprint {
+		for operationID, roles := range blueprint.ACLRoles() {
+			gateway.rules[strings.ToLower(operationID)] = roles
+		}
+	}
+
+	for operationID, roles := range conf.AuthRules {
+		gateway.rules[strings.ToLower(operationID)] = roles
+	}
+
+	log.Infof("authentication enabled using %v with rules %v", conf.AuthMethods, gateway.rules)
+	return gateway, nil
+}
+
+//Check authenticates the request and verifies that the principal may call the operation,
+//if not the returned status code should be send to the client. If rules are configured,
+//requests that do not resolve to an operation are denied.
+func (ag *authGateway) Check(req *http.Request, operationID string) (*principal, int, error) {
+	var caller *principal
+	for _, auth := range ag.authenticators {
+		p, err := auth.Authenticate(req)
+		if err == errUnauthenticated {
+			continue
+		}
+		if err != nil {
+			return nil, http.StatusUnauthorized, err
+		}
+		caller = p
+		break
+	}
+
+	if caller == nil {
+		return nil, http.StatusUnauthorized, errUnauthenticated
+	}
+
+	if operationID == "" && len(ag.rules) > 0 {
+		return caller, http.StatusForbidden, fmt.Errorf("%s may not call requests that do not resolve to an operation", caller.Name)
+	}
+
+	if roles, ok := ag.rules[strings.ToLower(operationID)]; ok && len(roles) > 0 {
+		if !caller.HasAnyRole(roles) {
+			return caller, http.StatusForbidden, fmt.Errorf("%s is not allowed to call %s", caller.Name, operationID)
+		}
+	}
+
+	return caller, http.StatusOK, nil
+}
+
+//Challenge sets the WWW-Authenticate headers for all authenticators
+func (ag *authGateway) Challenge(w http.ResponseWriter) {
+	for _, auth := range ag.authenticators {
+		w.Header().Add("WWW-Authenticate", auth.Challenge())
+	}
+}
+
+func readCredentials(file string) (map[string]credential, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	credentials := make(map[string]credential)
+	err = json.Unmarshal(data, &credentials)
+	if err != nil {
+		return nil, err
+	}
+	return credentials, nil
+}
+
+type apiKeyAuthenticator struct {
+	header string
+	keys   map[string]credential
+}
+
+func newAPIKeyAuthenticator(conf Configuration) (*apiKeyAuthenticator, error) {
+	keys, err := readCredentials(conf.configPath(conf.AuthAPIKeysFile))
+	if err != nil {
+		log.Errorf("could not read api keys %+v", err)
+		return nil, err
+	}
+
+	header := conf.AuthAPIKeyHeader
+	if header == "" {
+		header = "X-API-Key"
+	}
+
+	return &apiKeyAuthenticator{
+		header: header,
+		keys:   keys,
+	}, nil
+}
+
+func (a *apiKeyAuthenticator) Authenticate(req *http.Request) (*principal, error) {
+	key := req.Header.Get(a.header)
+	if key == "" {
+		return nil, errUnauthenticated
+	}
+
+	for candidate, cred := range a.keys {
+		if subtle.ConstantTimeCompare([]byte(candidate), []byte(key)) == 1 {
+			return &principal{Name: cred.Name, Roles: cred.Roles}, nil
+		}
+	}
+	return nil, errors.New("unknown api key")
+}
+
+func (a *apiKeyAuthenticator) Challenge() string {
+	return fmt.Sprintf("APIKey header=%q", a.header)
+}
+
+type basicAuthenticator struct {
+	users map[string]credential
+}
+
+func newBasicAuthenticator(conf Configuration) (*basicAuthenticator, error) {
+	users, err := readCredentials(conf.configPath(conf.AuthUsersFile))
+	if err != nil {
+		log.Errorf("could not read users %+v", err)
+		return nil, err
+	}
+	return &basicAuthenticator{users: users}, nil
+}
+
+func (a *basicAuthenticator) Authenticate(req *http.Request) (*principal, error) {
+	username, password, ok := req.BasicAuth()
+	if !ok {
+		return nil, errUnauthenticated
+	}
+
+	user, ok := a.users[username]
+	if !ok {
+		return nil, errors.New("unknown user")
+	}
+
+	err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password))
+	if err != nil {
+		return nil, errors.New("wrong password")
+	}
+
+	name := user.Name
+	if name == "" {
+		name = username
+	}
+	return &principal{Name: name, Roles: user.Roles}, nil
+}
+
+func (a *basicAuthenticator) Challenge() string {
+	return `Basic realm="VDC"`
+}
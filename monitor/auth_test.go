@@ -0,0 +1,273 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+package monitor
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func signToken(t *testing.T, key *rsa.PrivateKey, claims map[string]interface{}) string {
+	header, _ := json.Marshal(jwtHeader{Alg: "RS256", Kid: "test"})
+	payload, _ := json.Marshal(claims)
+
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	hasher := crypto.SHA256.New()
+	hasher.Write([]byte(unsigned))
+
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hasher.Sum(nil))
+	if err != nil {
+		t.Fatalf("could not sign token %+v", err)
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func writeJSON(t *testing.T, file string, v interface{}) {
+	data, _ := json.Marshal(v)
+	err := ioutil.WriteFile(file, data, 0600)
+	if err != nil {
+		t.Fatalf("could not prepare test %+v", err)
+	}
+}
+
+func prepareAuthConfig(t *testing.T, key *rsa.PrivateKey) Configuration {
+	dir, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatalf("could not prepare test %+v", err)
+	}
+
+	writeJSON(t, filepath.Join(dir, "jwks.json"), map[string]interface{}{
+		"keys": []jsonWebKey{{
+			Kty: "RSA",
+			Kid: "test",
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}},
+	})
+
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	writeJSON(t, filepath.Join(dir, "users.json"), map[string]credential{
+		"alice": {Password: string(hash), Roles: []string{"doctor_er_id"}},
+	})
+	writeJSON(t, filepath.Join(dir, "apikeys.json"), map[string]credential{
+		"key-1": {Name: "research-app", Roles: []string{"researcher_id"}},
+	})
+
+	return Configuration{
+		configDir:              dir,
+		AuthMethods:            []string{"jwt", "apikey", "basic"},
+		AuthJWKSFile:           "jwks.json",
+		AuthJWTIssuer:          "https://idp.local",
+		AuthRolesClaim:         "realm_access.roles",
+		AuthAPIKeysFile:        "apikeys.json",
+		AuthUsersFile:          "users.json",
+		AuthRulesFromBlueprint: true,
+	}
+}
+
+func TestAuthGateway(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("could not prepare test %+v", err)
+	}
+
+	conf := prepareAuthConfig(t, key)
+	defer os.RemoveAll(conf.configDir)
+
+	raw, err := readRawBlueprint(filepath.Join("..", "resources", "blueprint.json"))
+	if err != nil {
+		t.Fatalf("could not read blueprint %+v", err)
+	}
+
+	gateway, err := newAuthGateway(conf, raw)
+	if err != nil {
+		t.Fatalf("could not create gateway %+v", err)
+	}
+
+	doctorToken := signToken(t, key, map[string]interface{}{
+		"sub":          "dr-house",
+		"iss":          "https://idp.local",
+		"exp":          time.Now().Add(time.Hour).Unix(),
+		"realm_access": map[string]interface{}{"roles": []string{"doctor_er_id"}},
+	})
+	expiredToken := signToken(t, key, map[string]interface{}{
+		"sub": "dr-house",
+		"iss": "https://idp.local",
+		"exp": time.Now().Add(-time.Hour).Unix(),
+	})
+
+	tests := []struct {
+		name      string
+		header    string
+		value     string
+		operation string
+		status    int
+		principal string
+	}{
+		{"no credentials", "", "", "getPatientBiographicalData", http.StatusUnauthorized, ""},
+		{"jwt allowed", "Authorization", "Bearer " + doctorToken, "getPatientBiographicalData", http.StatusOK, "dr-house"},
+		{"jwt forbidden", "Authorization", "Bearer " + doctorToken, "getBloodTestComponentAverage", http.StatusForbidden, "dr-house"},
+		{"jwt expired", "Authorization", "Bearer " + expiredToken, "getPatientBiographicalData", http.StatusUnauthorized, ""},
+		{"jwt tampered", "Authorization", "Bearer " + doctorToken + "x", "getPatientBiographicalData", http.StatusUnauthorized, ""},
+		{"api key allowed", "X-API-Key", "key-1", "getBloodTestComponentAverage", http.StatusOK, "research-app"},
+		{"api key unknown", "X-API-Key", "key-2", "getBloodTestComponentAverage", http.StatusUnauthorized, ""},
+		{"basic allowed", "Authorization", "Basic " + base64.StdEncoding.EncodeToString([]byte("alice:secret")), "getLastValuesForBloodTest", http.StatusOK, "alice"},
+		{"basic wrong password", "Authorization", "Basic " + base64.StdEncoding.EncodeToString([]byte("alice:guess")), "getLastValuesForBloodTest", http.StatusUnauthorized, ""},
+		{"unknown operation", "X-API-Key", "key-1", "", http.StatusForbidden, "research-app"},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/patient/1", nil)
+		if test.header != "" {
+			req.Header.Set(test.header, test.value)
+		}
+
+		p, status, err := gateway.Check(req, test.operation)
+		if status != test.status {
+			t.Fatalf("%s: expected status %d got %d (%v)", test.name, test.status, status, err)
+		}
+
+		name := ""
+		if p != nil {
+			name = p.Name
+		}
+		if name != test.principal {
+			t.Fatalf("%s: expected principal %q got %q", test.name, test.principal, name)
+		}
+	}
+}
+
+func TestAuthGatewayDisabled(t *testing.T) {
+	gateway, err := newAuthGateway(Configuration{}, nil)
+	if err != nil || gateway != nil {
+		t.Fatalf("expected no gateway, got %v %v", gateway, err)
+	}
+}
+
+func TestAuthRulesFromConfig(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("could not prepare test %+v", err)
+	}
+
+	dir := prepareAuthConfig(t, key).configDir
+	defer os.RemoveAll(dir)
+
+	//viper lowercases the operationIDs of the config file
+	conf, err := loadConfig(t, dir, `{
+		"Endpoint": "http://localhost:8080",
+		"ElasticSearchURL": "http://localhost:9200",
+		"AuthMethods": ["apikey"],
+		"AuthAPIKeysFile": "apikeys.json",
+		"AuthRules": {"getLastValuesForBloodTest": ["admin"]}
+	}`)
+	if err != nil {
+		t.Fatalf("could not read config %+v", err)
+	}
+
+	gateway, err := newAuthGateway(conf, nil)
+	if err != nil {
+		t.Fatalf("could not create gateway %+v", err)
+	}
+
+	req := httptest.NewRequest("GET", "/patient/1/blood-test", nil)
+	req.Header.Set("X-API-Key", "key-1")
+	if _, status, _ := gateway.Check(req, "getLastValuesForBloodTest"); status != http.StatusForbidden {
+		t.Fatalf("expected the rule of the config to apply, got %d", status)
+	}
+	if _, status, _ := gateway.Check(req, "getPatientBiographicalData"); status != http.StatusOK {
+		t.Fatalf("expected operations without rules to be allowed, got %d", status)
+	}
+}
+
+func TestAuthResolvesWholePath(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("could not prepare test %+v", err)
+	}
+
+	var calls int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+	}))
+	defer upstream.Close()
+
+	conf := prepareAuthConfig(t, key)
+	defer os.RemoveAll(conf.configDir)
+
+	raw, err := readRawBlueprint(filepath.Join("..", "resources", "blueprint.json"))
+	if err != nil {
+		t.Fatalf("could not read blueprint %+v", err)
+	}
+
+	mon := newProxyStandIn(t, conf, upstream.URL)
+	mon.auth, err = newAuthGateway(mon.conf, raw)
+	if err != nil {
+		t.Fatalf("could not create gateway %+v", err)
+	}
+
+	tests := []struct {
+		name   string
+		path   string
+		status int
+		calls  int32
+	}{
+		{"allowed", "/blood-test/component/a/average/1-2", http.StatusOK, 1},
+		{"traversal", "/blood-test/component/a/average/1-2/../../../../patient/123", http.StatusBadRequest, 1},
+		{"empty segment", "/blood-test/component/a/average/1-2//patient/123", http.StatusBadRequest, 1},
+		{"suffix", "/blood-test/component/a/average/1-2/patient/123", http.StatusForbidden, 1},
+		{"prefix", "/patient/123/blood-test/component/a/average/1-2", http.StatusForbidden, 1},
+		{"not allowed", "/patient/123", http.StatusForbidden, 1},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", test.path, nil)
+		req.Header.Set("X-API-Key", "key-1")
+		w := httptest.NewRecorder()
+		mon.serve(w, req)
+
+		if w.Code != test.status {
+			t.Fatalf("%s: expected status %d got %d", test.name, test.status, w.Code)
+		}
+		if n := atomic.LoadInt32(&calls); n != test.calls {
+			t.Fatalf("%s: expected %d upstream calls got %d", test.name, test.calls, n)
+		}
+	}
+
+	if op, _ := mon.cache.MatchExact("/blood-test/component/a/average/1-2/patient/123", "GET"); op != "" {
+		t.Fatalf("expected no exact match for a longer path, got %s", op)
+	}
+	if op, _ := mon.cache.MatchExact("/blood-test/component/a/average/1-2/", "GET"); op != "getBloodTestComponentAverage" {
+		t.Fatalf("expected an exact match with a trailing slash, got %q", op)
+	}
+}
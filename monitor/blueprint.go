@@ -0,0 +1,178 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+package monitor
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+)
+
+//rawBlueprint holds the parts of the blueprint that are not covered by blueprint-go
+type rawBlueprint struct {
+	ExposedAPI struct {
+		Servers []struct {
+			URL string `json:"url"`
+		} `json:"servers"`
+	} `json:"EXPOSED_API"`
+
+	InternalStructure struct {
+		Overview struct {
+			Tags []struct {
+				MethodID string   `json:"method_id"`
+				Tags     []string `json:"tags"`
+			} `json:"tags"`
+		} `json:"Overview"`
+	} `json:"INTERNAL_STRUCTURE"`
+
+	DataManagement []struct {
+		MethodID   string `json:"method_id"`
+		Attributes struct {
+			Security []blueprintAttribute `json:"security"`
+		} `json:"attributes"`
+	} `json:"DATA_MANAGEMENT"`
+}
+
+type blueprintAttribute struct {
+	ID         string                       `json:"id"`
+	Type       string                       `json:"type"`
+	Properties map[string]blueprintProperty `json:"properties"`
+}
+
+type blueprintProperty struct {
+	Unit  string      `json:"unit"`
+	Value interface{} `json:"value"`
+}
+
+//Strings returns the value of a property as a list of strings
+func (bp blueprintProperty) Strings() []string {
+	switch v := bp.Value.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, e := range v {
+			if str, ok := e.(string); ok {
+				values = append(values, str)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+func readRawBlueprint(path string) (*rawBlueprint, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw rawBlueprint
+	err = json.Unmarshal(data, &raw)
+	if err != nil {
+		return nil, err
+	}
+	return &raw, nil
+}
+
+//Hosts returns the host names of all servers listed in the exposed api
+func (rb *rawBlueprint) Hosts() []string {
+	hosts := make([]string, 0)
+	if rb == nil {
+		return hosts
+	}
+
+	for _, server := range rb.ExposedAPI.Servers {
+		u, err := url.Parse(server.URL)
+		if err != nil || u.Hostname() == "" {
+			continue
+		}
+		hosts = append(hosts, u.Hostname())
+	}
+	return hosts
+}
+
+//SecurityAttributes returns all security attributes of the given operation with the given type
+func (rb *rawBlueprint) SecurityAttributes(methodID string, attributeType string) []blueprintAttribute {
+	attributes := make([]blueprintAttribute, 0)
+	if rb == nil {
+		return attributes
+	}
+
+	for _, dm := range rb.DataManagement {
+		if dm.MethodID != methodID {
+			continue
+		}
+		for _, attr := range dm.Attributes.Security {
+			if attr.Type == attributeType {
+				attributes = append(attributes, attr)
+			}
+		}
+	}
+	return attributes
+}
+
+//ACLRoles returns the roles (ACL credentials) that may access each operation
+func (rb *rawBlueprint) ACLRoles() map[string][]string {
+	roles := make(map[string][]string)
+	if rb == nil {
+		return roles
+	}
+
+	for _, dm := range rb.DataManagement {
+		for _, attr := range dm.Attributes.Security {
+			if attr.Type != "ACL" {
+				continue
+			}
+			if credentials, ok := attr.Properties["credentials"]; ok {
+				roles[dm.MethodID] = append(roles[dm.MethodID], credentials.Strings()...)
+			}
+		}
+	}
+	return roles
+}
+
+//Tags returns the tags of the given operation listed in the overview
+func (rb *rawBlueprint) Tags(methodID string) []string {
+	if rb == nil {
+		return nil
+	}
+
+	for _, tags := range rb.InternalStructure.Overview.Tags {
+		if tags.MethodID == methodID {
+			return tags.Tags
+		}
+	}
+	return nil
+}
+
+//TracedOperations returns all operations with a Tracing security attribute
+func (rb *rawBlueprint) TracedOperations() []string {
+	operations := make([]string, 0)
+	if rb == nil {
+		return operations
+	}
+
+	for _, dm := range rb.DataManagement {
+		if len(rb.SecurityAttributes(dm.MethodID, "Tracing")) > 0 {
+			operations = append(operations, dm.MethodID)
+		}
+	}
+	return operations
+}
@@ -0,0 +1,376 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+
+package monitor
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+)
+
+//responseCache stores the responses of idempotent operations in memory and/or on disk,
+//following the Cache-Control directives of a shared cache
+type responseCache struct {
+	ttls    map[string]time.Duration
+	memory  *lru.Cache
+	dir     string
+	maxBody int
+	quit    chan struct{}
+}
+
+//cacheLookup describes how a request is handled by the cache
+type cacheLookup struct {
+	key    string
+	ttl    time.Duration
+	status string //hit, miss or bypass, empty if the request is not cacheable
+}
+
+//cachedResponse is a stored response
+type cachedResponse struct {
+	Key     string
+	Status  int
+	Header  http.Header
+	Body    []byte
+	Stored  time.Time
+	Expires time.Time
+}
+
+//newResponseCache creates the cache for the operations in CacheTTL
+func newResponseCache(conf Configuration) (*responseCache, error) {
+	rc := &responseCache{
+		ttls:    make(map[string]time.Duration),
+		dir:     conf.configPath(conf.CacheDir),
+		maxBody: conf.CacheMaxBodySize * 1024 * 1024,
+		quit:    make(chan struct{}),
+	}
+
+	//map keys of the config are lower case, see viper
+	for operationID, ttl := range conf.CacheTTL {
+		rc.ttls[strings.ToLower(operationID)] = ttl
+	}
+
+	if conf.CacheMaxEntries > 0 {
+		memory, err := lru.New(conf.CacheMaxEntries)
+		if err != nil {
+			return nil, err
+		}
+		rc.memory = memory
+	}
+
+	if rc.dir != "" {
+		err := os.MkdirAll(rc.dir, 0700)
+		if err != nil {
+			log.Errorf("could not create cache directory %+v", err)
+			return nil, err
+		}
+	}
+
+	return rc, nil
+}
+
+//Start removes expired responses from the disk every interval
+func (rc *responseCache) Start(interval time.Duration) {
+	if rc.dir == "" {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				rc.sweep()
+			case <-rc.quit:
+				return
+			}
+		}
+	}()
+}
+
+//Stop terminates the sweeper
+func (rc *responseCache) Stop() {
+	close(rc.quit)
+}
+
+//Lookup returns how the request is cached and the cached response on a hit,
+//the principal and version are part of the key so that responses are not shared between them
+func (rc *responseCache) Lookup(req *http.Request, operationID string, principal string, version string) (cacheLookup, *cachedResponse) {
+	if rc == nil || (req.Method != "GET" && req.Method != "HEAD") {
+		return cacheLookup{}, nil
+	}
+
+	ttl, ok := rc.ttls[strings.ToLower(operationID)]
+	if !ok || ttl <= 0 {
+		return cacheLookup{}, nil
+	}
+
+	directives := cacheControl(req.Header)
+	if _, ok := directives["no-store"]; ok {
+		return cacheLookup{}, nil
+	}
+
+	lookup := cacheLookup{
+		key: cacheKey(req, operationID, principal, version),
+		ttl: ttl,
+	}
+	if _, ok := directives["no-cache"]; ok {
+		lookup.status = "bypass"
+		return lookup, nil
+	}
+
+	maxAge := time.Duration(-1)
+	if value, ok := directives["max-age"]; ok {
+		if seconds, err := strconv.Atoi(value); err == nil {
+			maxAge = time.Duration(seconds) * time.Second
+		}
+	}
+
+	cached := rc.get(lookup.key)
+	if cached == nil || (maxAge >= 0 && time.Now().Sub(cached.Stored) > maxAge) {
+		lookup.status = "miss"
+		metrics.Add("request_monitor_cache_misses_total", 1)
+		return lookup, nil
+	}
+
+	lookup.status = "hit"
+	metrics.Add("request_monitor_cache_hits_total", 1)
+	return lookup, cached
+}
+
+//Store keeps the response the client received, if the response allows it
+func (rc *responseCache) Store(lookup cacheLookup, rec *responseRecorder) {
+	if rc == nil || lookup.status == "" || rec.StatusCode() != http.StatusOK {
+		return
+	}
+
+	body, complete := rec.Body()
+	header := rec.Header()
+	if !complete || header.Get("Set-Cookie") != "" {
+		return
+	}
+
+	//only the negotiated encoding and type are part of the key
+	for _, vary := range header["Vary"] {
+		for _, name := range strings.Split(vary, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name != "Accept" && name != "Accept-Encoding" && name != "" {
+				return
+			}
+		}
+	}
+
+	ttl := lookup.ttl
+	directives := cacheControl(header)
+	for _, directive := range []string{"no-store", "no-cache", "private"} {
+		if _, ok := directives[directive]; ok {
+			return
+		}
+	}
+	for _, directive := range []string{"s-maxage", "max-age"} {
+		if value, ok := directives[directive]; ok {
+			if seconds, err := strconv.Atoi(value); err == nil {
+				if time.Duration(seconds)*time.Second < ttl {
+					ttl = time.Duration(seconds) * time.Second
+				}
+				break
+			}
+		}
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	now := time.Now()
+	stored := &cachedResponse{
+		Key:     lookup.key,
+		Status:  rec.StatusCode(),
+		Header:  cloneHeader(header),
+		Body:    []byte(body),
+		Stored:  now,
+		Expires: now.Add(ttl),
+	}
+	stored.Header.Del("X-Cache")
+	rc.put(stored)
+	metrics.Add("request_monitor_cache_stored_total", 1)
+}
+
+func (rc *responseCache) get(key string) *cachedResponse {
+	if rc.memory != nil {
+		if value, ok := rc.memory.Get(key); ok {
+			cached := value.(*cachedResponse)
+			if time.Now().Before(cached.Expires) {
+				return cached
+			}
+			rc.memory.Remove(key)
+		}
+	}
+
+	if rc.dir == "" {
+		return nil
+	}
+
+	path := rc.path(key)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+
+	var cached cachedResponse
+	err = json.Unmarshal(data, &cached)
+	if err != nil || cached.Key != key || !time.Now().Before(cached.Expires) {
+		os.Remove(path)
+		return nil
+	}
+
+	if rc.memory != nil {
+		rc.memory.Add(key, &cached)
+	}
+	return &cached
+}
+
+func (rc *responseCache) put(cached *cachedResponse) {
+	if rc.memory != nil {
+		rc.memory.Add(cached.Key, cached)
+		metrics.Set("request_monitor_cache_entries", float64(rc.memory.Len()))
+	}
+
+	if rc.dir == "" {
+		return
+	}
+
+	data, err := json.Marshal(cached)
+	if err != nil {
+		log.Debugf("could not encode cached response %+v", err)
+		return
+	}
+
+	//written to a temporary file first, so readers never see partial responses
+	path := rc.path(cached.Key)
+	tmp := fmt.Sprintf("%s.%d.tmp", path, time.Now().UnixNano())
+	err = ioutil.WriteFile(tmp, data, 0600)
+	if err == nil {
+		//the modification time is the expiry, see sweep
+		os.Chtimes(tmp, cached.Expires, cached.Expires)
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		log.Debugf("could not write cached response %+v", err)
+	}
+}
+
+func (rc *responseCache) path(key string) string {
+	return filepath.Join(rc.dir, key+".json")
+}
+
+//sweep removes the expired responses from the disk
+func (rc *responseCache) sweep() {
+	files, err := ioutil.ReadDir(rc.dir)
+	if err != nil {
+		log.Debugf("could not read cache directory %+v", err)
+		return
+	}
+
+	now := time.Now()
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), ".json") && file.ModTime().Before(now) {
+			os.Remove(filepath.Join(rc.dir, file.Name()))
+		}
+	}
+}
+
+//credentialHeaders carry the credentials the Endpoint may authorize requests with,
+//responses are only shared among requests with the same credentials
+var credentialHeaders = []string{"Authorization", "Cookie", "X-API-Key"}
+
+//cacheKey identifies the response of an operation by its parameters, i.e., the path and the query,
+//and by the credentials of the caller
+func cacheKey(req *http.Request, operationID string, principal string, version string) string {
+	//the URL of the request already points to the Endpoint
+	path, query := req.URL.Path, req.URL.Query()
+	if uri, err := url.ParseRequestURI(req.RequestURI); err == nil {
+		path, query = uri.Path, uri.Query()
+	}
+
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n%s\n", strings.ToLower(operationID), req.Method, path)
+	for _, name := range names {
+		values := append([]string(nil), query[name]...)
+		sort.Strings(values)
+		fmt.Fprintf(h, "%s=%s\n", name, strings.Join(values, ","))
+	}
+	fmt.Fprintf(h, "%s\n%s\n%s\n%s\n", principal, version, req.Header.Get("Accept"), req.Header.Get("Accept-Encoding"))
+	for _, name := range credentialHeaders {
+		fmt.Fprintf(h, "%s\n", strings.Join(req.Header[name], ","))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+//cacheControl parses the Cache-Control directives of a header
+func cacheControl(header http.Header) map[string]string {
+	directives := make(map[string]string)
+	for _, value := range header["Cache-Control"] {
+		for _, directive := range strings.Split(value, ",") {
+			directive = strings.TrimSpace(directive)
+			if directive == "" {
+				continue
+			}
+			parts := strings.SplitN(directive, "=", 2)
+			name := strings.ToLower(parts[0])
+			if len(parts) == 2 {
+				directives[name] = strings.Trim(parts[1], `"`)
+			} else {
+				directives[name] = ""
+			}
+		}
+	}
+	return directives
+}
+
+//WriteTo sends the stored response to the client
+func (cr *cachedResponse) WriteTo(w http.ResponseWriter) {
+	header := w.Header()
+	for key, values := range cr.Header {
+		header[key] = values
+	}
+	header.Set("Age", strconv.Itoa(int(time.Now().Sub(cr.Stored).Seconds())))
+
+	w.WriteHeader(cr.Status)
+	w.Write(cr.Body)
+}
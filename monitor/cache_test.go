@@ -0,0 +1,210 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+
+package monitor
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestResponseCache(t *testing.T) {
+	var calls int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		if r.URL.Query().Get("store") == "no" {
+			w.Header().Set("Cache-Control", "no-store")
+		} else {
+			w.Header().Set("Cache-Control", "max-age=60")
+		}
+		fmt.Fprintf(w, `{"call":%d}`, n)
+	}))
+	defer upstream.Close()
+
+	dir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatalf("could not prepare test %+v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	conf := Configuration{
+		CacheTTL:         map[string]time.Duration{"getpatientbiographicaldata": time.Minute},
+		CacheMaxEntries:  10,
+		CacheDir:         dir,
+		CacheMaxBodySize: 1,
+	}
+	mon := newProxyStandIn(t, conf, upstream.URL)
+	mon.responses, err = newResponseCache(mon.conf)
+	if err != nil {
+		t.Fatalf("could not create cache %+v", err)
+	}
+
+	get := func(uri string, cacheControl string) (*httptest.ResponseRecorder, MeterMessage) {
+		for len(mon.monitorQueue) > 0 {
+			<-mon.monitorQueue
+		}
+		req := httptest.NewRequest("GET", uri, nil)
+		if cacheControl != "" {
+			req.Header.Set("Cache-Control", cacheControl)
+		}
+		w := httptest.NewRecorder()
+		mon.serve(w, req)
+		//the meter of the monitor is the last one
+		var meter MeterMessage
+		for len(mon.monitorQueue) > 0 {
+			meter = <-mon.monitorQueue
+		}
+		return w, meter
+	}
+
+	w, meter := get("/patient/42?a=1&b=2", "")
+	if w.Body.String() != `{"call":1}` || w.Header().Get("X-Cache") != "MISS" || meter.Cache != "miss" {
+		t.Fatalf("expected a miss, got %s %v %+v", w.Body.String(), w.Header(), meter)
+	}
+
+	//the parameter order does not matter
+	w, meter = get("/patient/42?b=2&a=1", "")
+	if w.Body.String() != `{"call":1}` || w.Header().Get("X-Cache") != "HIT" || meter.Cache != "hit" || meter.ResponseCode != http.StatusOK {
+		t.Fatalf("expected a hit, got %s %v %+v", w.Body.String(), w.Header(), meter)
+	}
+
+	w, meter = get("/patient/42?a=1&b=2", "no-cache")
+	if w.Body.String() != `{"call":2}` || meter.Cache != "bypass" {
+		t.Fatalf("expected no-cache to bypass the cache, got %s %+v", w.Body.String(), meter)
+	}
+
+	w, _ = get("/patient/43", "")
+	if w.Body.String() != `{"call":3}` {
+		t.Fatalf("expected other parameters to miss, got %s", w.Body.String())
+	}
+
+	get("/patient/42?store=no", "")
+	w, _ = get("/patient/42?store=no", "")
+	if w.Body.String() != `{"call":5}` {
+		t.Fatalf("expected no-store responses not to be cached, got %s", w.Body.String())
+	}
+
+	//other operations are not cached
+	w, meter = get("/unknown", "")
+	if w.Header().Get("X-Cache") != "" || meter.Cache != "" {
+		t.Fatalf("expected the operation not to be cached, got %v %+v", w.Header(), meter)
+	}
+
+	//a new cache finds the responses on disk
+	mon.responses, err = newResponseCache(Configuration{CacheTTL: conf.CacheTTL, CacheDir: dir, CacheMaxBodySize: 1})
+	if err != nil {
+		t.Fatalf("could not create cache %+v", err)
+	}
+	w, _ = get("/patient/43", "")
+	if w.Body.String() != `{"call":3}` || w.Header().Get("X-Cache") != "HIT" {
+		t.Fatalf("expected a hit from the disk, got %s %v", w.Body.String(), w.Header())
+	}
+}
+
+func TestResponseCacheCredentials(t *testing.T) {
+	var calls int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		fmt.Fprintf(w, `{"call":%d,"auth":%q}`, n, r.Header.Get("Authorization"))
+	}))
+	defer upstream.Close()
+
+	conf := Configuration{
+		CacheTTL:         map[string]time.Duration{"getpatientbiographicaldata": time.Minute},
+		CacheMaxEntries:  10,
+		CacheMaxBodySize: 1,
+	}
+	mon := newProxyStandIn(t, conf, upstream.URL)
+	var err error
+	mon.responses, err = newResponseCache(mon.conf)
+	if err != nil {
+		t.Fatalf("could not create cache %+v", err)
+	}
+
+	get := func(authorization string) string {
+		req := httptest.NewRequest("GET", "/patient/42", nil)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		w := httptest.NewRecorder()
+		mon.serve(w, req)
+		return w.Body.String()
+	}
+
+	alice := get("Bearer alice")
+	if get("Bearer alice") != alice {
+		t.Fatalf("expected the same credentials to hit the cache")
+	}
+	if body := get("Bearer bob"); body == alice || body != `{"call":2,"auth":"Bearer bob"}` {
+		t.Fatalf("expected other credentials to miss the cache, got %s", body)
+	}
+	if body := get(""); body == alice || body != `{"call":3,"auth":""}` {
+		t.Fatalf("expected requests without credentials to miss the cache, got %s", body)
+	}
+}
+
+func TestResponseCacheExpiry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatalf("could not prepare test %+v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	rc, err := newResponseCache(Configuration{CacheMaxEntries: 10, CacheDir: dir})
+	if err != nil {
+		t.Fatalf("could not create cache %+v", err)
+	}
+
+	now := time.Now()
+	rc.put(&cachedResponse{Key: "expired", Status: 200, Stored: now.Add(-time.Hour), Expires: now.Add(-time.Minute)})
+	rc.put(&cachedResponse{Key: "valid", Status: 200, Stored: now, Expires: now.Add(time.Minute)})
+
+	if rc.get("expired") != nil || rc.get("valid") == nil {
+		t.Fatal("expected only the valid response to be returned")
+	}
+
+	rc.put(&cachedResponse{Key: "swept", Status: 200, Stored: now.Add(-time.Hour), Expires: now.Add(-time.Minute)})
+	rc.sweep()
+	if _, err := os.Stat(rc.path("swept")); !os.IsNotExist(err) {
+		t.Fatal("expected the expired response to be removed from disk")
+	}
+	if _, err := os.Stat(rc.path("valid")); err != nil {
+		t.Fatalf("expected the valid response to stay on disk %+v", err)
+	}
+}
+
+func TestCacheControl(t *testing.T) {
+	header := http.Header{}
+	header.Add("Cache-Control", `public, max-age=60`)
+	header.Add("Cache-Control", `s-maxage="30", No-Cache`)
+
+	directives := cacheControl(header)
+	for name, value := range map[string]string{"public": "", "max-age": "60", "s-maxage": "30", "no-cache": ""} {
+		if v, ok := directives[name]; !ok || v != value {
+			t.Fatalf("expected %s=%s, got %v", name, value, directives)
+		}
+	}
+}
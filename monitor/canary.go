@@ -0,0 +1,104 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+
+package monitor
+
+import (
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/vulcand/oxy/forward"
+)
+
+//canaryRouter splits the live traffic between the Endpoint and a canary VDC
+type canaryRouter struct {
+	target         *url.URL
+	oxy            *forward.Forwarder
+	weight         float64
+	header         string
+	cookie         string
+	version        string
+	primaryVersion string
+}
+
+//newCanaryRouter creates the router to CanaryEndpoint, newForwarder creates the proxy to it
+func newCanaryRouter(conf Configuration, newForwarder func(transport http.RoundTripper) (*forward.Forwarder, error)) (*canaryRouter, error) {
+	target, err := url.Parse(conf.CanaryEndpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	transport, err := newSecondaryTransport(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	fwd, err := newForwarder(transport)
+	if err != nil {
+		return nil, err
+	}
+
+	cr := &canaryRouter{
+		target:         target,
+		oxy:            fwd,
+		weight:         conf.CanaryWeight,
+		header:         conf.CanaryHeader,
+		cookie:         conf.CanaryCookie,
+		version:        conf.CanaryVersion,
+		primaryVersion: conf.EndpointVersion,
+	}
+	if cr.version == "" {
+		cr.version = "canary"
+	}
+	if cr.primaryVersion == "" {
+		cr.primaryVersion = "primary"
+	}
+	return cr, nil
+}
+
+//Selects tells if the canary serves the request. A CanaryHeader or CanaryCookie with the value
+//always or never overrides the weight, e.g., for testers or clients that must not see the canary
+func (cr *canaryRouter) Selects(req *http.Request) bool {
+	if cr.header != "" {
+		if selected, ok := canaryOverride(req.Header.Get(cr.header)); ok {
+			return selected
+		}
+	}
+	if cr.cookie != "" {
+		if cookie, err := req.Cookie(cr.cookie); err == nil {
+			if selected, ok := canaryOverride(cookie.Value); ok {
+				return selected
+			}
+		}
+	}
+
+	return cr.weight >= 100 || (cr.weight > 0 && rand.Float64()*100 < cr.weight)
+}
+
+func canaryOverride(value string) (bool, bool) {
+	switch strings.ToLower(value) {
+	case "always":
+		return true, true
+	case "never":
+		return false, true
+	}
+	return false, false
+}
@@ -0,0 +1,121 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+
+package monitor
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCanaryRouting(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("primary"))
+	}))
+	defer upstream.Close()
+
+	canary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("canary"))
+	}))
+	defer canary.Close()
+
+	mon := newProxyStandIn(t, Configuration{
+		CanaryEndpoint: canary.URL,
+		CanaryWeight:   0,
+		CanaryHeader:   "X-Canary",
+		CanaryCookie:   "canary",
+		CanaryVersion:  "v2",
+	}, upstream.URL)
+
+	router, err := newCanaryRouter(mon.conf, mon.newForwarder)
+	if err != nil {
+		t.Fatalf("could not create canary router %+v", err)
+	}
+	mon.canary = router
+
+	serve := func(configure func(req *http.Request)) (string, []MeterMessage) {
+		for len(mon.monitorQueue) > 0 {
+			<-mon.monitorQueue
+		}
+
+		req := httptest.NewRequest("GET", "/patient/42", nil)
+		configure(req)
+		w := httptest.NewRecorder()
+		mon.serve(w, req)
+
+		meters := make([]MeterMessage, 0)
+		for len(mon.monitorQueue) > 0 {
+			meters = append(meters, <-mon.monitorQueue)
+		}
+		return w.Body.String(), meters
+	}
+
+	body, meters := serve(func(req *http.Request) {})
+	if body != "primary" {
+		t.Fatalf("expected the Endpoint to serve the request at weight 0, got %s", body)
+	}
+	for _, meter := range meters {
+		if meter.Version != "primary" {
+			t.Fatalf("expected the primary version to be tagged, got %+v", meter)
+		}
+	}
+
+	body, meters = serve(func(req *http.Request) { req.Header.Set("X-Canary", "always") })
+	if body != "canary" {
+		t.Fatalf("expected the canary to serve the request, got %s", body)
+	}
+	if len(meters) != 2 {
+		t.Fatalf("expected a request and a response meter, got %d", len(meters))
+	}
+	for _, meter := range meters {
+		if meter.Version != "v2" {
+			t.Fatalf("expected the canary version to be tagged, got %+v", meter)
+		}
+	}
+
+	body, _ = serve(func(req *http.Request) { req.AddCookie(&http.Cookie{Name: "canary", Value: "always"}) })
+	if body != "canary" {
+		t.Fatalf("expected the cookie to route to the canary, got %s", body)
+	}
+
+	router.weight = 100
+	body, _ = serve(func(req *http.Request) { req.Header.Set("X-Canary", "never") })
+	if body != "primary" {
+		t.Fatalf("expected the header to override the weight, got %s", body)
+	}
+	body, _ = serve(func(req *http.Request) {})
+	if body != "canary" {
+		t.Fatalf("expected the canary to serve all requests at weight 100, got %s", body)
+	}
+}
+
+func TestCanaryWeight(t *testing.T) {
+	router := &canaryRouter{weight: 25}
+	selected := 0
+	for i := 0; i < 4000; i++ {
+		if router.Selects(httptest.NewRequest("GET", "/", nil)) {
+			selected++
+		}
+	}
+	if selected < 800 || selected > 1200 {
+		t.Fatalf("expected about a quarter of the requests to be routed to the canary, got %d of 4000", selected)
+	}
+}
@@ -0,0 +1,320 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+package monitor
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+//certificateOptions describe a self signed certificate
+type certificateOptions struct {
+	CommonName  string
+	DNSNames    []string
+	IPAddresses []net.IP
+	Validity    time.Duration
+	KeyType     string //ecdsa or rsa
+}
+
+//selfSignedOptions assembles the certificateOptions from the configuration,
+//if no SANs are configured the VDCName, localhost and all local addresses are used
+func selfSignedOptions(conf Configuration) (certificateOptions, error) {
+	opts := certificateOptions{
+		CommonName: conf.VDCName,
+		DNSNames:   conf.CertDNSNames,
+		Validity:   conf.CertValidity,
+		KeyType:    conf.CertKeyType,
+	}
+
+	if len(opts.DNSNames) == 0 {
+		opts.DNSNames = []string{strings.ToLower(conf.VDCName), "localhost"}
+	}
+
+	if len(conf.CertIPAddresses) > 0 {
+		for _, addr := range conf.CertIPAddresses {
+			ip := net.ParseIP(addr)
+			if ip == nil {
+				return opts, fmt.Errorf("invalid ip address %s", addr)
+			}
+			opts.IPAddresses = append(opts.IPAddresses, ip)
+		}
+	} else {
+		opts.IPAddresses = localAddresses()
+	}
+
+	return opts, nil
+}
+
+//localAddresses returns the addresses of all local interfaces, e.g., the pod ip
+func localAddresses() []net.IP {
+	ips := []net.IP{net.ParseIP("127.0.0.1")}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		log.Warnf("could not list interface addresses %+v", err)
+		return ips
+	}
+
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() && !ipNet.IP.IsLinkLocalUnicast() {
+			ips = append(ips, ipNet.IP)
+		}
+	}
+	return ips
+}
+
+//generateCertificate creates a new self signed certificate and writes it to certFile and keyFile
+func generateCertificate(certFile string, keyFile string, opts certificateOptions) error {
+	var key crypto.Signer
+	var err error
+	switch strings.ToLower(opts.KeyType) {
+	case "", "ecdsa":
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "rsa":
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	default:
+		return fmt.Errorf("unknown key type %s", opts.KeyType)
+	}
+	if err != nil {
+		return err
+	}
+
+	validity := opts.Validity
+	if validity <= 0 {
+		validity = 365 * 24 * time.Hour
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	notBefore := time.Now().Add(-time.Hour)
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{"DITAS VDC-Request-Monitor"},
+			CommonName:   opts.CommonName,
+		},
+		NotBefore:             notBefore,
+		NotAfter:              notBefore.Add(validity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  false, //a serving certificate must not be able to sign other certificates
+		DNSNames:              opts.DNSNames,
+		IPAddresses:           opts.IPAddresses,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, key.Public(), key)
+	if err != nil {
+		return err
+	}
+
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer}), 0600)
+}
+
+//fingerprint returns the hex encoded SHA-256 fingerprint of a certificate, used for pinning
+func fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+//certificateReloader serves the certificate stored in certFile and keyFile
+//and reloads it whenever one of the files changes
+type certificateReloader struct {
+	certFile string
+	keyFile  string
+
+	warnBefore time.Duration
+
+	lock    sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+	warned  time.Time
+}
+
+func newCertificateReloader(certFile string, keyFile string, warnBefore time.Duration) (*certificateReloader, error) {
+	cr := &certificateReloader{
+		certFile:   certFile,
+		keyFile:    keyFile,
+		warnBefore: warnBefore,
+	}
+
+	modTime, err := cr.latestModTime()
+	if err != nil {
+		return nil, err
+	}
+
+	err = cr.load(modTime)
+	if err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+//GetCertificate can be used as tls.Config.GetCertificate
+func (cr *certificateReloader) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.lock.RLock()
+	defer cr.lock.RUnlock()
+	return cr.cert, nil
+}
+
+//PEM returns the current certificate chain PEM encoded
+func (cr *certificateReloader) PEM() []byte {
+	cr.lock.RLock()
+	defer cr.lock.RUnlock()
+
+	var chain []byte
+	for _, der := range cr.cert.Certificate {
+		chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	return chain
+}
+
+//Fingerprint returns the SHA-256 fingerprint of the current certificate
+func (cr *certificateReloader) Fingerprint() string {
+	cr.lock.RLock()
+	defer cr.lock.RUnlock()
+	return fingerprint(cr.cert.Leaf)
+}
+
+//Watch checks the certificate files every interval until quit is closed
+func (cr *certificateReloader) Watch(interval time.Duration, quit chan bool) {
+	if interval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				err := cr.Reload()
+				if err != nil {
+					log.Errorf("failed to reload certificate, keeping the old one %+v", err)
+				}
+				cr.checkExpiry()
+			case <-quit:
+				return
+			}
+		}
+	}()
+}
+
+//Reload loads the certificate again if the files changed since the last load
+func (cr *certificateReloader) Reload() error {
+	modTime, err := cr.latestModTime()
+	if err != nil {
+		return err
+	}
+
+	cr.lock.RLock()
+	changed := !modTime.Equal(cr.modTime)
+	cr.lock.RUnlock()
+
+	if !changed {
+		return nil
+	}
+	return cr.load(modTime)
+}
+
+func (cr *certificateReloader) load(modTime time.Time) error {
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return err
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	cert.Leaf = leaf
+
+	cr.lock.Lock()
+	cr.cert = &cert
+	cr.modTime = modTime
+	cr.lock.Unlock()
+
+	log.Infof("loaded certificate %s valid until %s (sha256 %s)", cr.certFile, leaf.NotAfter.Format(time.RFC3339), fingerprint(leaf))
+	cr.checkExpiry()
+	return nil
+}
+
+//checkExpiry updates the expiry metric and warns once per certificate if it is about to expire
+func (cr *certificateReloader) checkExpiry() {
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+
+	if cr.cert == nil || cr.cert.Leaf == nil {
+		return
+	}
+	notAfter := cr.cert.Leaf.NotAfter
+
+	metrics.Set(fmt.Sprintf("request_monitor_certificate_not_after_seconds{file=%q}", filepath.Base(cr.certFile)), float64(notAfter.Unix()))
+
+	remaining := notAfter.Sub(time.Now())
+	if remaining < cr.warnBefore && !cr.warned.Equal(notAfter) {
+		log.Warnf("certificate %s expires in %s (%s)", cr.certFile, remaining.Truncate(time.Minute), notAfter.Format(time.RFC3339))
+		cr.warned = notAfter
+	}
+}
+
+func (cr *certificateReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, file := range []string{cr.certFile, cr.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
@@ -0,0 +1,147 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+package monitor
+
+import (
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func copyFile(t *testing.T, src string, dst string) {
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		t.Fatalf("could not prepare test %+v", err)
+	}
+	err = ioutil.WriteFile(dst, data, 0600)
+	if err != nil {
+		t.Fatalf("could not prepare test %+v", err)
+	}
+}
+
+func TestCertificateReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certs")
+	if err != nil {
+		t.Fatalf("could not prepare test %+v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	cert := filepath.Join(dir, "cert.pem")
+	key := filepath.Join(dir, "key.pem")
+	copyFile(t, filepath.Join("..", ".config", "cert.pem"), cert)
+	copyFile(t, filepath.Join("..", ".config", "key.pem"), key)
+
+	reloader, err := newCertificateReloader(cert, key, time.Hour)
+	if err != nil {
+		t.Fatalf("could not load certificate %+v", err)
+	}
+
+	first, _ := reloader.GetCertificate(nil)
+	if first == nil || first.Leaf == nil {
+		t.Fatal("expected a parsed certificate")
+	}
+
+	if metrics.Get(`request_monitor_certificate_not_after_seconds{file="cert.pem"}`) != float64(first.Leaf.NotAfter.Unix()) {
+		t.Fatal("expected the expiry metric to be set")
+	}
+
+	//unchanged files must not cause a reload
+	err = reloader.Reload()
+	if err != nil {
+		t.Fatalf("reload failed %+v", err)
+	}
+	if same, _ := reloader.GetCertificate(nil); same != first {
+		t.Fatal("certificate was reloaded without a change")
+	}
+
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(cert, later, later)
+
+	err = reloader.Reload()
+	if err != nil {
+		t.Fatalf("reload failed %+v", err)
+	}
+	if second, _ := reloader.GetCertificate(nil); second == first {
+		t.Fatal("certificate was not reloaded after a change")
+	}
+
+	//a broken file keeps the old certificate
+	ioutil.WriteFile(key, []byte("broken"), 0600)
+	later = later.Add(time.Minute)
+	os.Chtimes(key, later, later)
+
+	if reloader.Reload() == nil {
+		t.Fatal("expected an error for a broken key")
+	}
+	if current, _ := reloader.GetCertificate(nil); current == nil {
+		t.Fatal("lost the certificate after a failed reload")
+	}
+}
+
+func TestGenerateCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certs")
+	if err != nil {
+		t.Fatalf("could not prepare test %+v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, keyType := range []string{"ecdsa", "rsa"} {
+		cert := filepath.Join(dir, keyType+"-cert.pem")
+		key := filepath.Join(dir, keyType+"-key.pem")
+
+		err = generateCertificate(cert, key, certificateOptions{
+			CommonName:  "tubvdc",
+			DNSNames:    []string{"tubvdc", "localhost"},
+			IPAddresses: []net.IP{net.ParseIP("10.0.0.12")},
+			Validity:    24 * time.Hour,
+			KeyType:     keyType,
+		})
+		if err != nil {
+			t.Fatalf("could not generate %s certificate %+v", keyType, err)
+		}
+
+		reloader, err := newCertificateReloader(cert, key, time.Hour)
+		if err != nil {
+			t.Fatalf("could not load generated %s certificate %+v", keyType, err)
+		}
+
+		leaf := reloader.cert.Leaf
+		if err := leaf.VerifyHostname("tubvdc"); err != nil {
+			t.Fatalf("missing DNS SAN %+v", err)
+		}
+		if err := leaf.VerifyHostname("10.0.0.12"); err != nil {
+			t.Fatalf("missing IP SAN %+v", err)
+		}
+		if leaf.NotAfter.Sub(leaf.NotBefore) != 24*time.Hour {
+			t.Fatalf("unexpected validity %s", leaf.NotAfter.Sub(leaf.NotBefore))
+		}
+		if leaf.IsCA || leaf.KeyUsage&x509.KeyUsageCertSign != 0 {
+			t.Fatal("expected a leaf certificate that can not sign certificates")
+		}
+	}
+
+	err = generateCertificate(filepath.Join(dir, "c.pem"), filepath.Join(dir, "k.pem"), certificateOptions{KeyType: "dsa"})
+	if err == nil {
+		t.Fatal("expected an error for an unknown key type")
+	}
+}
@@ -0,0 +1,124 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+
+package monitor
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+//requestCoalescer lets identical concurrent requests of idempotent operations share a single
+//upstream call, the first request leads the flight and the followers get its response
+type requestCoalescer struct {
+	operations []string
+	maxBody    int
+
+	lock    sync.Mutex
+	flights map[string]*flight
+}
+
+//flight is an upstream call shared by identical requests
+type flight struct {
+	done      chan struct{}
+	response  *cachedResponse //nil if the response of the leader can not be shared
+	followers int
+	landed    bool
+}
+
+func newRequestCoalescer(conf Configuration) *requestCoalescer {
+	return &requestCoalescer{
+		operations: conf.CoalesceOperations,
+		maxBody:    conf.CoalesceMaxBodySize * 1024 * 1024,
+		flights:    make(map[string]*flight),
+	}
+}
+
+//Selects tells if requests like this one are coalesced
+func (rc *requestCoalescer) Selects(req *http.Request, operationID string) bool {
+	if rc == nil || (req.Method != "GET" && req.Method != "HEAD") {
+		return false
+	}
+	for _, operation := range rc.operations {
+		if strings.EqualFold(operation, operationID) {
+			return true
+		}
+	}
+	return false
+}
+
+//Join returns the flight of the key and if the caller leads it, the leader must call Land
+func (rc *requestCoalescer) Join(key string) (*flight, bool) {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+
+	if f, ok := rc.flights[key]; ok {
+		f.followers++
+		return f, false
+	}
+
+	f := &flight{done: make(chan struct{})}
+	rc.flights[key] = f
+	return f, true
+}
+
+//Land passes the response the leader received to the followers, a nil recorder or responses that set cookies
+//are not shared and the followers forward their requests themselves. Requests that arrive afterwards start a
+//new flight, only the first call of Land has an effect.
+func (rc *requestCoalescer) Land(key string, f *flight, rec *responseRecorder) {
+	rc.lock.Lock()
+	if f.landed {
+		rc.lock.Unlock()
+		return
+	}
+	f.landed = true
+	if rc.flights[key] == f {
+		delete(rc.flights, key)
+	}
+	rc.lock.Unlock()
+
+	if rec == nil {
+		close(f.done)
+		return
+	}
+	if body, complete := rec.Body(); complete && len(rec.Header()["Set-Cookie"]) == 0 {
+		f.response = &cachedResponse{
+			Key:    key,
+			Status: rec.StatusCode(),
+			Header: cloneHeader(rec.Header()),
+			Body:   []byte(body),
+			Stored: time.Now(),
+		}
+		f.response.Header.Del("X-Cache")
+	}
+	close(f.done)
+}
+
+//Await waits for the leader, it returns nil if the response can not be shared
+//or the client went away
+func (f *flight) Await(req *http.Request) *cachedResponse {
+	select {
+	case <-f.done:
+		return f.response
+	case <-req.Context().Done():
+		return nil
+	}
+}
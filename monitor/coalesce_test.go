@@ -0,0 +1,256 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+
+package monitor
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRequestCoalescing(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		<-release
+		fmt.Fprintf(w, `{"call":%d}`, n)
+	}))
+	defer upstream.Close()
+
+	conf := Configuration{
+		CoalesceOperations:  []string{"getPatientBiographicalData"},
+		CoalesceMaxBodySize: 1,
+	}
+	mon := newProxyStandIn(t, conf, upstream.URL)
+	mon.coalescer = newRequestCoalescer(mon.conf)
+
+	const followers = 4
+	responses := make([]*httptest.ResponseRecorder, followers+1)
+	var wg sync.WaitGroup
+	get := func(i int) {
+		defer wg.Done()
+		responses[i] = httptest.NewRecorder()
+		mon.serve(responses[i], httptest.NewRequest("GET", "/patient/42", nil))
+	}
+
+	wg.Add(1)
+	go get(0)
+	waitFor(t, func() bool { return atomic.LoadInt32(&calls) == 1 })
+
+	for i := 1; i <= followers; i++ {
+		wg.Add(1)
+		go get(i)
+	}
+	waitFor(t, func() bool {
+		mon.coalescer.lock.Lock()
+		defer mon.coalescer.lock.Unlock()
+		for _, f := range mon.coalescer.flights {
+			return f.followers == followers
+		}
+		return false
+	})
+
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Fatalf("expected a single upstream call, got %d", calls)
+	}
+	for i, w := range responses {
+		if w.Code != http.StatusOK || w.Body.String() != `{"call":1}` {
+			t.Fatalf("expected request %d to get the response of the leader, got %d %s", i, w.Code, w.Body.String())
+		}
+	}
+
+	var coalesced int
+	for len(mon.monitorQueue) > 0 {
+		if meter := <-mon.monitorQueue; meter.Coalesced {
+			coalesced++
+		}
+	}
+	if coalesced != followers {
+		t.Fatalf("expected %d coalesced meters, got %d", followers, coalesced)
+	}
+
+	//later requests start a new flight
+	w := httptest.NewRecorder()
+	mon.serve(w, httptest.NewRequest("GET", "/patient/42", nil))
+	if w.Body.String() != `{"call":2}` {
+		t.Fatalf("expected a new upstream call, got %s", w.Body.String())
+	}
+}
+
+func TestCoalescerLeaderCancelled(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		if n == 1 {
+			<-release
+		}
+		fmt.Fprintf(w, `{"call":%d}`, n)
+	}))
+	defer upstream.Close()
+	defer close(release)
+
+	conf := Configuration{
+		CoalesceOperations:  []string{"getPatientBiographicalData"},
+		CoalesceMaxBodySize: 1,
+	}
+	mon := newProxyStandIn(t, conf, upstream.URL)
+	mon.coalescer = newRequestCoalescer(mon.conf)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		mon.serve(httptest.NewRecorder(), httptest.NewRequest("GET", "/patient/42", nil).WithContext(ctx))
+	}()
+	waitFor(t, func() bool { return atomic.LoadInt32(&calls) == 1 })
+
+	follower := httptest.NewRecorder()
+	go func() {
+		defer wg.Done()
+		mon.serve(follower, httptest.NewRequest("GET", "/patient/42", nil))
+	}()
+	waitFor(t, func() bool {
+		mon.coalescer.lock.Lock()
+		defer mon.coalescer.lock.Unlock()
+		for _, f := range mon.coalescer.flights {
+			return f.followers == 1
+		}
+		return false
+	})
+
+	//the client of the leader goes away, its upstream call is cancelled
+	cancel()
+	wg.Wait()
+
+	if follower.Code != http.StatusOK || follower.Body.String() != `{"call":2}` {
+		t.Fatalf("expected the follower to forward its own request, got %d %s", follower.Code, follower.Body.String())
+	}
+}
+
+func TestCoalescerLandOnce(t *testing.T) {
+	rc := newRequestCoalescer(Configuration{CoalesceMaxBodySize: 1})
+	leading, _ := rc.Join("key")
+	follow, _ := rc.Join("key")
+
+	rc.Land("key", leading, nil)
+	next, leader := rc.Join("key")
+	if !leader {
+		t.Fatal("expected a new flight after landing")
+	}
+
+	rec := newResponseRecorder(httptest.NewRecorder())
+	rec.keepBody(rc.maxBody)
+	rec.Write([]byte(`{}`))
+	rc.Land("key", leading, rec)
+
+	if shared := follow.Await(httptest.NewRequest("GET", "/", nil)); shared != nil {
+		t.Fatalf("expected only the first landing to count, got %+v", shared)
+	}
+	if _, leader := rc.Join("key"); leader {
+		t.Fatal("expected a second landing to keep the new flight")
+	}
+	rc.Land("key", next, nil)
+}
+
+func TestCoalescerSelects(t *testing.T) {
+	rc := newRequestCoalescer(Configuration{CoalesceOperations: []string{"getPatientBiographicalData"}})
+
+	if !rc.Selects(httptest.NewRequest("GET", "/patient/42", nil), "getpatientbiographicaldata") {
+		t.Fatal("expected the configured operation to be coalesced")
+	}
+	if rc.Selects(httptest.NewRequest("POST", "/patient/42", nil), "getPatientBiographicalData") {
+		t.Fatal("expected POST requests not to be coalesced")
+	}
+	if rc.Selects(httptest.NewRequest("GET", "/patient/42", nil), "getAllValuesForBloodTestComponent") {
+		t.Fatal("expected other operations not to be coalesced")
+	}
+
+	var disabled *requestCoalescer
+	if disabled.Selects(httptest.NewRequest("GET", "/patient/42", nil), "getPatientBiographicalData") {
+		t.Fatal("expected no coalescing without a coalescer")
+	}
+}
+
+func TestCoalescerOversizedResponse(t *testing.T) {
+	rc := newRequestCoalescer(Configuration{CoalesceMaxBodySize: 0})
+	leading, leader := rc.Join("key")
+	follow, _ := rc.Join("key")
+	if !leader || follow != leading {
+		t.Fatal("expected the second request to follow the first")
+	}
+
+	rec := newResponseRecorder(httptest.NewRecorder())
+	rec.keepBody(rc.maxBody)
+	rec.Write([]byte("too large"))
+	rc.Land("key", leading, rec)
+
+	if shared := follow.Await(httptest.NewRequest("GET", "/", nil)); shared != nil {
+		t.Fatalf("expected an oversized response not to be shared, got %+v", shared)
+	}
+	if _, leader := rc.Join("key"); !leader {
+		t.Fatal("expected a new flight after landing")
+	}
+}
+
+func TestCoalescerCookies(t *testing.T) {
+	rc := newRequestCoalescer(Configuration{CoalesceMaxBodySize: 1})
+	leading, _ := rc.Join("key")
+	follow, _ := rc.Join("key")
+
+	rec := newResponseRecorder(httptest.NewRecorder())
+	rec.keepBody(rc.maxBody)
+	rec.Header().Set("Set-Cookie", "session=alice")
+	rec.Write([]byte(`{}`))
+	rc.Land("key", leading, rec)
+
+	if shared := follow.Await(httptest.NewRequest("GET", "/", nil)); shared != nil {
+		t.Fatalf("expected a response that sets cookies not to be shared, got %+v", shared)
+	}
+}
+
+func TestCoalescerCredentials(t *testing.T) {
+	rc := newRequestCoalescer(Configuration{CoalesceOperations: []string{"getPatientBiographicalData"}})
+
+	key := func(authorization string) string {
+		req := httptest.NewRequest("GET", "/patient/42", nil)
+		req.Header.Set("Authorization", authorization)
+		return cacheKey(req, "getPatientBiographicalData", "", "")
+	}
+
+	if _, leader := rc.Join(key("Bearer alice")); !leader {
+		t.Fatal("expected the first request to lead")
+	}
+	if _, leader := rc.Join(key("Bearer bob")); !leader {
+		t.Fatal("expected requests with other credentials to lead their own flight")
+	}
+	if _, leader := rc.Join(key("Bearer alice")); leader {
+		t.Fatal("expected requests with the same credentials to follow")
+	}
+}
@@ -0,0 +1,109 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+
+package monitor
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	spec "github.com/DITAS-Project/blueprint-go"
+)
+
+//ValidateConfig reads the configuration and the blueprint and reports all problems, without starting the monitor
+func ValidateConfig() error {
+	conf, err := readConfig()
+	if err != nil {
+		return err
+	}
+
+	return validateBlueprint(conf)
+}
+
+//validateBlueprint checks that the blueprint can be read and that the operations
+//referenced by the configuration exist
+func validateBlueprint(conf Configuration) error {
+	file := filepath.Join(conf.configDir, "blueprint.json")
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		log.Warnf("no blueprint found at %s, requests can not be matched to operations", file)
+		return nil
+	}
+
+	var errs configErrors
+	blueprint, err := spec.ReadBlueprint(file)
+	if err != nil {
+		errs.add("blueprint %s is invalid: %v", file, err)
+		return errs
+	}
+
+	_, err = readRawBlueprint(file)
+	if err != nil {
+		errs.add("blueprint %s is invalid: %v", file, err)
+		return errs
+	}
+
+	//map keys of the config are lower case, see viper
+	operations := make(map[string]bool)
+	for operationID := range spec.AssembleOperationsMap(*blueprint) {
+		operations[strings.ToLower(operationID)] = true
+	}
+	if len(operations) == 0 {
+		log.Warnf("blueprint %s does not define any operations", file)
+	}
+
+	for operationID := range conf.AuthRules {
+		if !operations[strings.ToLower(operationID)] {
+			errs.add("AuthRules references the unknown operation %q", operationID)
+		}
+	}
+	for operationID := range conf.TracingOperationSampleRatio {
+		if !operations[strings.ToLower(operationID)] {
+			errs.add("TracingOperationSampleRatio references the unknown operation %q", operationID)
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+//MatchOperation returns the blueprint operation a request with the given method and path resolves to
+func MatchOperation(method string, path string) (string, error) {
+	conf, err := readConfig()
+	if err != nil {
+		return "", err
+	}
+
+	blueprint, err := spec.ReadBlueprint(filepath.Join(conf.configDir, "blueprint.json"))
+	if err != nil {
+		log.Errorf("could not read blueprint %+v", err)
+		return "", err
+	}
+
+	u, err := url.Parse(path)
+	if err != nil {
+		return "", err
+	}
+
+	cache := NewResoruceCache(blueprint)
+	return cache.Match(u.Path, strings.ToUpper(method))
+}
@@ -0,0 +1,67 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+
+package monitor
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	spec "github.com/DITAS-Project/blueprint-go"
+)
+
+func TestValidateBlueprint(t *testing.T) {
+	blueprint, err := spec.ReadBlueprint(filepath.Join("..", "resources", "blueprint.json"))
+	if err != nil {
+		t.Fatalf("could not prepare test %+v", err)
+	}
+
+	var known string
+	for operationID := range spec.AssembleOperationsMap(*blueprint) {
+		known = operationID
+		break
+	}
+
+	conf := Configuration{
+		configDir:                   filepath.Join("..", "resources"),
+		AuthRules:                   map[string][]string{strings.ToLower(known): {"admin"}, "nooperation": {"admin"}},
+		TracingOperationSampleRatio: map[string]float64{known: 0.5},
+	}
+
+	err = validateBlueprint(conf)
+	if err == nil {
+		t.Fatal("expected the unknown operation to be reported")
+	}
+	errs := err.(configErrors)
+	if len(errs) != 1 || !strings.Contains(errs[0], "nooperation") {
+		t.Fatalf("expected only nooperation to be reported, got %v", errs)
+	}
+
+	delete(conf.AuthRules, "nooperation")
+	if err := validateBlueprint(conf); err != nil {
+		t.Fatalf("expected the config to be valid, got %+v", err)
+	}
+
+	//a missing blueprint is no error
+	if err := validateBlueprint(Configuration{configDir: filepath.Join(os.TempDir(), "noblueprint")}); err != nil {
+		t.Fatalf("a missing blueprint should only be warned about, got %+v", err)
+	}
+}
@@ -0,0 +1,359 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+
+package monitor
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+//maxDecodedBody limits the size of decoded bodies to guard against compression bombs
+const maxDecodedBody = 16 * 1024 * 1024
+
+//supportedEncodings are the content encodings the monitor can decode and compress, in order of preference
+var supportedEncodings = []string{"br", "gzip", "deflate"}
+
+//decodeContent decodes a body with the given Content-Encoding, bodies without an encoding are returned as is
+func decodeContent(body string, encoding string) (string, error) {
+	var reader io.Reader = strings.NewReader(body)
+	encodings := strings.Split(encoding, ",")
+	//the encodings are listed in the order they were applied
+	for i := len(encodings) - 1; i >= 0; i-- {
+		switch strings.ToLower(strings.TrimSpace(encodings[i])) {
+		case "", "identity":
+		case "gzip", "x-gzip":
+			gz, err := gzip.NewReader(reader)
+			if err != nil {
+				return body, err
+			}
+			reader = gz
+		case "deflate":
+			reader = newDeflateReader(reader)
+		case "br":
+			reader = brotli.NewReader(reader)
+		default:
+			return body, fmt.Errorf("unsupported content encoding %s", encodings[i])
+		}
+	}
+
+	decoded, err := ioutil.ReadAll(io.LimitReader(reader, maxDecodedBody+1))
+	if err != nil {
+		return body, err
+	}
+	if len(decoded) > maxDecodedBody {
+		return body, fmt.Errorf("decoded body exceeds %d bytes", maxDecodedBody)
+	}
+	return string(decoded), nil
+}
+
+//newDeflateReader reads deflate bodies, which are zlib streams but raw deflate in some implementations
+func newDeflateReader(r io.Reader) io.Reader {
+	buffered := bufio.NewReader(r)
+	header, err := buffered.Peek(2)
+	//a zlib header uses the deflate method and is a multiple of 31
+	if err == nil && header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+		zr, err := zlib.NewReader(buffered)
+		if err == nil {
+			return zr
+		}
+	}
+	return flate.NewReader(buffered)
+}
+
+//decodedBody returns the body of a response for reporting, it stays encoded if it can not be decoded
+func decodedBody(body string, header http.Header) string {
+	encoding := header.Get("Content-Encoding")
+	if encoding == "" {
+		return body
+	}
+	decoded, err := decodeContent(body, encoding)
+	if err != nil {
+		log.Debugf("could not decode %s body %+v", encoding, err)
+		return body
+	}
+	return decoded
+}
+
+//decodedResponse returns the body and a copy of the header of a response for reporting,
+//if the body was decoded the header no longer announces the encoding and the encoded length
+func decodedResponse(body string, header http.Header) (string, http.Header) {
+	header = cloneHeader(header)
+	encoding := header.Get("Content-Encoding")
+	if encoding == "" {
+		return body, header
+	}
+
+	decoded, err := decodeContent(body, encoding)
+	if err != nil {
+		log.Debugf("could not decode %s body %+v", encoding, err)
+		return body, header
+	}
+	header.Del("Content-Encoding")
+	header.Del("Content-Length")
+	return decoded, header
+}
+
+//negotiateEncoding picks the preferred supported encoding of an Accept-Encoding header, empty if none is accepted
+func negotiateEncoding(accept string) string {
+	best, bestQ := "", 0.0
+	wildcard := -1.0
+	qualities := make(map[string]float64)
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(fields[0]))
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if coding == "*" {
+			wildcard = q
+		} else if coding != "" {
+			qualities[coding] = q
+		}
+	}
+
+	for _, coding := range supportedEncodings {
+		q, ok := qualities[coding]
+		if !ok {
+			q = wildcard
+		}
+		if q > bestQ {
+			best, bestQ = coding, q
+		}
+	}
+	return best
+}
+
+//responseCompressor compresses responses toward clients that accept it
+type responseCompressor struct {
+	minSize int64
+	types   []string
+}
+
+func newResponseCompressor(conf Configuration) *responseCompressor {
+	return &responseCompressor{
+		minSize: int64(conf.CompressMinSize),
+		types:   conf.CompressTypes,
+	}
+}
+
+//Wrap returns a ResponseWriter that compresses the response if the client accepts it,
+//it must be closed once the response is written
+func (rc *responseCompressor) Wrap(w http.ResponseWriter, req *http.Request) *compressWriter {
+	if rc == nil || req.Method == "HEAD" {
+		return nil
+	}
+	return &compressWriter{
+		ResponseWriter: w,
+		compressor:     rc,
+		header:         make(http.Header),
+		accepted:       negotiateEncoding(req.Header.Get("Accept-Encoding")),
+	}
+}
+
+//compressible tells if a response with this header is compressed
+func (rc *responseCompressor) compressible(status int, header http.Header) bool {
+	if status < 200 || status == http.StatusNoContent || status == http.StatusPartialContent || status == http.StatusNotModified {
+		return false
+	}
+	if header.Get("Content-Encoding") != "" || strings.Contains(header.Get("Cache-Control"), "no-transform") {
+		return false
+	}
+	if length, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64); err == nil && length < rc.minSize {
+		return false
+	}
+
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		//compressed bodies can not be sniffed for their type
+		return false
+	}
+	for _, t := range rc.types {
+		if strings.HasPrefix(mediaType, strings.ToLower(t)) {
+			return true
+		}
+	}
+	return false
+}
+
+//compressWriter compresses the response body with the encoding the client accepts,
+//the header passed to the client is kept apart so that the recorded response stays unencoded
+type compressWriter struct {
+	http.ResponseWriter
+	compressor *responseCompressor
+	header     http.Header
+	accepted   string
+
+	encoding    string
+	encoder     io.WriteCloser
+	wroteHeader bool
+	in          int64
+	out         countingWriter
+}
+
+//countingWriter counts the bytes written to the client
+type countingWriter struct {
+	w       io.Writer
+	written int64
+}
+
+func (cw *countingWriter) Write(data []byte) (int, error) {
+	n, err := cw.w.Write(data)
+	cw.written += int64(n)
+	return n, err
+}
+
+func (cw *compressWriter) Header() http.Header {
+	return cw.header
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.wroteHeader {
+		return
+	}
+	cw.wroteHeader = true
+
+	header := cw.ResponseWriter.Header()
+	for key, values := range cw.header {
+		header[key] = values
+	}
+
+	if cw.compressor.compressible(status, header) {
+		header.Add("Vary", "Accept-Encoding")
+		if cw.accepted != "" {
+			cw.encoding = cw.accepted
+			header.Set("Content-Encoding", cw.encoding)
+			header.Del("Content-Length")
+			header.Del("Accept-Ranges")
+			if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+				header.Set("ETag", "W/"+etag)
+			}
+		}
+	}
+
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *compressWriter) Write(data []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.encoding == "" {
+		return cw.ResponseWriter.Write(data)
+	}
+
+	if cw.encoder == nil {
+		cw.out.w = cw.ResponseWriter
+		switch cw.encoding {
+		case "br":
+			cw.encoder = brotli.NewWriter(&cw.out)
+		case "gzip":
+			cw.encoder = gzip.NewWriter(&cw.out)
+		default:
+			cw.encoder = zlib.NewWriter(&cw.out)
+		}
+	}
+
+	n, err := cw.encoder.Write(data)
+	cw.in += int64(n)
+	return n, err
+}
+
+//Close finishes the compressed body
+func (cw *compressWriter) Close() error {
+	if cw.encoder == nil {
+		return nil
+	}
+	err := cw.encoder.Close()
+	cw.encoder = nil
+	return err
+}
+
+//Ratio returns the size of the compressed body relative to the uncompressed one, 0 if it was not compressed
+func (cw *compressWriter) Ratio() float64 {
+	if cw.in == 0 {
+		return 0
+	}
+	return float64(cw.out.written) / float64(cw.in)
+}
+
+//Flush is needed for streamed responses
+func (cw *compressWriter) Flush() {
+	if flusher, ok := cw.encoder.(interface{ Flush() error }); ok {
+		flusher.Flush()
+	}
+	if flusher, ok := cw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+//Hijack is needed for websocket connections
+func (cw *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hijacker, ok := cw.ResponseWriter.(http.Hijacker); ok {
+		return hijacker.Hijack()
+	}
+	return nil, nil, errors.New("connection can't be hijacked")
+}
+
+//written returns the number of body bytes send to the client, after the compression if it applied
+func written(w http.ResponseWriter, rec *responseRecorder) int64 {
+	if cw, ok := w.(*compressWriter); ok && cw.encoding != "" {
+		return cw.out.written
+	}
+	return rec.Written()
+}
+
+//compressed finishes the compression of a response and notes it in the meter
+func compressed(w http.ResponseWriter, meter *MeterMessage) {
+	cw, ok := w.(*compressWriter)
+	if !ok {
+		return
+	}
+	if err := cw.Close(); err != nil {
+		log.Debugf("could not finish compressed response %+v", err)
+	}
+	if cw.encoding == "" {
+		return
+	}
+
+	meter.Compression = cw.encoding
+	meter.CompressionRatio = cw.Ratio()
+	metrics.Add("request_monitor_compressed_total", 1)
+	metrics.Add("request_monitor_compression_in_bytes_total", float64(cw.in))
+	metrics.Add("request_monitor_compression_out_bytes_total", float64(cw.out.written))
+}
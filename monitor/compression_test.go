@@ -0,0 +1,227 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+
+package monitor
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+func encodeContent(t *testing.T, body string, encoding string) string {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch encoding {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "deflate":
+		w = zlib.NewWriter(&buf)
+	case "raw-deflate":
+		w, _ = flate.NewWriter(&buf, flate.DefaultCompression)
+	case "br":
+		w = brotli.NewWriter(&buf)
+	}
+	if _, err := w.Write([]byte(body)); err != nil {
+		t.Fatalf("could not prepare test %+v", err)
+	}
+	w.Close()
+	return buf.String()
+}
+
+func TestDecodeContent(t *testing.T) {
+	body := `{"patientId":42,"name":"Jane"}`
+	for _, encoding := range []string{"gzip", "deflate", "br"} {
+		decoded, err := decodeContent(encodeContent(t, body, encoding), encoding)
+		if err != nil || decoded != body {
+			t.Fatalf("expected %s to be decoded, got %q %+v", encoding, decoded, err)
+		}
+	}
+
+	decoded, err := decodeContent(encodeContent(t, body, "raw-deflate"), "deflate")
+	if err != nil || decoded != body {
+		t.Fatalf("expected raw deflate to be decoded, got %q %+v", decoded, err)
+	}
+
+	//encodings are applied in the listed order
+	twice := encodeContent(t, encodeContent(t, body, "gzip"), "br")
+	decoded, err = decodeContent(twice, "gzip, br")
+	if err != nil || decoded != body {
+		t.Fatalf("expected both encodings to be decoded, got %q %+v", decoded, err)
+	}
+
+	if _, err := decodeContent(body, "compress"); err == nil {
+		t.Fatal("expected unsupported encodings to fail")
+	}
+
+	if decodedBody("not gzip", http.Header{"Content-Encoding": {"gzip"}}) != "not gzip" {
+		t.Fatal("expected undecodable bodies to be reported as is")
+	}
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	for accept, expected := range map[string]string{
+		"":                        "",
+		"identity":                "",
+		"gzip":                    "gzip",
+		"gzip, deflate, br":       "br",
+		"br;q=0.5, gzip":          "gzip",
+		"br;q=0, gzip;q=0.1":      "gzip",
+		"*":                       "br",
+		"*;q=0.5, gzip;q=0.8":     "gzip",
+		"compress, DEFLATE;q=0.9": "deflate",
+	} {
+		if actual := negotiateEncoding(accept); actual != expected {
+			t.Errorf("expected %q for %q, got %q", expected, accept, actual)
+		}
+	}
+}
+
+func TestResponseCompression(t *testing.T) {
+	large := `{"values":"` + strings.Repeat("blood test ", 200) + `"}`
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/patient/1":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{}`))
+		case "/patient/2":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte(large))
+		default:
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.Header().Set("ETag", `"v1"`)
+			w.Write([]byte(large))
+		}
+	}))
+	defer upstream.Close()
+
+	mon := newProxyStandIn(t, Configuration{
+		CompressResponses: true,
+		CompressMinSize:   1024,
+		CompressTypes:     []string{"text/", "application/json"},
+		AccessLogOutput:   "access.log",
+	}, upstream.URL)
+	mon.compress = newResponseCompressor(mon.conf)
+
+	get := func(path string, accept string) (*httptest.ResponseRecorder, MeterMessage) {
+		for len(mon.monitorQueue) > 0 {
+			<-mon.monitorQueue
+		}
+		req := httptest.NewRequest("GET", path, nil)
+		if accept != "" {
+			req.Header.Set("Accept-Encoding", accept)
+		}
+		w := httptest.NewRecorder()
+		mon.serve(w, req)
+		var meter MeterMessage
+		for len(mon.monitorQueue) > 0 {
+			meter = <-mon.monitorQueue
+		}
+		return w, meter
+	}
+
+	w, meter := get("/patient/42", "gzip, deflate")
+	sent := int64(w.Body.Len())
+	if w.Header().Get("Content-Encoding") != "gzip" || w.Header().Get("Content-Length") != "" || w.Header().Get("Vary") != "Accept-Encoding" || w.Header().Get("ETag") != `W/"v1"` {
+		t.Fatalf("expected a gzip response, got %v", w.Header())
+	}
+	gz, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatalf("expected a gzip body %+v", err)
+	}
+	body, _ := ioutil.ReadAll(gz)
+	if string(body) != large {
+		t.Fatalf("expected the upstream response, got %s", body)
+	}
+	if meter.Compression != "gzip" || meter.CompressionRatio <= 0 || meter.CompressionRatio >= 1 {
+		t.Fatalf("expected the compression to be metered, got %+v", meter)
+	}
+	if entry := <-mon.accessLogQueue; entry.ResponseLength != sent {
+		t.Fatalf("expected the access log to count the compressed bytes %d, got %d", sent, entry.ResponseLength)
+	}
+
+	w, meter = get("/patient/42", "br")
+	decoded, err := decodeContent(w.Body.String(), w.Header().Get("Content-Encoding"))
+	if w.Header().Get("Content-Encoding") != "br" || err != nil || decoded != large || meter.Compression != "br" {
+		t.Fatalf("expected a brotli response, got %v %+v", w.Header(), err)
+	}
+
+	w, meter = get("/patient/42", "")
+	if w.Header().Get("Content-Encoding") != "" || w.Body.String() != large || meter.Compression != "" {
+		t.Fatalf("expected an uncompressed response, got %v", w.Header())
+	}
+	if w.Header().Get("Vary") != "Accept-Encoding" {
+		t.Fatalf("expected the response to vary on Accept-Encoding, got %v", w.Header())
+	}
+
+	for _, path := range []string{"/patient/1", "/patient/2"} {
+		w, _ = get(path, "gzip")
+		if w.Header().Get("Content-Encoding") != "" {
+			t.Fatalf("expected %s not to be compressed, got %v", path, w.Header())
+		}
+	}
+}
+
+func TestExchangeResponseDecoded(t *testing.T) {
+	body := `{"patientId":42}`
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write([]byte(encodeContent(t, body, "gzip")))
+	}))
+	defer upstream.Close()
+
+	mon := newProxyStandIn(t, Configuration{ForwardTraffic: true}, upstream.URL)
+
+	req := httptest.NewRequest("GET", "/patient/42", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	mon.serve(w, req)
+
+	if decoded, err := decodeContent(w.Body.String(), "gzip"); err != nil || decoded != body || w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("expected the client to get the encoded response, got %v %+v", w.Header(), err)
+	}
+
+	var reported bool
+	for len(mon.exchangeQueue) > 0 {
+		exchange := <-mon.exchangeQueue
+		if exchange.ResponseCode == 0 {
+			continue
+		}
+		reported = true
+		if exchange.ResponseBody != body {
+			t.Fatalf("expected the reported response to be decoded, got %q", exchange.ResponseBody)
+		}
+		if exchange.ResponseHeader.Get("Content-Encoding") != "" || exchange.ResponseHeader.Get("Content-Length") != "" {
+			t.Fatalf("expected the reported header to match the decoded body, got %v", exchange.ResponseHeader)
+		}
+	}
+	if !reported {
+		t.Fatal("expected the response to be reported")
+	}
+}
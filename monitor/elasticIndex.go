@@ -0,0 +1,332 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+package monitor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DITAS-Project/TUBUtil/util"
+	"github.com/olivere/elastic"
+)
+
+//elasticIndex decides in which index a meter is stored and prepares the cluster,
+//installing the index template, the ILM policy and the first rollover index
+type elasticIndex struct {
+	client *elastic.Client
+
+	vdc        string
+	pattern    string
+	dateFormat string
+	rollover   bool
+
+	template  bool
+	policy    string
+	maxAge    string
+	maxSize   string
+	retention string
+
+	docType    string
+	typeless   bool
+	opensearch bool
+}
+
+//newElasticIndex creates the index naming from the configuration
+func newElasticIndex(config Configuration, client *elastic.Client) (*elasticIndex, error) {
+	ei := &elasticIndex{
+		client:     client,
+		vdc:        config.VDCName,
+		pattern:    config.ElasticIndex,
+		dateFormat: config.ElasticIndexDateFormat,
+		rollover:   config.ElasticRollover,
+		template:   config.ElasticTemplate,
+		policy:     config.ElasticILMPolicy,
+		maxAge:     config.ElasticILMRolloverMaxAge,
+		maxSize:    config.ElasticILMRolloverMaxSize,
+		retention:  config.ElasticILMRetention,
+		docType:    config.ElasticDocumentType,
+	}
+
+	if ei.dateFormat == "" {
+		ei.dateFormat = "2006-01-02"
+	}
+
+	if ei.rollover {
+		if ei.pattern == "" || strings.Contains(ei.pattern, "{date}") {
+			return nil, fmt.Errorf("rollover requires an ElasticIndex alias without {date}")
+		}
+		if ei.policy == "" {
+			log.Warn("rollover is enabled without an ILM policy, the write index will never roll over")
+		}
+	}
+
+	return ei, nil
+}
+
+//Name returns the index, or the write alias, of a meter taken at the given time
+func (ei *elasticIndex) Name(t time.Time) string {
+	if ei.pattern == "" {
+		return util.GetElasticIndex(ei.vdc)
+	}
+
+	name := strings.Replace(ei.pattern, "{vdc}", strings.ToLower(ei.vdc), -1)
+	return strings.Replace(name, "{date}", t.UTC().Format(ei.dateFormat), -1)
+}
+
+//DocumentType returns the mapping type used for indexing, _doc on typeless clusters
+func (ei *elasticIndex) DocumentType() string {
+	if ei.docType != "" {
+		return ei.docType
+	}
+	if ei.typeless {
+		return "_doc"
+	}
+	return "data"
+}
+
+//indexPattern matches all indices written by this monitor
+func (ei *elasticIndex) indexPattern() string {
+	switch {
+	case ei.pattern == "":
+		return strings.ToLower(ei.vdc) + "-*"
+	case ei.rollover:
+		return ei.Name(time.Time{}) + "-*"
+	default:
+		name := strings.Replace(ei.pattern, "{vdc}", strings.ToLower(ei.vdc), -1)
+		return strings.Replace(name, "{date}", "*", -1)
+	}
+}
+
+func (ei *elasticIndex) templateName() string {
+	if ei.vdc == "" {
+		return "request-monitor"
+	}
+	return strings.ToLower(ei.vdc) + "-request-monitor"
+}
+
+//Setup installs the ILM policy, the index template and the first rollover index,
+//the API flavour of the cluster must be detected before
+func (ei *elasticIndex) Setup(ctx context.Context) error {
+	var err error
+	if ei.policy != "" {
+		if ei.opensearch {
+			log.Warnf("ILM is not supported by OpenSearch, policy %s is not installed", ei.policy)
+		} else {
+			err = ei.put(ctx, "/_ilm/policy/"+ei.policy, ei.lifecyclePolicy())
+			if err != nil {
+				log.Errorf("could not install ILM policy %+v", err)
+				return err
+			}
+		}
+	}
+
+	if ei.template {
+		err = ei.put(ctx, "/_template/"+ei.templateName(), ei.indexTemplate())
+		if err != nil {
+			log.Errorf("could not install index template %+v", err)
+			return err
+		}
+	}
+
+	if ei.rollover {
+		err = ei.bootstrap(ctx)
+		if err != nil {
+			log.Errorf("could not create rollover index %+v", err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+//detect reads the version of the cluster, ES 7+ and OpenSearch use the typeless APIs
+func (ei *elasticIndex) detect(ctx context.Context) error {
+	resp, err := ei.client.PerformRequest(ctx, elastic.PerformRequestOptions{
+		Method: "GET",
+		Path:   "/",
+	})
+	if err != nil {
+		return err
+	}
+
+	var info struct {
+		Version struct {
+			Number       string `json:"number"`
+			Distribution string `json:"distribution"`
+		} `json:"version"`
+	}
+	err = json.Unmarshal(resp.Body, &info)
+	if err != nil {
+		return err
+	}
+
+	major, err := strconv.Atoi(strings.SplitN(info.Version.Number, ".", 2)[0])
+	if err != nil {
+		return fmt.Errorf("unknown version %s", info.Version.Number)
+	}
+
+	ei.opensearch = info.Version.Distribution == "opensearch"
+	ei.typeless = ei.opensearch || major >= 7
+	log.Debugf("using elasticsearch %s (%s), typeless %v", info.Version.Number, info.Version.Distribution, ei.typeless)
+	return nil
+}
+
+func (ei *elasticIndex) put(ctx context.Context, path string, body interface{}) error {
+	_, err := ei.client.PerformRequest(ctx, elastic.PerformRequestOptions{
+		Method: "PUT",
+		Path:   path,
+		Body:   body,
+	})
+	return err
+}
+
+//bootstrap creates the first index of the write alias, if the alias does not exist yet
+func (ei *elasticIndex) bootstrap(ctx context.Context) error {
+	alias := ei.Name(time.Now())
+	resp, err := ei.client.PerformRequest(ctx, elastic.PerformRequestOptions{
+		Method:       "HEAD",
+		Path:         "/_alias/" + alias,
+		IgnoreErrors: []int{404},
+	})
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != 404 {
+		return nil
+	}
+
+	return ei.put(ctx, "/"+alias+"-000001", map[string]interface{}{
+		"aliases": map[string]interface{}{
+			alias: map[string]interface{}{"is_write_index": true},
+		},
+	})
+}
+
+//lifecyclePolicy rolls the write index over and deletes indices after the retention period
+func (ei *elasticIndex) lifecyclePolicy() map[string]interface{} {
+	hot := map[string]interface{}{}
+	if ei.rollover {
+		rollover := map[string]interface{}{}
+		if ei.maxAge != "" {
+			rollover["max_age"] = ei.maxAge
+		}
+		if ei.maxSize != "" {
+			rollover["max_size"] = ei.maxSize
+		}
+		hot["rollover"] = rollover
+	}
+
+	phases := map[string]interface{}{
+		"hot": map[string]interface{}{"actions": hot},
+	}
+	if ei.retention != "" {
+		phases["delete"] = map[string]interface{}{
+			"min_age": ei.retention,
+			"actions": map[string]interface{}{"delete": map[string]interface{}{}},
+		}
+	}
+
+	return map[string]interface{}{
+		"policy": map[string]interface{}{"phases": phases},
+	}
+}
+
+//indexTemplate maps the fields of the elasticDocument
+func (ei *elasticIndex) indexTemplate() map[string]interface{} {
+	keyword := map[string]interface{}{"type": "keyword"}
+	long := map[string]interface{}{"type": "long"}
+
+	mapping := map[string]interface{}{
+		"dynamic_templates": []interface{}{
+			map[string]interface{}{
+				"strings": map[string]interface{}{
+					"match_mapping_type": "string",
+					"mapping":            keyword,
+				},
+			},
+		},
+		"properties": map[string]interface{}{
+			"@timestamp":                map[string]interface{}{"type": "date"},
+			"request.id":                keyword,
+			"request.operationID":       keyword,
+			"request.method":            keyword,
+			"request.path":              keyword,
+			"request.client":            map[string]interface{}{"type": "ip"},
+			"request.length":            long,
+			"request.requestTime":       map[string]interface{}{"type": "double"},
+			"request.principal":         keyword,
+			"request.traceID":           keyword,
+			"response.code":             map[string]interface{}{"type": "integer"},
+			"response.length":           long,
+			"response.tlsVersion":       keyword,
+			"request.version":           keyword,
+			"request.mirrored":          map[string]interface{}{"type": "boolean"},
+			"response.diff":             keyword,
+			"response.cache":            keyword,
+			"request.coalesced":         map[string]interface{}{"type": "boolean"},
+			"response.compression":      keyword,
+			"response.compressionRatio": map[string]interface{}{"type": "double"},
+		},
+	}
+
+	settings := map[string]interface{}{}
+	if ei.policy != "" && !ei.opensearch {
+		settings["index.lifecycle.name"] = ei.policy
+		if ei.rollover {
+			settings["index.lifecycle.rollover_alias"] = ei.Name(time.Now())
+		}
+	}
+
+	template := map[string]interface{}{
+		"index_patterns": []string{ei.indexPattern()},
+		"settings":       settings,
+	}
+	if ei.typeless {
+		template["mappings"] = mapping
+	} else {
+		template["mappings"] = map[string]interface{}{ei.DocumentType(): mapping}
+	}
+	return template
+}
+
+//elasticDocument is the stored form of a meter, it reports the request time
+//in milliseconds and the client as a plain IP
+type elasticDocument struct {
+	MeterMessage
+	Client      string  `json:"request.client,omitempty"`
+	RequestTime float64 `json:"request.requestTime"`
+}
+
+func newElasticDocument(meter MeterMessage) elasticDocument {
+	client := meter.Client
+	if host, _, err := net.SplitHostPort(client); err == nil {
+		client = host
+	}
+
+	return elasticDocument{
+		MeterMessage: meter,
+		Client:       client,
+		RequestTime:  float64(meter.RequestTime) / float64(time.Millisecond),
+	}
+}
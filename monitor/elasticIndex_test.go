@@ -0,0 +1,160 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+
+package monitor
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/olivere/elastic"
+)
+
+//elasticStandIn answers the version request and records all other requests
+type elasticStandIn struct {
+	version  string
+	lock     sync.Mutex
+	requests map[string]map[string]interface{}
+}
+
+func (es *elasticStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/":
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"version":{"number":"` + es.version + `"}}`))
+	case r.Method == "HEAD":
+		w.WriteHeader(http.StatusNotFound)
+	default:
+		var body map[string]interface{}
+		data, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(data, &body)
+
+		es.lock.Lock()
+		es.requests[r.Method+" "+r.URL.Path] = body
+		es.lock.Unlock()
+		w.Write([]byte(`{"acknowledged":true}`))
+	}
+}
+
+func setupElasticIndex(t *testing.T, version string, conf Configuration) (*elasticIndex, *elasticStandIn) {
+	standIn := &elasticStandIn{version: version, requests: make(map[string]map[string]interface{})}
+	server := httptest.NewServer(standIn)
+	defer server.Close()
+
+	client, err := elastic.NewClient(elastic.SetURL(server.URL), elastic.SetSniff(false), elastic.SetHealthcheck(false))
+	if err != nil {
+		t.Fatalf("could not create client %+v", err)
+	}
+
+	index, err := newElasticIndex(conf, client)
+	if err != nil {
+		t.Fatalf("could not create index %+v", err)
+	}
+
+	err = index.detect(context.Background())
+	if err != nil {
+		t.Fatalf("version detection failed %+v", err)
+	}
+
+	err = index.Setup(context.Background())
+	if err != nil {
+		t.Fatalf("setup failed %+v", err)
+	}
+	return index, standIn
+}
+
+func TestElasticIndexRollover(t *testing.T) {
+	index, standIn := setupElasticIndex(t, "7.10.2", Configuration{
+		VDCName:                  "VDC1",
+		ElasticIndex:             "{vdc}-monitor",
+		ElasticRollover:          true,
+		ElasticTemplate:          true,
+		ElasticILMPolicy:         "monitor",
+		ElasticILMRolloverMaxAge: "1d",
+		ElasticILMRetention:      "30d",
+	})
+
+	if index.Name(time.Now()) != "vdc1-monitor" || index.DocumentType() != "_doc" {
+		t.Errorf("unexpected index %s/%s", index.Name(time.Now()), index.DocumentType())
+	}
+
+	policy := standIn.requests["PUT /_ilm/policy/monitor"]
+	phases, _ := lookupClaim(policy, "policy.phases").(map[string]interface{})
+	if phases["hot"] == nil || phases["delete"] == nil {
+		t.Errorf("unexpected ILM policy %+v", policy)
+	}
+
+	template := standIn.requests["PUT /_template/vdc1-request-monitor"]
+	properties, ok := lookupClaim(template, "mappings.properties").(map[string]interface{})
+	if !ok {
+		t.Fatalf("expected typeless mappings %+v", template)
+	}
+	client, _ := properties["request.client"].(map[string]interface{})
+	if client["type"] != "ip" {
+		t.Errorf("client should be mapped as ip %+v", client)
+	}
+	if lookupClaim(template, "settings").(map[string]interface{})["index.lifecycle.rollover_alias"] != "vdc1-monitor" {
+		t.Errorf("rollover alias is missing %+v", template)
+	}
+
+	if standIn.requests["PUT /vdc1-monitor-000001"] == nil {
+		t.Errorf("rollover index was not created")
+	}
+}
+
+func TestElasticIndexLegacyCluster(t *testing.T) {
+	index, standIn := setupElasticIndex(t, "6.8.0", Configuration{
+		VDCName:                "VDC1",
+		ElasticIndex:           "{vdc}-{date}",
+		ElasticIndexDateFormat: "2006.01",
+		ElasticTemplate:        true,
+	})
+
+	day := time.Date(2018, 7, 1, 12, 0, 0, 0, time.UTC)
+	if index.Name(day) != "vdc1-2018.07" || index.DocumentType() != "data" {
+		t.Errorf("unexpected index %s/%s", index.Name(day), index.DocumentType())
+	}
+
+	template := standIn.requests["PUT /_template/vdc1-request-monitor"]
+	if lookupClaim(template, "mappings.data.properties") == nil {
+		t.Errorf("expected mappings of type data %+v", template)
+	}
+	patterns, _ := template["index_patterns"].([]interface{})
+	if len(patterns) != 1 || patterns[0] != "vdc1-*" {
+		t.Errorf("unexpected index pattern %+v", patterns)
+	}
+}
+
+func TestElasticDocument(t *testing.T) {
+	doc := newElasticDocument(MeterMessage{Client: "10.0.0.1:51234", RequestTime: 1500 * time.Microsecond})
+
+	data, _ := json.Marshal(doc)
+	var fields map[string]interface{}
+	json.Unmarshal(data, &fields)
+
+	if fields["request.client"] != "10.0.0.1" || fields["request.requestTime"] != 1.5 {
+		t.Errorf("unexpected document %s", data)
+	}
+}
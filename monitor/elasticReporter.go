@@ -20,90 +20,351 @@ package monitor
 
 import (
 	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"reflect"
+	"sync"
 	"time"
 
 	"github.com/DITAS-Project/TUBUtil/util"
 	"github.com/olivere/elastic"
+	"github.com/sirupsen/logrus"
 )
 
 type elasticReporter struct {
-	Queue    chan MeterMessage
-	Client   *elastic.Client
-	VDCName  string
-	QuitChan chan bool
-	ctx      context.Context
+	Queue   chan MeterMessage
+	VDCName string
+	index   *elasticIndex
+	pool    *workerPool
+	ctx     context.Context
+
+	url           string
+	options       []elastic.ClientOptionFunc
+	retryInterval time.Duration
+	buffer        *meterBuffer
+
+	lock   *sync.Mutex
+	client *elastic.Client
 }
 
 //NewElasticReporter creates a new reporter worker,
-//will fail if no elastic client can be built
-//otherwise retunrs a worker handler
+//will fail if the elastic client is misconfigured. The cluster is connected in the background
+//once the reporter is started, meters are buffered until it becomes available
 func NewElasticReporter(config Configuration, queue chan MeterMessage) (elasticReporter, error) {
 
 	util.SetLogger(logger)
 	util.SetLog(log)
 
-	util.WaitForAvailible(config.ElasticSearchURL, nil)
-
-	client, err := elastic.NewClient(
-		elastic.SetURL(config.ElasticSearchURL),
-		elastic.SetSniff(false),
-	)
+	options, err := elasticClientOptions(config)
+	if err != nil {
+		log.Errorf("invalid elastic client configuration %+v", err)
+		return elasticReporter{}, err
+	}
 
 	log.Debugf("using %s as ES endpoint", config.ElasticSearchURL)
 
+	index, err := newElasticIndex(config, nil)
+	if err != nil {
+		log.Errorf("invalid index configuration %+v", err)
+		return elasticReporter{}, err
+	}
+
+	pool, err := newWorkerPool(config, "monitor")
 	if err != nil {
-		log.Error("failed to connect to elastic serach", err)
 		return elasticReporter{}, err
 	}
 
+	retryInterval := config.ElasticRetryInterval
+	if retryInterval <= 0 {
+		retryInterval = 5 * time.Second
+	}
+
 	reporter := elasticReporter{
-		Queue:    queue,
-		Client:   client,
-		VDCName:  config.VDCName,
-		QuitChan: make(chan bool),
-		ctx:      context.Background(),
+		Queue:   queue,
+		VDCName: config.VDCName,
+		index:   index,
+		pool:    pool,
+		ctx:     context.Background(),
+
+		url:           config.ElasticSearchURL,
+		options:       options,
+		retryInterval: retryInterval,
+		buffer:        newMeterBuffer(config.ElasticBufferSize),
+		lock:          &sync.Mutex{},
 	}
+	sinks.Set("elastic", sinkConnecting)
 
 	return reporter, nil
 }
 
-//Start creates a new worker process and waits for meterMessages
-//can only be terminated by calling Stop()
+//Start creates the worker processes that wait for meterMessages and
+//connects to elastic in the background, can only be terminated by calling Stop()
 func (er *elasticReporter) Start() {
-	go func() {
-		for {
+	er.pool.Start(er.Queue, func(queue interface{}, wlog *logrus.Entry) {
+		er.work(queue.(chan MeterMessage), wlog)
+	}, nil)
+
+	go er.maintain()
+}
+
+func (er *elasticReporter) work(queue chan MeterMessage, wlog *logrus.Entry) {
+	for {
 
-			select {
-			case work := <-er.Queue:
-				//TODO
-				log.Infof("reporting %s - %s", work.Client, work.Method)
+		select {
+		case work := <-queue:
+			//TODO
+			wlog.Infof("reporting %s - %s", work.Client, work.Method)
 
+			if work.Timestamp.IsZero() {
 				work.Timestamp = time.Now()
+			}
+
+			client := er.connected()
+			if client == nil || er.buffer.Len() > 0 {
+				//keep the order until the buffered meters are delivered
+				er.buffer.Add(work)
+				continue
+			}
+
+			err := er.report(client, work)
+			if err != nil {
+				wlog.Debugf("failed to report mesurement to %+v", err)
+			} else {
+				wlog.Debug("reported data to elastic!")
+			}
+
+		case <-er.pool.Done():
+			// We have been asked to stop.
+			wlog.Info("worker stopping")
+			return
+		}
+	}
+}
+
+//report indexes a meter, meters that could not be delivered because the cluster
+//is unreachable are buffered
+func (er *elasticReporter) report(client *elastic.Client, work MeterMessage) error {
+	_, err := client.Index().Index(er.index.Name(work.Timestamp)).Type(er.index.DocumentType()).BodyJson(newElasticDocument(work)).Do(er.ctx)
+	if err != nil && isConnectionError(err) {
+		er.buffer.Add(work)
+		sinks.Set("elastic", sinkDegraded)
+	}
+	return err
+}
+
+//isConnectionError reports if the cluster could not be reached, other errors are answers of the cluster
+func isConnectionError(err error) bool {
+	if e, ok := err.(*elastic.Error); ok {
+		return e.Status == 0 || e.Status >= http.StatusInternalServerError
+	}
+	return true
+}
+
+func (er *elasticReporter) connected() *elastic.Client {
+	er.lock.Lock()
+	defer er.lock.Unlock()
+	return er.client
+}
+
+//maintain connects to the cluster and delivers the buffered meters,
+//retrying every retry interval until the reporter is stopped
+func (er *elasticReporter) maintain() {
+	ticker := time.NewTicker(er.retryInterval)
+	defer ticker.Stop()
 
-				_, err := er.Client.Index().Index(er.getElasticIndex()).Type("data").BodyJson(work).Do(er.ctx)
+	for {
+		client := er.connected()
+		if client == nil {
+			client = er.connect()
+		}
 
-				if err != nil {
-					log.Debug("failed to report mesurement to", err)
-				} else {
-					log.Debug("reported data to elastic!")
-				}
+		if client != nil {
+			er.flush(client)
+		}
 
-			case <-er.QuitChan:
-				// We have been asked to stop.
-				log.Info("worker%d stopping")
-				return
+		select {
+		case <-ticker.C:
+		case <-er.pool.Done():
+			if n := er.buffer.Len(); n > 0 {
+				log.Warnf("dropping %d buffered meters", n)
 			}
+			return
 		}
-	}()
+	}
+}
+
+//connect creates the client and prepares the indices, it returns nil while the cluster is unavailable
+func (er *elasticReporter) connect() *elastic.Client {
+	client, err := elastic.NewClient(append([]elastic.ClientOptionFunc{
+		elastic.SetURL(er.url),
+		elastic.SetSniff(false),
+	}, er.options...)...)
+	if err != nil {
+		log.Warnf("elastic is not available, buffering meters %+v", err)
+		return nil
+	}
+
+	er.index.client = client
+	err = er.index.detect(er.ctx)
+	if err != nil {
+		log.Warnf("elastic is not available, buffering meters %+v", err)
+		return nil
+	}
+
+	err = er.index.Setup(er.ctx)
+	if err != nil {
+		log.Warnf("could not prepare elastic indices, meters are stored with the cluster defaults %+v", err)
+	}
+
+	er.lock.Lock()
+	er.client = client
+	er.lock.Unlock()
+
+	log.Infof("connected to elastic at %s", er.url)
+	return client
+}
+
+//flush delivers the buffered meters in order, it stops at the first connection error
+func (er *elasticReporter) flush(client *elastic.Client) {
+	for {
+		work, ok := er.buffer.Peek()
+		if !ok {
+			sinks.Set("elastic", sinkUp)
+			return
+		}
+
+		_, err := client.Index().Index(er.index.Name(work.Timestamp)).Type(er.index.DocumentType()).BodyJson(newElasticDocument(work)).Do(er.ctx)
+		if err != nil && isConnectionError(err) {
+			log.Debugf("elastic is still not available %+v", err)
+			sinks.Set("elastic", sinkDegraded)
+			return
+		}
+		if err != nil {
+			log.Debugf("failed to report buffered mesurement %+v", err)
+		}
+		er.buffer.Remove(work)
+	}
 }
 
 //Stop termintates this Worker
 func (er *elasticReporter) Stop() {
-	go func() {
-		er.QuitChan <- true
-	}()
+	er.pool.Stop()
+}
+
+//meterBuffer keeps the meters that could not be delivered yet,
+//the oldest meters are dropped once it is full
+type meterBuffer struct {
+	lock   sync.Mutex
+	size   int
+	meters []MeterMessage
 }
 
-func (er *elasticReporter) getElasticIndex() string {
-	return util.GetElasticIndex(er.VDCName)
+func newMeterBuffer(size int) *meterBuffer {
+	if size <= 0 {
+		size = 10000
+	}
+	return &meterBuffer{size: size}
+}
+
+//Add appends a meter to the buffer
+func (mb *meterBuffer) Add(meter MeterMessage) {
+	mb.lock.Lock()
+	defer mb.lock.Unlock()
+
+	if len(mb.meters) >= mb.size {
+		mb.meters = mb.meters[1:]
+		metrics.Add("request_monitor_elastic_buffer_dropped_total", 1)
+	}
+	mb.meters = append(mb.meters, meter)
+	metrics.Set("request_monitor_elastic_buffered", float64(len(mb.meters)))
+}
+
+//Peek returns the oldest meter
+func (mb *meterBuffer) Peek() (MeterMessage, bool) {
+	mb.lock.Lock()
+	defer mb.lock.Unlock()
+
+	if len(mb.meters) == 0 {
+		return MeterMessage{}, false
+	}
+	return mb.meters[0], true
+}
+
+//Remove removes the oldest meter if it is still the given one
+func (mb *meterBuffer) Remove(meter MeterMessage) {
+	mb.lock.Lock()
+	defer mb.lock.Unlock()
+
+	if len(mb.meters) > 0 && reflect.DeepEqual(mb.meters[0], meter) {
+		mb.meters = mb.meters[1:]
+	}
+	metrics.Set("request_monitor_elastic_buffered", float64(len(mb.meters)))
+}
+
+//Len returns the number of buffered meters
+func (mb *meterBuffer) Len() int {
+	mb.lock.Lock()
+	defer mb.lock.Unlock()
+	return len(mb.meters)
+}
+
+//elasticClientOptions creates the authentication and TLS options of the elastic client,
+//passwords and api keys were already read from a file or the environment by resolveSecrets
+func elasticClientOptions(config Configuration) ([]elastic.ClientOptionFunc, error) {
+	options := make([]elastic.ClientOptionFunc, 0)
+	password, apiKey := config.ElasticPassword, config.ElasticAPIKey
+
+	if config.ElasticUsername != "" {
+		if apiKey != "" {
+			return nil, fmt.Errorf("either basic auth or an api key can be used for elastic")
+		}
+		options = append(options, elastic.SetBasicAuth(config.ElasticUsername, password))
+	}
+
+	tlsConfig, err := loadTLSConfig(config, config.ElasticCAFile, config.ElasticClientCert, config.ElasticClientKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var transport http.RoundTripper = &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConnsPerHost: 4,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+		TLSClientConfig:     tlsConfig,
+	}
+
+	if apiKey != "" {
+		transport = &authorizationTransport{
+			authorization: "ApiKey " + apiKey,
+			next:          transport,
+		}
+	}
+
+	options = append(options, elastic.SetHttpClient(&http.Client{Transport: transport}))
+	return options, nil
+}
+
+//authorizationTransport sets the Authorization header of all requests
+type authorizationTransport struct {
+	authorization string
+	next          http.RoundTripper
+}
+
+func (at *authorizationTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	//the request must not be modified, see http.RoundTripper
+	clone := new(http.Request)
+	*clone = *req
+	clone.Header = make(http.Header, len(req.Header)+1)
+	for key, values := range req.Header {
+		clone.Header[key] = values
+	}
+	clone.Header.Set("Authorization", at.authorization)
+
+	return at.next.RoundTrip(clone)
 }
@@ -0,0 +1,167 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+
+package monitor
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/olivere/elastic"
+)
+
+func TestElasticClientAPIKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "elastic")
+	if err != nil {
+		t.Fatalf("could not prepare test %+v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	err = ioutil.WriteFile(filepath.Join(dir, "apikey"), []byte("c2VjcmV0\n"), 0600)
+	if err != nil {
+		t.Fatalf("could not prepare test %+v", err)
+	}
+
+	var authorization string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		w.Write([]byte(`{"version":{"number":"7.0.0"}}`))
+	}))
+	defer server.Close()
+
+	conf := Configuration{configDir: dir, ElasticAPIKeyFile: "apikey"}
+	if err := conf.resolveSecrets(); err != nil {
+		t.Fatalf("could not resolve secrets %+v", err)
+	}
+	options, err := elasticClientOptions(conf)
+	if err != nil {
+		t.Fatalf("could not create options %+v", err)
+	}
+
+	client, err := elastic.NewClient(append([]elastic.ClientOptionFunc{
+		elastic.SetURL(server.URL),
+		elastic.SetSniff(false),
+		elastic.SetHealthcheck(false),
+	}, options...)...)
+	if err != nil {
+		t.Fatalf("could not create client %+v", err)
+	}
+
+	_, err = client.PerformRequest(context.Background(), elastic.PerformRequestOptions{Method: "GET", Path: "/"})
+	if err != nil {
+		t.Fatalf("request failed %+v", err)
+	}
+	if authorization != "ApiKey c2VjcmV0" {
+		t.Errorf("unexpected authorization %s", authorization)
+	}
+
+	conf.ElasticUsername = "monitor"
+	if _, err := elasticClientOptions(conf); err == nil {
+		t.Errorf("basic auth and api keys should be exclusive")
+	}
+}
+
+func TestConfigurationRedacted(t *testing.T) {
+	os.Setenv("ELASTIC_PASSWORD", "from-env")
+	defer os.Unsetenv("ELASTIC_PASSWORD")
+
+	conf := Configuration{ElasticUsername: "monitor", ElasticAPIKey: "key"}
+	err := conf.resolveSecrets()
+	if err != nil || conf.ElasticPassword != "from-env" {
+		t.Errorf("expected the password from the environment, got %s %+v", conf.ElasticPassword, err)
+	}
+
+	logged := fmt.Sprintf("%+v", conf.redacted())
+	if !strings.Contains(logged, "ElasticAPIKey:<redacted>") {
+		t.Errorf("secret was not redacted %s", logged)
+	}
+	if conf.ElasticAPIKey != "key" {
+		t.Errorf("redacted must not modify the configuration")
+	}
+}
+
+func TestElasticReporterBuffersUntilAvailable(t *testing.T) {
+	var lock sync.Mutex
+	available := false
+	indexed := make([]string, 0)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		if !available {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/":
+			w.Write([]byte(`{"version":{"number":"7.10.2"}}`))
+		case r.Method == "POST":
+			data, _ := ioutil.ReadAll(r.Body)
+			indexed = append(indexed, string(data))
+			w.Write([]byte(`{"result":"created"}`))
+		default:
+			w.Write([]byte(`{"acknowledged":true}`))
+		}
+	}))
+	defer server.Close()
+
+	queue := make(chan MeterMessage, 10)
+	reporter, err := NewElasticReporter(Configuration{
+		ElasticSearchURL:     server.URL,
+		ElasticIndex:         "monitor",
+		ElasticRetryInterval: 20 * time.Millisecond,
+	}, queue)
+	if err != nil {
+		t.Fatalf("reporter should not wait for elastic %+v", err)
+	}
+	reporter.Start()
+	defer reporter.Stop()
+
+	for _, id := range []string{"a", "b", "c"} {
+		queue <- MeterMessage{RequestID: id}
+	}
+
+	waitFor(t, func() bool { return reporter.buffer.Len() == 3 })
+	if state := sinks.States()["elastic"]; state == sinkUp {
+		t.Errorf("elastic should not be up")
+	}
+
+	lock.Lock()
+	available = true
+	lock.Unlock()
+
+	waitFor(t, func() bool { return sinks.States()["elastic"] == sinkUp })
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(indexed) != 3 || !strings.Contains(indexed[0], `"request.id":"a"`) || !strings.Contains(indexed[2], `"request.id":"c"`) {
+		t.Errorf("buffered meters were not delivered in order %v", indexed)
+	}
+}
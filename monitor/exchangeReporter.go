@@ -1,83 +1,228 @@
-/*
- * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
- *
- * Licensed under the Apache License, Version 2.0 (the "License");
- * you may not use this file except in compliance with the License.
- * You may obtain a copy of the License at
- *
- *                       http://www.apache.org/licenses/LICENSE-2.0
- *
- * Unless required by applicable law or agreed to in writing, software
- * distributed under the License is distributed on an "AS IS" BASIS,
- * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
- * See the License for the specific language governing permissions and
- * limitations under the License.
- *
- * This is being developed for the DITAS Project: https://www.ditas-project.eu/
- */
-
 package monitor
 
 import (
 	"bytes"
+	"compress/gzip"
 	"encoding/json"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
 )
 
 type exchangeReporter struct {
 	Queue            chan exchangeMessage
 	ExchangeEndpoint string
-	QuitChan         chan bool
+	pool             *workerPool
+
+	client        *http.Client
+	BatchSize     int
+	FlushInterval time.Duration
+	Retries       int
+	Gzip          bool
+	BearerToken   string
 }
 
 //newExchangeReporter creates a new exchange worker
-func newExchangeReporter(ExchangeEndpoint string, queue chan exchangeMessage) (exchangeReporter, error) {
-	//Wait for endpoint to become availible or timeout with error
+func newExchangeReporter(conf Configuration, queue chan exchangeMessage) (exchangeReporter, error) {
+	tlsConfig, err := loadTLSConfig(conf, conf.ExchangeCAFile, conf.ExchangeClientCert, conf.ExchangeClientKey)
+	if err != nil {
+		return exchangeReporter{}, err
+	}
+
+	timeout := conf.ExchangeTimeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+
+	flushInterval := conf.ExchangeFlushInterval
+	if flushInterval <= 0 {
+		flushInterval = time.Second
+	}
+
+	batchSize := conf.ExchangeBatchSize
+	if batchSize <= 0 {
+		batchSize = 1
+	}
+
+	pool, err := newWorkerPool(conf, "exchange")
+	if err != nil {
+		return exchangeReporter{}, err
+	}
+
+	client := &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   timeout,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			MaxIdleConnsPerHost: 4,
+			IdleConnTimeout:     90 * time.Second,
+			TLSHandshakeTimeout: timeout,
+			TLSClientConfig:     tlsConfig,
+		},
+	}
+
 	return exchangeReporter{
 		Queue:            queue,
-		ExchangeEndpoint: ExchangeEndpoint,
-		QuitChan:         make(chan bool),
+		ExchangeEndpoint: conf.ExchangeReporterURL,
+		pool:             pool,
+		client:           client,
+		BatchSize:        batchSize,
+		FlushInterval:    flushInterval,
+		Retries:          conf.ExchangeRetries,
+		Gzip:             conf.ExchangeGzip,
+		BearerToken:      conf.ExchangeBearerToken,
 	}, nil
 }
 
-//Start will create a new worker process, for processing exchange Messages
+//Start will create the worker processes, for processing exchange Messages
 func (er *exchangeReporter) Start() {
-	go func() {
-		for {
-
-			select {
-			case work := <-er.Queue:
-				b := new(bytes.Buffer)
-				json.NewEncoder(b).Encode(work)
-				//send
-				log.Debug("sending data to excahge!")
-				resp, err := http.Post(er.ExchangeEndpoint, "application/json; charset=utf-8", b)
-
-				if err != nil {
-					log.Debug("failed to forward to :%s", err)
-				}
-
-				if resp.StatusCode > 200 {
-					msg, err := ioutil.ReadAll(resp.Body)
-					if err != nil {
-						log.Info("exchange failed %d - %s", resp.StatusCode, string(msg))
-					}
-				}
-				log.Debugf("send data to excahge with: %d", resp.StatusCode)
-
-			case <-er.QuitChan:
-				// We have been asked to stop.
-				log.Info("worker%d stopping")
-				return
+	er.pool.Start(er.Queue, func(queue interface{}, wlog *logrus.Entry) {
+		er.work(queue.(chan exchangeMessage), wlog)
+	}, nil)
+}
+
+func (er *exchangeReporter) work(queue chan exchangeMessage, wlog *logrus.Entry) {
+	ticker := time.NewTicker(er.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]exchangeMessage, 0, er.BatchSize)
+	for {
+
+		select {
+		case work := <-queue:
+			batch = append(batch, work)
+			if len(batch) >= er.BatchSize {
+				er.send(batch, wlog)
+				batch = batch[:0]
+			}
+
+		case <-ticker.C:
+			if len(batch) > 0 {
+				er.send(batch, wlog)
+				batch = batch[:0]
 			}
+
+		case <-er.pool.Done():
+			// We have been asked to stop.
+			if len(batch) > 0 {
+				er.send(batch, wlog)
+			}
+			wlog.Info("exchange worker stopping")
+			return
 		}
-	}()
+	}
 }
 
 //Stop will terminate any running worker process
 func (er *exchangeReporter) Stop() {
-	go func() {
-		er.QuitChan <- true
-	}()
+	er.pool.Stop()
+}
+
+//send delivers a batch, retrying failed attempts with an exponential backoff
+func (er *exchangeReporter) send(batch []exchangeMessage, wlog *logrus.Entry) {
+	body, contentType, err := er.encode(batch)
+	if err != nil {
+		wlog.Errorf("failed to encode exchange messages %+v", err)
+		metrics.Add("request_monitor_exchange_failed_total", float64(len(batch)))
+		return
+	}
+
+	backoff := 100 * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		retry, err := er.post(body, contentType)
+		if err == nil {
+			wlog.Debugf("send %d messages to exchange", len(batch))
+			metrics.Add("request_monitor_exchange_sent_total", float64(len(batch)))
+			metrics.Add("request_monitor_exchange_sent_bytes_total", float64(len(body)))
+			sinks.Set("exchange", sinkUp)
+			return
+		}
+
+		if !retry || attempt >= er.Retries {
+			wlog.Warnf("failed to forward %d messages to exchange %+v", len(batch), err)
+			metrics.Add("request_monitor_exchange_failed_total", float64(len(batch)))
+			if retry {
+				sinks.Set("exchange", sinkDegraded)
+			}
+			return
+		}
+
+		wlog.Debugf("exchange failed, retrying in %s %+v", backoff, err)
+		metrics.Add("request_monitor_exchange_retries_total", 1)
+		time.Sleep(backoff)
+		if backoff < 10*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+//encode creates a single JSON document or, for batches, a NDJSON body
+func (er *exchangeReporter) encode(batch []exchangeMessage) ([]byte, string, error) {
+	b := new(bytes.Buffer)
+	var w io.Writer = b
+
+	var zw *gzip.Writer
+	if er.Gzip {
+		zw = gzip.NewWriter(b)
+		w = zw
+	}
+
+	encoder := json.NewEncoder(w)
+	for _, work := range batch {
+		err := encoder.Encode(work)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	if zw != nil {
+		err := zw.Close()
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	if er.BatchSize > 1 {
+		return b.Bytes(), "application/x-ndjson", nil
+	}
+	return b.Bytes(), "application/json; charset=utf-8", nil
+}
+
+//post sends one body to the exchange, it reports if a failed attempt may be retried
+func (er *exchangeReporter) post(body []byte, contentType string) (bool, error) {
+	req, err := http.NewRequest("POST", er.ExchangeEndpoint, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+
+	req.Header.Set("Content-Type", contentType)
+	if er.Gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	if er.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+er.BearerToken)
+	}
+
+	resp, err := er.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		return retry, fmt.Errorf("exchange responded with %d - %s", resp.StatusCode, string(msg))
+	}
+
+	io.Copy(ioutil.Discard, resp.Body)
+	return false, nil
 }
@@ -0,0 +1,135 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+
+package monitor
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestExchangeReporterBatchRetry(t *testing.T) {
+	var lock sync.Mutex
+	var attempts int
+	var received []exchangeMessage
+
+	exchange := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			t.Errorf("missing bearer token, got %s", r.Header.Get("Authorization"))
+		}
+		if r.Header.Get("Content-Type") != "application/x-ndjson" {
+			t.Errorf("expected NDJSON body, got %s", r.Header.Get("Content-Type"))
+		}
+
+		body, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Errorf("body is not gzip encoded %+v", err)
+			return
+		}
+
+		scanner := bufio.NewScanner(body)
+		for scanner.Scan() {
+			var msg exchangeMessage
+			if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+				t.Errorf("invalid NDJSON line %+v", err)
+			}
+			received = append(received, msg)
+		}
+	}))
+	defer exchange.Close()
+
+	queue := make(chan exchangeMessage, 10)
+	reporter, err := newExchangeReporter(Configuration{
+		ExchangeReporterURL:   exchange.URL,
+		ExchangeRetries:       2,
+		ExchangeBatchSize:     2,
+		ExchangeFlushInterval: time.Minute,
+		ExchangeGzip:          true,
+		ExchangeBearerToken:   "secret",
+	}, queue)
+	if err != nil {
+		t.Fatalf("could not create reporter %+v", err)
+	}
+	reporter.Start()
+	defer reporter.Stop()
+
+	queue <- exchangeMessage{RequestID: "a"}
+	queue <- exchangeMessage{RequestID: "b"}
+
+	waitFor(t, func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(received) == 2
+	})
+
+	lock.Lock()
+	defer lock.Unlock()
+	if attempts != 2 {
+		t.Errorf("expected one retry, got %d attempts", attempts)
+	}
+	if received[0].RequestID != "a" || received[1].RequestID != "b" {
+		t.Errorf("unexpected messages %+v", received)
+	}
+}
+
+func TestExchangeReporterPermanentFailure(t *testing.T) {
+	var lock sync.Mutex
+	var attempts int
+
+	exchange := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		attempts++
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer exchange.Close()
+
+	reporter, err := newExchangeReporter(Configuration{
+		ExchangeReporterURL: exchange.URL,
+		ExchangeRetries:     3,
+	}, nil)
+	if err != nil {
+		t.Fatalf("could not create reporter %+v", err)
+	}
+
+	before := metrics.Get("request_monitor_exchange_failed_total")
+	reporter.send([]exchangeMessage{{}}, log)
+
+	if attempts != 1 {
+		t.Errorf("client errors should not be retried, got %d attempts", attempts)
+	}
+	if metrics.Get("request_monitor_exchange_failed_total") != before+1 {
+		t.Errorf("failed message was not counted")
+	}
+}
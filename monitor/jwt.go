@@ -0,0 +1,335 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+package monitor
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256" //register the hashes used by the RS/ES algorithms
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//jwtAuthenticator validates bearer tokens against the keys of a local JWKS file
+type jwtAuthenticator struct {
+	keys       map[string]crypto.PublicKey
+	issuer     string
+	audience   string
+	rolesClaim string
+	leeway     time.Duration
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+var jwtAlgorithms = map[string]crypto.Hash{
+	"RS256": crypto.SHA256,
+	"RS384": crypto.SHA384,
+	"RS512": crypto.SHA512,
+	"ES256": crypto.SHA256,
+	"ES384": crypto.SHA384,
+	"ES512": crypto.SHA512,
+}
+
+func newJWTAuthenticator(conf Configuration) (*jwtAuthenticator, error) {
+	keys, err := readJWKS(conf.configPath(conf.AuthJWKSFile))
+	if err != nil {
+		log.Errorf("could not read jwks %+v", err)
+		return nil, err
+	}
+
+	rolesClaim := conf.AuthRolesClaim
+	if rolesClaim == "" {
+		rolesClaim = "roles"
+	}
+
+	return &jwtAuthenticator{
+		keys:       keys,
+		issuer:     conf.AuthJWTIssuer,
+		audience:   conf.AuthJWTAudience,
+		rolesClaim: rolesClaim,
+		leeway:     time.Minute,
+	}, nil
+}
+
+func readJWKS(file string) (map[string]crypto.PublicKey, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	err = json.Unmarshal(data, &jwks)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, jwk := range jwks.Keys {
+		key, err := jwk.PublicKey()
+		if err != nil {
+			log.Warnf("skipping key %s - %+v", jwk.Kid, err)
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no usable keys in %s", file)
+	}
+	return keys, nil
+}
+
+//PublicKey converts a RSA or EC json web key
+func (jwk jsonWebKey) PublicKey() (crypto.PublicKey, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decodeBigInt(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", jwk.Crv)
+		}
+		x, err := decodeBigInt(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %s", jwk.Kty)
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(data), nil
+}
+
+func (a *jwtAuthenticator) Authenticate(req *http.Request) (*principal, error) {
+	authorization := req.Header.Get("Authorization")
+	if len(authorization) < 7 || !strings.EqualFold(authorization[:7], "Bearer ") {
+		return nil, errUnauthenticated
+	}
+
+	claims, err := a.verify(strings.TrimSpace(authorization[7:]))
+	if err != nil {
+		return nil, err
+	}
+
+	name, _ := claims["sub"].(string)
+	return &principal{Name: name, Roles: claimStrings(lookupClaim(claims, a.rolesClaim))}, nil
+}
+
+func (a *jwtAuthenticator) Challenge() string {
+	return `Bearer realm="VDC"`
+}
+
+//verify checks the signature and the registered claims of a token and returns its claims
+func (a *jwtAuthenticator) verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	var header jwtHeader
+	err := decodeSegment(parts[0], &header)
+	if err != nil {
+		return nil, err
+	}
+
+	hash, ok := jwtAlgorithms[header.Alg]
+	if !ok {
+		return nil, fmt.Errorf("unsupported algorithm %s", header.Alg)
+	}
+
+	key, err := a.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+
+	hasher := hash.New()
+	hasher.Write([]byte(parts[0] + "." + parts[1]))
+	digest := hasher.Sum(nil)
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(header.Alg, "RS") {
+			return nil, errors.New("algorithm does not match key")
+		}
+		err = rsa.VerifyPKCS1v15(k, hash, digest, signature)
+		if err != nil {
+			return nil, err
+		}
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if !strings.HasPrefix(header.Alg, "ES") || len(signature) != 2*size {
+			return nil, errors.New("algorithm does not match key")
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return nil, errors.New("invalid signature")
+		}
+	}
+
+	var claims map[string]interface{}
+	err = decodeSegment(parts[1], &claims)
+	if err != nil {
+		return nil, err
+	}
+
+	return claims, a.validate(claims)
+}
+
+func (a *jwtAuthenticator) key(kid string) (crypto.PublicKey, error) {
+	if key, ok := a.keys[kid]; ok {
+		return key, nil
+	}
+
+	if kid == "" && len(a.keys) == 1 {
+		for _, key := range a.keys {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown key %s", kid)
+}
+
+func (a *jwtAuthenticator) validate(claims map[string]interface{}) error {
+	now := time.Now()
+
+	if exp, ok := claims["exp"].(float64); ok {
+		if now.After(time.Unix(int64(exp), 0).Add(a.leeway)) {
+			return errors.New("token expired")
+		}
+	}
+
+	if nbf, ok := claims["nbf"].(float64); ok {
+		if now.Add(a.leeway).Before(time.Unix(int64(nbf), 0)) {
+			return errors.New("token not yet valid")
+		}
+	}
+
+	if a.issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != a.issuer {
+			return fmt.Errorf("unexpected issuer %s", iss)
+		}
+	}
+
+	if a.audience != "" {
+		found := false
+		for _, aud := range claimStrings(claims["aud"]) {
+			if aud == a.audience {
+				found = true
+			}
+		}
+		if !found {
+			return errors.New("token not issued for this audience")
+		}
+	}
+
+	return nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+//lookupClaim resolves dotted claim names like realm_access.roles
+func lookupClaim(claims map[string]interface{}, name string) interface{} {
+	var current interface{} = claims
+	for _, part := range strings.Split(name, ".") {
+		m, ok := current.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		current = m[part]
+	}
+	return current
+}
+
+//claimStrings converts a claim that is either a list or a space separated string
+func claimStrings(claim interface{}) []string {
+	switch v := claim.(type) {
+	case string:
+		return strings.Fields(v)
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, e := range v {
+			if str, ok := e.(string); ok {
+				values = append(values, str)
+			}
+		}
+		return values
+	}
+	return nil
+}
@@ -0,0 +1,395 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+package monitor
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+//busMessage is a meter or exchange record waiting to be published
+type busMessage struct {
+	Kind        string //meter or exchange
+	OperationID string
+	Payload     interface{}
+}
+
+//busPublisher delivers batches of encoded records grouped by topic
+type busPublisher interface {
+	Publish(batch map[string][][]byte) error
+	Close() error
+}
+
+type messageBusReporter struct {
+	Queue         chan busMessage
+	Publisher     busPublisher
+	Topic         string
+	VDCName       string
+	BatchSize     int
+	FlushInterval time.Duration
+	Retries       int
+	pool          *workerPool
+}
+
+var topicSanitizer = regexp.MustCompile("[^a-zA-Z0-9._-]")
+
+//newMessageBusReporter creates a reporter for the configured MessageBusType
+func newMessageBusReporter(conf Configuration, queue chan busMessage) (messageBusReporter, error) {
+	var publisher busPublisher
+	var err error
+	switch strings.ToLower(conf.MessageBusType) {
+	case "nats":
+		publisher, err = newNATSPublisher(conf.MessageBusURL)
+	case "kafka-rest":
+		publisher = newKafkaRESTPublisher(conf.MessageBusURL)
+	default:
+		err = fmt.Errorf("unknown message bus type %s", conf.MessageBusType)
+	}
+	if err != nil {
+		return messageBusReporter{}, err
+	}
+
+	retries := 0
+	switch strings.ToLower(conf.MessageBusDelivery) {
+	case "", "at-most-once":
+	case "at-least-once":
+		retries = conf.MessageBusRetries
+	default:
+		return messageBusReporter{}, fmt.Errorf("unknown delivery guarantee %s", conf.MessageBusDelivery)
+	}
+
+	batchSize := conf.MessageBusBatchSize
+	if batchSize <= 0 {
+		batchSize = 1
+	}
+
+	flushInterval := conf.MessageBusFlushInterval
+	if flushInterval <= 0 {
+		flushInterval = time.Second
+	}
+
+	pool, err := newWorkerPool(conf, "bus")
+	if err != nil {
+		publisher.Close()
+		return messageBusReporter{}, err
+	}
+
+	return messageBusReporter{
+		Queue:         queue,
+		Publisher:     publisher,
+		Topic:         conf.MessageBusTopic,
+		VDCName:       conf.VDCName,
+		BatchSize:     batchSize,
+		FlushInterval: flushInterval,
+		Retries:       retries,
+		pool:          pool,
+	}, nil
+}
+
+//Start creates the worker processes that publish batches of messages,
+//the publisher is closed once all workers stopped
+func (mr *messageBusReporter) Start() {
+	mr.pool.Start(mr.Queue, func(queue interface{}, wlog *logrus.Entry) {
+		mr.work(queue.(chan busMessage), wlog)
+	}, func() {
+		mr.Publisher.Close()
+	})
+}
+
+func (mr *messageBusReporter) work(queue chan busMessage, wlog *logrus.Entry) {
+	ticker := time.NewTicker(mr.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make(map[string][][]byte)
+	size := 0
+	flush := func() {
+		if size > 0 {
+			mr.publish(batch, size, wlog)
+			batch = make(map[string][][]byte)
+			size = 0
+		}
+	}
+
+	for {
+		select {
+		case msg := <-queue:
+			data, err := json.Marshal(msg.Payload)
+			if err != nil {
+				wlog.Debugf("failed to encode %s message %+v", msg.Kind, err)
+				continue
+			}
+			topic := mr.topic(msg)
+			batch[topic] = append(batch[topic], data)
+			size++
+			if size >= mr.BatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-mr.pool.Done():
+			flush()
+			wlog.Info("message bus worker stopping")
+			return
+		}
+	}
+}
+
+//Stop terminates this Worker
+func (mr *messageBusReporter) Stop() {
+	mr.pool.Stop()
+}
+
+func (mr *messageBusReporter) publish(batch map[string][][]byte, size int, wlog *logrus.Entry) {
+	backoff := 100 * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		err := mr.Publisher.Publish(batch)
+		if err == nil {
+			metrics.Add("request_monitor_bus_published_total", float64(size))
+			sinks.Set("bus", sinkUp)
+			return
+		}
+
+		if attempt >= mr.Retries {
+			wlog.Warnf("dropping %d messages, publishing failed %+v", size, err)
+			metrics.Add("request_monitor_bus_dropped_total", float64(size))
+			sinks.Set("bus", sinkDegraded)
+			return
+		}
+
+		wlog.Debugf("publishing failed, retrying in %s %+v", backoff, err)
+		time.Sleep(backoff)
+		if backoff < 10*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+//topic expands the {vdc}, {kind} and {operation} placeholders of the topic template
+func (mr *messageBusReporter) topic(msg busMessage) string {
+	operationID := msg.OperationID
+	if operationID == "" {
+		operationID = "unknown"
+	}
+
+	topic := strings.NewReplacer(
+		"{vdc}", topicSanitizer.ReplaceAllString(mr.VDCName, "_"),
+		"{kind}", msg.Kind,
+		"{operation}", topicSanitizer.ReplaceAllString(operationID, "_"),
+	).Replace(mr.Topic)
+	return topic
+}
+
+//kafkaRESTPublisher produces records using the Kafka REST proxy API (v2)
+type kafkaRESTPublisher struct {
+	baseURL string
+	client  *http.Client
+}
+
+func newKafkaRESTPublisher(baseURL string) *kafkaRESTPublisher {
+	return &kafkaRESTPublisher{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (kp *kafkaRESTPublisher) Publish(batch map[string][][]byte) error {
+	for topic, records := range batch {
+		body := bytes.NewBufferString(`{"records":[`)
+		for i, record := range records {
+			if i > 0 {
+				body.WriteString(",")
+			}
+			body.WriteString(`{"value":`)
+			body.Write(record)
+			body.WriteString("}")
+		}
+		body.WriteString("]}")
+
+		resp, err := kp.client.Post(kp.baseURL+"/topics/"+url.PathEscape(topic), "application/vnd.kafka.json.v2+json", body)
+		if err != nil {
+			return err
+		}
+
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			return fmt.Errorf("kafka rest proxy responded with %d - %s", resp.StatusCode, string(msg))
+		}
+	}
+	return nil
+}
+
+func (kp *kafkaRESTPublisher) Close() error {
+	return nil
+}
+
+//natsPublisher publishes to a NATS server using the core text protocol,
+//a batch is confirmed by a PING/PONG round trip after all PUBs
+type natsPublisher struct {
+	lock    sync.Mutex
+	address string
+	user    *url.Userinfo
+	conn    net.Conn
+	reader  *bufio.Reader
+	timeout time.Duration
+}
+
+func newNATSPublisher(address string) (*natsPublisher, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "4222")
+	}
+
+	return &natsPublisher{
+		address: host,
+		user:    u.User,
+		timeout: 10 * time.Second,
+	}, nil
+}
+
+func (np *natsPublisher) connect() error {
+	conn, err := net.DialTimeout("tcp", np.address, np.timeout)
+	if err != nil {
+		return err
+	}
+	np.conn = conn
+	np.reader = bufio.NewReader(conn)
+	conn.SetDeadline(time.Now().Add(np.timeout))
+
+	//the server greets with INFO
+	line, err := np.reader.ReadString('\n')
+	if err != nil {
+		np.close()
+		return err
+	}
+	if !strings.HasPrefix(line, "INFO") {
+		np.close()
+		return fmt.Errorf("unexpected greeting %s", strings.TrimSpace(line))
+	}
+
+	options := map[string]interface{}{
+		"verbose":  false,
+		"pedantic": false,
+		"name":     "request-monitor",
+		"lang":     "go",
+	}
+	if np.user != nil {
+		if pass, ok := np.user.Password(); ok {
+			options["user"] = np.user.Username()
+			options["pass"] = pass
+		} else {
+			options["auth_token"] = np.user.Username()
+		}
+	}
+
+	connect, _ := json.Marshal(options)
+	_, err = fmt.Fprintf(conn, "CONNECT %s\r\n", connect)
+	if err != nil {
+		np.close()
+		return err
+	}
+	return nil
+}
+
+func (np *natsPublisher) Publish(batch map[string][][]byte) error {
+	np.lock.Lock()
+	defer np.lock.Unlock()
+
+	if np.conn == nil {
+		err := np.connect()
+		if err != nil {
+			return err
+		}
+	}
+
+	err := np.publish(batch)
+	if err != nil {
+		//force a reconnect on the next attempt
+		np.close()
+	}
+	return err
+}
+
+func (np *natsPublisher) publish(batch map[string][][]byte) error {
+	np.conn.SetDeadline(time.Now().Add(np.timeout))
+
+	writer := bufio.NewWriter(np.conn)
+	for subject, records := range batch {
+		for _, record := range records {
+			fmt.Fprintf(writer, "PUB %s %d\r\n", subject, len(record))
+			writer.Write(record)
+			writer.WriteString("\r\n")
+		}
+	}
+	writer.WriteString("PING\r\n")
+	err := writer.Flush()
+	if err != nil {
+		return err
+	}
+
+	for {
+		line, err := np.reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "PONG":
+			return nil
+		case line == "PING":
+			io.WriteString(np.conn, "PONG\r\n")
+		case strings.HasPrefix(line, "-ERR"):
+			return errors.New(line)
+		}
+	}
+}
+
+func (np *natsPublisher) Close() error {
+	np.lock.Lock()
+	defer np.lock.Unlock()
+	return np.close()
+}
+
+func (np *natsPublisher) close() error {
+	if np.conn == nil {
+		return nil
+	}
+	err := np.conn.Close()
+	np.conn = nil
+	return err
+}
@@ -0,0 +1,182 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+package monitor
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//natsStandIn is a minimal NATS server that records all published messages
+type natsStandIn struct {
+	listener net.Listener
+	lock     sync.Mutex
+	messages map[string][]string
+}
+
+func newNATSStandIn(t *testing.T) *natsStandIn {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not prepare test %+v", err)
+	}
+
+	ns := &natsStandIn{listener: listener, messages: make(map[string][]string)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go ns.handle(conn)
+		}
+	}()
+	return ns
+}
+
+func (ns *natsStandIn) handle(conn net.Conn) {
+	defer conn.Close()
+	io.WriteString(conn, `INFO {"server_id":"stand-in"}`+"\r\n")
+
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 0:
+		case fields[0] == "PING":
+			io.WriteString(conn, "PONG\r\n")
+		case fields[0] == "PUB" && len(fields) == 3:
+			var size int
+			fmt.Sscanf(fields[2], "%d", &size)
+			payload := make([]byte, size+2)
+			io.ReadFull(reader, payload)
+
+			ns.lock.Lock()
+			ns.messages[fields[1]] = append(ns.messages[fields[1]], string(payload[:size]))
+			ns.lock.Unlock()
+		}
+	}
+}
+
+func (ns *natsStandIn) count(subject string) int {
+	ns.lock.Lock()
+	defer ns.lock.Unlock()
+	return len(ns.messages[subject])
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMessageBusReporterNATS(t *testing.T) {
+	nats := newNATSStandIn(t)
+	defer nats.listener.Close()
+
+	queue := make(chan busMessage, 10)
+	reporter, err := newMessageBusReporter(Configuration{
+		VDCName:                 "tub vdc",
+		MessageBusType:          "nats",
+		MessageBusURL:           "nats://" + nats.listener.Addr().String(),
+		MessageBusTopic:         "ditas.{vdc}.{kind}.{operation}",
+		MessageBusBatchSize:     2,
+		MessageBusFlushInterval: time.Hour,
+		MessageBusDelivery:      "at-least-once",
+		MessageBusRetries:       1,
+	}, queue)
+	if err != nil {
+		t.Fatalf("could not create reporter %+v", err)
+	}
+	reporter.Start()
+	defer reporter.Stop()
+
+	queue <- busMessage{Kind: "meter", OperationID: "getPatientBiographicalData", Payload: MeterMessage{RequestID: "1"}}
+	queue <- busMessage{Kind: "meter", Payload: MeterMessage{RequestID: "2"}}
+
+	waitFor(t, func() bool {
+		return nats.count("ditas.tub_vdc.meter.getPatientBiographicalData") == 1 && nats.count("ditas.tub_vdc.meter.unknown") == 1
+	})
+
+	var meter MeterMessage
+	json.Unmarshal([]byte(nats.messages["ditas.tub_vdc.meter.unknown"][0]), &meter)
+	if meter.RequestID != "2" {
+		t.Fatalf("unexpected payload %+v", meter)
+	}
+}
+
+func TestMessageBusReporterKafkaREST(t *testing.T) {
+	var lock sync.Mutex
+	records := make(map[string]int)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var body struct {
+			Records []struct {
+				Value MeterMessage `json:"value"`
+			} `json:"records"`
+		}
+		json.NewDecoder(req.Body).Decode(&body)
+
+		lock.Lock()
+		records[req.URL.Path] += len(body.Records)
+		lock.Unlock()
+	}))
+	defer proxy.Close()
+
+	queue := make(chan busMessage, 10)
+	reporter, err := newMessageBusReporter(Configuration{
+		VDCName:                 "tubvdc",
+		MessageBusType:          "kafka-rest",
+		MessageBusURL:           proxy.URL,
+		MessageBusTopic:         "ditas.{vdc}.{kind}",
+		MessageBusBatchSize:     100,
+		MessageBusFlushInterval: 10 * time.Millisecond,
+	}, queue)
+	if err != nil {
+		t.Fatalf("could not create reporter %+v", err)
+	}
+	reporter.Start()
+	defer reporter.Stop()
+
+	for i := 0; i < 3; i++ {
+		queue <- busMessage{Kind: "exchange", Payload: MeterMessage{RequestID: fmt.Sprint(i)}}
+	}
+
+	waitFor(t, func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return records["/topics/ditas.tubvdc.exchange"] == 3
+	})
+}
@@ -0,0 +1,82 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+package monitor
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+//metricRegistry is a minimal store for gauges and counters exposed on the admin endpoint
+//in the prometheus text format. Names may contain labels, e.g. `queue_size{queue="monitor"}`
+type metricRegistry struct {
+	lock   sync.Mutex
+	values map[string]float64
+}
+
+var metrics = &metricRegistry{values: make(map[string]float64)}
+
+//Set sets a gauge to the given value
+func (mr *metricRegistry) Set(name string, value float64) {
+	mr.lock.Lock()
+	mr.values[name] = value
+	mr.lock.Unlock()
+}
+
+//Add increments a counter by delta
+func (mr *metricRegistry) Add(name string, delta float64) {
+	mr.lock.Lock()
+	mr.values[name] += delta
+	mr.lock.Unlock()
+}
+
+//Get returns the current value of a metric
+func (mr *metricRegistry) Get(name string) float64 {
+	mr.lock.Lock()
+	defer mr.lock.Unlock()
+	return mr.values[name]
+}
+
+//WriteTo writes all metrics sorted by name
+func (mr *metricRegistry) WriteTo(w io.Writer) (int64, error) {
+	mr.lock.Lock()
+	names := make([]string, 0, len(mr.values))
+	for name := range mr.values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lines := make([]string, len(names))
+	for i, name := range names {
+		lines[i] = fmt.Sprintf("%s %g\n", name, mr.values[name])
+	}
+	mr.lock.Unlock()
+
+	var written int64
+	for _, line := range lines {
+		n, err := io.WriteString(w, line)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
@@ -0,0 +1,194 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+
+package monitor
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+//maxMirrorBody is the size up to which the mirrored and the primary response bodies are compared
+const maxMirrorBody = 1024 * 1024
+
+//trafficMirror sends copies of live requests to a secondary endpoint, e.g., a canary VDC,
+//and compares its responses with the primary ones. The mirrored responses are discarded.
+type trafficMirror struct {
+	target     *url.URL
+	operations []string
+	percentage float64
+	ignore     []string
+	client     *http.Client
+	inflight   chan struct{}
+	report     func(requestID string, meter MeterMessage)
+}
+
+//mirroredRequest is a request that is send to the mirror, the primary response is passed
+//once the client received it
+type mirroredRequest struct {
+	primary chan primaryResponse
+}
+
+type primaryResponse struct {
+	status   int
+	body     string
+	encoding string
+	complete bool
+}
+
+//newTrafficMirror creates a mirror to MirrorEndpoint, the results are passed to report
+func newTrafficMirror(conf Configuration, report func(requestID string, meter MeterMessage)) (*trafficMirror, error) {
+	target, err := url.Parse(conf.MirrorEndpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	transport, err := newSecondaryTransport(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	concurrent := conf.MirrorMaxConcurrent
+	if concurrent <= 0 {
+		concurrent = 1
+	}
+
+	return &trafficMirror{
+		target:     target,
+		operations: conf.MirrorOperations,
+		percentage: conf.MirrorPercentage,
+		ignore:     conf.MirrorIgnore,
+		client:     &http.Client{Transport: transport, Timeout: conf.MirrorTimeout},
+		inflight:   make(chan struct{}, concurrent),
+		report:     report,
+	}, nil
+}
+
+//Selects tells if a request of the operation is mirrored
+func (tm *trafficMirror) Selects(operationID string) bool {
+	if len(tm.operations) > 0 {
+		selected := false
+		for _, operation := range tm.operations {
+			if strings.EqualFold(operation, operationID) {
+				selected = true
+				break
+			}
+		}
+		if !selected {
+			return false
+		}
+	}
+
+	return tm.percentage >= 100 || rand.Float64()*100 < tm.percentage
+}
+
+//Send mirrors the request with the given body asynchronously, it returns nil if too many
+//mirrored requests are in flight, otherwise Complete must be called with the primary response
+func (tm *trafficMirror) Send(req *http.Request, body []byte, requestID string, meter MeterMessage) *mirroredRequest {
+	select {
+	case tm.inflight <- struct{}{}:
+	default:
+		metrics.Add("request_monitor_mirror_dropped_total", 1)
+		return nil
+	}
+
+	//the URL of the request already points to the Endpoint
+	uri, err := url.ParseRequestURI(req.RequestURI)
+	if err != nil {
+		<-tm.inflight
+		log.Debugf("could not mirror %s %s %+v", req.Method, req.RequestURI, err)
+		return nil
+	}
+	u := *tm.target
+	u.Path = strings.TrimSuffix(tm.target.Path, "/") + uri.Path
+	u.RawQuery = uri.RawQuery
+
+	mirror, err := http.NewRequest(req.Method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		<-tm.inflight
+		log.Debugf("could not mirror %s %s %+v", req.Method, req.RequestURI, err)
+		return nil
+	}
+	mirror.Header = cloneHeader(req.Header)
+	mirror.Header.Set("X-DITAS-Mirror", "true")
+
+	mr := &mirroredRequest{primary: make(chan primaryResponse, 1)}
+	go func() {
+		defer func() { <-tm.inflight }()
+		tm.send(mirror, mr, requestID, meter)
+	}()
+
+	return mr
+}
+
+//Complete passes the response the client received to the comparison
+func (mr *mirroredRequest) Complete(rec *responseRecorder) {
+	body, complete := rec.Body()
+	mr.primary <- primaryResponse{status: rec.StatusCode(), body: body, encoding: rec.Header().Get("Content-Encoding"), complete: complete}
+}
+
+func (tm *trafficMirror) send(req *http.Request, mr *mirroredRequest, requestID string, meter MeterMessage) {
+	metrics.Add("request_monitor_mirror_requests_total", 1)
+
+	start := time.Now()
+	resp, err := tm.client.Do(req)
+	if err != nil {
+		metrics.Add("request_monitor_mirror_failed_total", 1)
+		meter.RequestTime = time.Now().Sub(start)
+		meter.ResponseDiff = []string{fmt.Sprintf("mirror failed: %v", err)}
+		<-mr.primary
+		tm.report(requestID, meter)
+		return
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxMirrorBody+1))
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	meter.RequestTime = time.Now().Sub(start)
+	meter.ResponseCode = resp.StatusCode
+	meter.ResponseLength = int64(len(body))
+
+	primary := <-mr.primary
+	if err != nil || len(body) > maxMirrorBody || !primary.complete {
+		//bodies that are too large are not compared
+		primary.body = ""
+		body = nil
+	}
+
+	//compare the content, the upstreams may compress it differently
+	primary.body = decodedBody(primary.body, http.Header{"Content-Encoding": {primary.encoding}})
+	body = []byte(decodedBody(string(body), resp.Header))
+
+	meter.ResponseDiff = diffResponse(primary.status, primary.body, resp.StatusCode, string(body), tm.ignore)
+	if len(meter.ResponseDiff) > maxDiffs {
+		meter.ResponseDiff = append(meter.ResponseDiff[:maxDiffs], fmt.Sprintf("... %d more", len(meter.ResponseDiff)-maxDiffs))
+	}
+	if len(meter.ResponseDiff) > 0 {
+		metrics.Add("request_monitor_mirror_differing_total", 1)
+	}
+
+	tm.report(requestID, meter)
+}
@@ -0,0 +1,123 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+
+package monitor
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTrafficMirror(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"ssn":"42","name":"a","created":"now"}`))
+	}))
+	defer upstream.Close()
+
+	mirrored := make(chan *http.Request, 1)
+	canary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mirrored <- r
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte(`{"ssn":"42","name":"b","created":"later"}`))
+	}))
+	defer canary.Close()
+
+	conf := Configuration{
+		MirrorEndpoint:      canary.URL,
+		MirrorOperations:    []string{"getPatientBiographicalData"},
+		MirrorPercentage:    100,
+		MirrorTimeout:       time.Second,
+		MirrorMaxConcurrent: 1,
+		MirrorIgnore:        []string{"$.created"},
+	}
+	mon := newProxyStandIn(t, conf, upstream.URL)
+
+	meters := make(chan MeterMessage, 1)
+	mirror, err := newTrafficMirror(mon.conf, func(requestID string, meter MeterMessage) {
+		meter.RequestID = requestID
+		meters <- meter
+	})
+	if err != nil {
+		t.Fatalf("could not create mirror %+v", err)
+	}
+	mon.mirror = mirror
+
+	w := httptest.NewRecorder()
+	mon.serve(w, httptest.NewRequest("GET", "/patient/42?fields=name", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"name":"a"`) {
+		t.Fatalf("the client should get the primary response, got %d %s", w.Code, w.Body.String())
+	}
+
+	select {
+	case req := <-mirrored:
+		if req.URL.RequestURI() != "/patient/42?fields=name" || req.Header.Get("X-DITAS-Mirror") != "true" {
+			t.Fatalf("unexpected mirrored request %s %v", req.URL.RequestURI(), req.Header)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("request was not mirrored")
+	}
+
+	select {
+	case meter := <-meters:
+		if !meter.Mirrored || meter.ResponseCode != http.StatusAccepted || meter.OperationID != "getPatientBiographicalData" || meter.RequestID == "" {
+			t.Fatalf("unexpected mirror meter %+v", meter)
+		}
+		if len(meter.ResponseDiff) != 2 || meter.ResponseDiff[0] != "status 202, expected 200" || !strings.HasPrefix(meter.ResponseDiff[1], "$.name") {
+			t.Fatalf("unexpected differences %v", meter.ResponseDiff)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("mirrored response was not metered")
+	}
+
+	//other operations are not mirrored
+	mon.serve(httptest.NewRecorder(), httptest.NewRequest("GET", "/unknown", nil))
+	select {
+	case <-mirrored:
+		t.Fatal("only the selected operations should be mirrored")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestTrafficMirrorLimits(t *testing.T) {
+	mirror, err := newTrafficMirror(Configuration{MirrorEndpoint: "http://localhost:1", MirrorPercentage: 0, MirrorMaxConcurrent: 1}, nil)
+	if err != nil {
+		t.Fatalf("could not create mirror %+v", err)
+	}
+	if mirror.Selects("any") {
+		t.Fatal("no request should be mirrored at 0 percent")
+	}
+
+	mirror.percentage = 100
+	if !mirror.Selects("any") {
+		t.Fatal("all operations should be mirrored without MirrorOperations")
+	}
+
+	//the only slot is taken, so the request is not mirrored
+	mirror.inflight <- struct{}{}
+	before := metrics.Get("request_monitor_mirror_dropped_total")
+	if mr := mirror.Send(httptest.NewRequest("GET", "/patient/1", nil), nil, "1", MeterMessage{}); mr != nil {
+		t.Fatal("expected the request to be dropped")
+	}
+	if metrics.Get("request_monitor_mirror_dropped_total") != before+1 {
+		t.Fatal("expected the dropped request to be counted")
+	}
+}
@@ -26,16 +26,16 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"os/signal"
 	"path/filepath"
+	"strings"
+	"syscall"
 	"time"
 
-	opentracing "github.com/opentracing/opentracing-go"
-	zipkin "github.com/openzipkin/zipkin-go-opentracing"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/crypto/acme/autocert"
 
-	"github.com/kabukky/httpscerts"
-
 	"github.com/vulcand/oxy/forward"
 	"github.com/vulcand/oxy/utils"
 
@@ -56,17 +56,37 @@ func SetLog(entty *logrus.Entry) {
 
 //RequestMonitor data struct
 type RequestMonitor struct {
-	conf      Configuration
-	blueprint *spec.BlueprintType
-	oxy       *forward.Forwarder
+	conf         Configuration
+	blueprint    *spec.BlueprintType
+	rawBlueprint *rawBlueprint
+	oxy          *forward.Forwarder
+
+	monitorQueue   chan MeterMessage
+	exchangeQueue  chan exchangeMessage
+	accessLogQueue chan accessLogEntry
+	busQueue       chan busMessage
+	recordQueue    chan exchangeMessage
+	queues         map[string]*reporterQueue
+
+	reporter  elasticReporter
+	exporter  exchangeReporter
+	accessLog accessLogReporter
+	bus       messageBusReporter
+	recorder  trafficRecorder
+	mirror    *trafficMirror
+	canary    *canaryRouter
+	responses *responseCache
+	coalescer *requestCoalescer
+	compress  *responseCompressor
 
-	monitorQueue  chan MeterMessage
-	exchangeQueue chan exchangeMessage
+	cache ResouceCache
 
-	reporter elasticReporter
-	exporter exchangeReporter
+	certificates *certificateReloader
+	auth         *authGateway
 
-	cache ResouceCache
+	tracingCollector io.Closer
+	sampler          *sampler
+	otlpMetrics      *otlpMetrics
 }
 
 //NewManger Creates a new logging, tracing RequestMonitor
@@ -78,33 +98,73 @@ func NewManger() (*RequestMonitor, error) {
 		return nil, err
 	}
 
+	return newManager(configuration)
+}
+
+//newManager creates the RequestMonitor of a configuration
+func newManager(configuration Configuration) (*RequestMonitor, error) {
 	blueprint, err := spec.ReadBlueprint(filepath.Join(configuration.configDir, "blueprint.json"))
 
 	if err != nil {
 		log.Warn("could not read blueprint (monitoring quality will be degraded)")
 	}
 
+	raw, err := readRawBlueprint(filepath.Join(configuration.configDir, "blueprint.json"))
+	if err != nil {
+		log.Debugf("could not read blueprint extensions %+v", err)
+	}
+
 	mng := &RequestMonitor{
-		conf:          configuration,
-		blueprint:     blueprint,
-		monitorQueue:  make(chan MeterMessage, 10),
-		exchangeQueue: make(chan exchangeMessage, 10),
-		cache:         NewResoruceCache(blueprint),
+		conf:           configuration,
+		blueprint:      blueprint,
+		rawBlueprint:   raw,
+		monitorQueue:   make(chan MeterMessage, queueSize(configuration, "monitor")),
+		exchangeQueue:  make(chan exchangeMessage, queueSize(configuration, "exchange")),
+		accessLogQueue: make(chan accessLogEntry, queueSize(configuration, "accesslog")),
+		busQueue:       make(chan busMessage, queueSize(configuration, "bus")),
+		recordQueue:    make(chan exchangeMessage, queueSize(configuration, "record")),
+		queues:         make(map[string]*reporterQueue),
+		cache:          NewResoruceCache(blueprint),
 	}
 
+	for name, queue := range map[string]interface{}{
+		"monitor":   mng.monitorQueue,
+		"exchange":  mng.exchangeQueue,
+		"accesslog": mng.accessLogQueue,
+		"bus":       mng.busQueue,
+		"record":    mng.recordQueue,
+	} {
+		rq, err := newReporterQueue(configuration, name, queue)
+		if err != nil {
+			log.Errorf("failed to init %s queue %+v", name, err)
+			return nil, err
+		}
+		mng.queues[name] = rq
+	}
+
+	if configuration.OTLPMetrics {
+		mng.otlpMetrics = newOTLPMetrics(configuration)
+	}
+
+	auth, err := newAuthGateway(configuration, raw)
+	if err != nil {
+		log.Errorf("failed to init authentication %+v", err)
+		return nil, err
+	}
+	mng.auth = auth
+
 	err = mng.initTracing()
 	if err != nil {
 		log.Errorf("failed to init tracer %+v", err)
 	}
 
-	fwd, err := forward.New(
-		forward.Stream(true),
-		forward.PassHostHeader(true),
-		forward.ErrorHandler(utils.ErrorHandlerFunc(handleError)),
-		forward.StateListener(forward.UrlForwardingStateListener(stateListener)),
-		forward.ResponseModifier(mng.responseInterceptor),
-	)
+	transport, err := newUpstreamTransport(configuration)
+	if err != nil {
+		log.Errorf("failed to init upstream transport %+v", err)
+		return nil, err
+	}
 
+	fwd, err := mng.newForwarder(transport)
 	if err != nil {
 		log.Errorf("failed to init oxy %+v", err)
 		return nil, err
@@ -112,6 +172,15 @@ func NewManger() (*RequestMonitor, error) {
 
 	mng.oxy = fwd
 
+	if configuration.CanaryEndpoint != "" {
+		canary, err := newCanaryRouter(configuration, mng.newForwarder)
+		if err != nil {
+			log.Errorf("failed to init canary routing %+v", err)
+			return nil, err
+		}
+		mng.canary = canary
+	}
+
 	reporter, err := NewElasticReporter(configuration, mng.monitorQueue)
 	if err != nil {
 		log.Errorf("Failed to init elastic reporter %+v", err)
@@ -120,7 +189,7 @@ func NewManger() (*RequestMonitor, error) {
 	mng.reporter = reporter
 
 	if configuration.ForwardTraffic {
-		exporter, err := newExchangeReporter(configuration.ExchangeReporterURL, mng.exchangeQueue)
+		exporter, err := newExchangeReporter(configuration, mng.exchangeQueue)
 		if err != nil {
 			log.Errorf("Failed to init exchange reporter %+v", err)
 			return nil, err
@@ -128,11 +197,87 @@ func NewManger() (*RequestMonitor, error) {
 		mng.exporter = exporter
 	}
 
+	if configuration.AccessLogOutput != "" {
+		accessLog, err := newAccessLogReporter(configuration, mng.accessLogQueue)
+		if err != nil {
+			log.Errorf("Failed to init access log reporter %+v", err)
+			return nil, err
+		}
+		mng.accessLog = accessLog
+	}
+
+	if configuration.MessageBusType != "" {
+		bus, err := newMessageBusReporter(configuration, mng.busQueue)
+		if err != nil {
+			log.Errorf("Failed to init message bus reporter %+v", err)
+			return nil, err
+		}
+		mng.bus = bus
+	}
+
+	if len(configuration.CacheTTL) > 0 {
+		responses, err := newResponseCache(configuration)
+		if err != nil {
+			log.Errorf("Failed to init response cache %+v", err)
+			return nil, err
+		}
+		mng.responses = responses
+	}
+
+	if len(configuration.CoalesceOperations) > 0 {
+		mng.coalescer = newRequestCoalescer(configuration)
+	}
+
+	if configuration.CompressResponses {
+		mng.compress = newResponseCompressor(configuration)
+	}
+
+	if configuration.MirrorEndpoint != "" {
+		mirror, err := newTrafficMirror(configuration, mng.push)
+		if err != nil {
+			log.Errorf("Failed to init traffic mirror %+v", err)
+			return nil, err
+		}
+		mng.mirror = mirror
+	}
+
+	if configuration.RecordOutput != "" {
+		recorder, err := newTrafficRecorder(configuration, mng.recordQueue)
+		if err != nil {
+			log.Errorf("Failed to init traffic recorder %+v", err)
+			return nil, err
+		}
+		mng.recorder = recorder
+	}
+
 	log.Info("Request-Monitor created")
 
 	return mng, nil
 }
 
+//newForwarder creates the proxy to an upstream, its responses are observed by the responseInterceptor
+func (mon *RequestMonitor) newForwarder(transport http.RoundTripper) (*forward.Forwarder, error) {
+	return forward.New(
+		forward.RoundTripper(transport),
+		forward.Stream(true),
+		forward.PassHostHeader(true),
+		forward.ErrorHandler(utils.ErrorHandlerFunc(handleError)),
+		forward.StateListener(forward.UrlForwardingStateListener(stateListener)),
+		forward.ResponseModifier(mon.responseInterceptor),
+	)
+}
+
+//route selects the upstream that serves a request and the version its meters are tagged with
+func (mon *RequestMonitor) route(req *http.Request) (*url.URL, *forward.Forwarder, string) {
+	if mon.canary == nil {
+		return mon.conf.endpointURL, mon.oxy, mon.conf.EndpointVersion
+	}
+	if mon.canary.Selects(req) {
+		return mon.canary.target, mon.canary.oxy, mon.canary.version
+	}
+	return mon.conf.endpointURL, mon.oxy, mon.canary.primaryVersion
+}
+
 func stateListener(url *url.URL, state int) {
 	if url != nil {
 		log.Printf("url:%s - state:%d", url.String(), state)
@@ -152,6 +297,11 @@ func handleError(w http.ResponseWriter, req *http.Request, err error) {
 	}
 
 	log.Errorf("reqest:%s suffered internal error:%d - %v+", req.URL, statusCode, err)
+	spanError(req, err)
+
+	if rec, ok := req.Context().Value(recorderKey{}).(*responseRecorder); ok {
+		rec.failed = true
+	}
 
 	w.WriteHeader(statusCode)
 	w.Write([]byte(http.StatusText(statusCode)))
@@ -162,74 +312,89 @@ func (mon *RequestMonitor) generateRequestID(remoteAddr string) string {
 	return uuid.NewV5(uuid.NamespaceX500, fmt.Sprintf("%s-%d-%d", remoteAddr, now.Day(), now.Minute())).String()
 }
 
-func (mon *RequestMonitor) initTracing() error {
-	if mon.conf.Opentracing {
-		log.Info("opentracing active")
-		// Create our HTTP collector.
-		collector, err := zipkin.NewHTTPCollector(mon.conf.ZipkinEndpoint)
-		if err != nil {
-			log.Errorf("unable to create Zipkin HTTP collector: %+v\n", err)
-			return err
-		}
-
-		// Create our recorder.
-		recorder := zipkin.NewRecorder(collector, false, "0.0.0.0:0", "request-monitor")
-
-		// Create our tracer.
-		tracer, err := zipkin.NewTracer(
-			recorder,
-			zipkin.ClientServerSameSpan(true),
-			zipkin.TraceID128Bit(true),
-		)
-		if err != nil {
-			log.Errorf("unable to create Zipkin tracer: %+v\n", err)
-			return err
-		}
-
-		// Explicitly set our tracer to be the default tracer.
-		opentracing.InitGlobalTracer(tracer)
-	}
-	return nil
-}
-
 func (mon *RequestMonitor) push(requestID string, message MeterMessage) {
 	message.RequestID = requestID
 	message.Timestamp = time.Now()
-	mon.monitorQueue <- message
+	mon.queues["monitor"].Offer(message)
+
+	if mon.conf.MessageBusType != "" {
+		mon.queues["bus"].Offer(busMessage{Kind: "meter", OperationID: message.OperationID, Payload: message})
+	}
 }
 
 func (mon *RequestMonitor) forward(requestID string, message exchangeMessage) {
 	if mon.conf.ForwardTraffic {
 		message.RequestID = requestID
 		message.Timestamp = time.Now()
-		mon.exchangeQueue <- message
+		mon.queues["exchange"].Offer(message)
+
+		if mon.conf.MessageBusType != "" {
+			mon.queues["bus"].Offer(busMessage{Kind: "exchange", OperationID: message.OperationID, Payload: message})
+		}
 	}
 }
 
-//Listen will start all worker threads and wait for incoming requests
-func (mon *RequestMonitor) Listen() {
+func (mon *RequestMonitor) logAccess(requestID string, entry accessLogEntry) {
+	if mon.conf.AccessLogOutput != "" {
+		entry.RequestID = requestID
+		mon.queues["accesslog"].Offer(entry)
+	}
+}
 
-	//start parallel reporter threads
-	mon.reporter.Start()
+//recording tells if the exchanges of an operation are recorded
+func (mon *RequestMonitor) recording(operationID string) bool {
+	if mon.conf.RecordOutput == "" {
+		return false
+	}
+	if len(mon.conf.RecordOperations) == 0 {
+		return true
+	}
+	for _, operation := range mon.conf.RecordOperations {
+		if strings.EqualFold(operation, operationID) {
+			return true
+		}
+	}
+	return false
+}
 
-	if mon.conf.ForwardTraffic {
-		mon.exporter.Start()
-		defer mon.exporter.Stop()
+//recordedHeader copies a request header for the archive, the credentials are redacted unless RecordCredentials is set
+func (mon *RequestMonitor) recordedHeader(header http.Header) http.Header {
+	recorded := cloneHeader(header)
+	if !mon.conf.RecordCredentials {
+		redactCredentials(recorded, mon.conf.AuthAPIKeyHeader)
+	}
+	return recorded
+}
+
+//redactCredentials replaces the values of the credential headers and the api key header
+func redactCredentials(header http.Header, apiKeyHeader string) {
+	for _, name := range append(credentialHeaders, apiKeyHeader) {
+		if _, ok := header[http.CanonicalHeaderKey(name)]; ok && name != "" {
+			header.Set(name, redactedValue)
+		}
 	}
+}
+
+func (mon *RequestMonitor) record(requestID string, message exchangeMessage) {
+	message.RequestID = requestID
+	mon.queues["record"].Offer(message)
+}
+
+//shutdownTimeout limits the time open requests and queued records get on shutdown
+const shutdownTimeout = 30 * time.Second
 
-	defer mon.reporter.Stop()
+//Listen will start all worker threads and wait for incoming requests until the process is terminated
+func (mon *RequestMonitor) Listen() {
+
+	stop := mon.start()
+	servers := make([]*http.Server, 0)
 
 	var m *autocert.Manager
 	if mon.conf.UseACME {
-
-		m = &autocert.Manager{
-			Email:  "werner@tu-berlin.de",
-			Prompt: autocert.AcceptTOS,
-			HostPolicy: func(ctx context.Context, host string) error {
-				//TODO: add sensible host model
-				return nil
-			},
-			Cache: autocert.DirCache(".certs"),
+		var err error
+		m, err = mon.newACMEManager()
+		if err != nil {
+			log.Fatalf("could not create ACME manager %+v", err)
 		}
 
 		httpsServer := &http.Server{
@@ -237,11 +402,12 @@ func (mon *RequestMonitor) Listen() {
 			Handler:   http.HandlerFunc(mon.serve),
 			TLSConfig: &tls.Config{GetCertificate: m.GetCertificate},
 		}
+		servers = append(servers, httpsServer)
 
 		go func() {
 
 			err := httpsServer.ListenAndServeTLS("", "")
-			if err != nil {
+			if err != nil && err != http.ErrServerClosed {
 				log.Fatalf("httpsSrv.ListendAndServeTLS() failed with %s", err)
 			}
 		}()
@@ -249,22 +415,38 @@ func (mon *RequestMonitor) Listen() {
 		cert := filepath.Join(mon.conf.configDir, "cert.pem")
 		key := filepath.Join(mon.conf.configDir, "key.pem")
 
-		err := httpscerts.Check(cert, key)
+		_, err := tls.LoadX509KeyPair(cert, key)
 		if err != nil {
 			log.Info("could not load self signed keys - generationg some")
-			err = httpscerts.Generate(cert, key, "127.0.0.1:443")
+			opts, err := selfSignedOptions(mon.conf)
 			if err != nil {
-				log.Fatal("Error: Couldn't create https certs.")
+				log.Fatalf("invalid certificate options %+v", err)
+			}
+			err = generateCertificate(cert, key, opts)
+			if err != nil {
+				log.Fatalf("Error: Couldn't create https certs. %+v", err)
 			}
 		}
+
+		reloader, err := newCertificateReloader(cert, key, mon.conf.CertExpiryWarning)
+		if err != nil {
+			log.Fatalf("could not load certificate %+v", err)
+		}
+		mon.certificates = reloader
+		quit := make(chan bool)
+		defer close(quit)
+		reloader.Watch(mon.conf.CertReloadInterval, quit)
+
 		httpsServer := &http.Server{
-			Addr:    ":443",
-			Handler: http.HandlerFunc(mon.serve),
+			Addr:      ":443",
+			Handler:   http.HandlerFunc(mon.serve),
+			TLSConfig: &tls.Config{GetCertificate: reloader.GetCertificate},
 		}
+		servers = append(servers, httpsServer)
 		go func() {
 
-			err := httpsServer.ListenAndServeTLS(cert, key)
-			if err != nil {
+			err := httpsServer.ListenAndServeTLS("", "")
+			if err != nil && err != http.ErrServerClosed {
 				log.Fatalf("httpsSrv.ListendAndServeTLS() failed with %s", err)
 			}
 		}()
@@ -280,7 +462,110 @@ func (mon *RequestMonitor) Listen() {
 		httpServer.Handler = http.HandlerFunc(mon.serve)
 	}
 
+	servers = append(servers, httpServer)
+
+	mon.startAdmin()
+
+	go func() {
+		err := httpServer.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatalf("httpSrv.ListenAndServe() failed with %s", err)
+		}
+	}()
 	log.Info("request-monitor ready")
-	httpServer.ListenAndServe()
 
+	//shut down cleanly on SIGINT or SIGTERM, so that the reporters deliver their last records
+	//and archives like HAR recordings are completed
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+	log.Infof("received %s, shutting down", sig)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	for _, server := range servers {
+		err := server.Shutdown(ctx)
+		if err != nil {
+			log.Warnf("could not shut down %s gracefully %+v", server.Addr, err)
+		}
+	}
+
+	mon.drain(stop, shutdownTimeout)
+	log.Info("request-monitor stopped")
+}
+
+//start starts all reporter threads and returns a function that stops them again
+func (mon *RequestMonitor) start() func() {
+	stops := make([]func(), 0)
+
+	//start parallel reporter threads
+	mon.reporter.Start()
+
+	for _, queue := range mon.queues {
+		queue.Start()
+		stops = append(stops, queue.Stop)
+	}
+
+	if mon.conf.ForwardTraffic {
+		mon.exporter.Start()
+		stops = append(stops, mon.exporter.Stop)
+	}
+
+	stops = append(stops, mon.reporter.Stop)
+
+	if mon.conf.AccessLogOutput != "" {
+		mon.accessLog.Start()
+		stops = append(stops, mon.accessLog.Stop)
+	}
+
+	if mon.conf.MessageBusType != "" {
+		mon.bus.Start()
+		stops = append(stops, mon.bus.Stop)
+	}
+
+	if mon.responses != nil {
+		mon.responses.Start(time.Minute)
+		stops = append(stops, mon.responses.Stop)
+	}
+
+	if mon.conf.RecordOutput != "" {
+		mon.recorder.Start()
+		stops = append(stops, mon.recorder.Stop)
+	}
+
+	if mon.tracingCollector != nil {
+		stops = append(stops, func() { mon.tracingCollector.Close() })
+	}
+
+	if mon.otlpMetrics != nil {
+		mon.otlpMetrics.Start()
+		stops = append(stops, mon.otlpMetrics.Stop)
+	}
+
+	return func() {
+		for i := len(stops) - 1; i >= 0; i-- {
+			stops[i]()
+		}
+	}
+}
+
+//drain waits until all queued records are taken by the reporters, stops them
+//and waits until the workers have delivered their last batches
+func (mon *RequestMonitor) drain(stop func(), timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		queued := len(mon.monitorQueue) + len(mon.exchangeQueue) + len(mon.accessLogQueue) + len(mon.busQueue) + len(mon.recordQueue)
+		if queued == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	stop()
+
+	for _, pool := range []*workerPool{mon.reporter.pool, mon.exporter.pool, mon.accessLog.pool, mon.bus.pool, mon.recorder.pool} {
+		if pool != nil {
+			pool.Wait(time.Until(deadline))
+		}
+	}
 }
@@ -0,0 +1,314 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+package monitor
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//otlpExporter batches finished spans and sends them to an OTLP/HTTP collector
+//using the JSON encoding
+type otlpExporter struct {
+	endpoint string
+	headers  map[string]string
+	resource otlpResource
+	client   *http.Client
+
+	queue    chan *otlpSpan
+	interval time.Duration
+	quit     chan bool
+	done     sync.WaitGroup
+}
+
+const otlpBatchSize = 512
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpJSONSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue  `json:"attributes,omitempty"`
+	Events            []otlpJSONEvent `json:"events,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpJSONEvent struct {
+	TimeUnixNano string         `json:"timeUnixNano"`
+	Name         string         `json:"name"`
+	Attributes   []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpTraceRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope      `json:"scope"`
+	Spans []otlpJSONSpan `json:"spans"`
+}
+
+func newOTLPResource(conf Configuration) otlpResource {
+	return otlpResource{
+		Attributes: []otlpKeyValue{
+			otlpAttribute("service.name", "request-monitor"),
+			otlpAttribute("service.namespace", conf.VDCName),
+		},
+	}
+}
+
+func newOTLPExporter(conf Configuration) *otlpExporter {
+	interval := conf.OTLPExportInterval
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+
+	return &otlpExporter{
+		endpoint: strings.TrimSuffix(conf.OTLPEndpoint, "/") + "/v1/traces",
+		headers:  conf.OTLPHeaders,
+		resource: newOTLPResource(conf),
+		client:   &http.Client{Timeout: 10 * time.Second},
+		queue:    make(chan *otlpSpan, 4*otlpBatchSize),
+		interval: interval,
+		quit:     make(chan bool),
+	}
+}
+
+//Add queues a finished span, spans are dropped if the queue is full
+func (oe *otlpExporter) Add(span *otlpSpan) {
+	select {
+	case oe.queue <- span:
+	default:
+		metrics.Add("request_monitor_spans_dropped_total", 1)
+	}
+}
+
+//Start sends batches of spans until Close is called
+func (oe *otlpExporter) Start() {
+	oe.done.Add(1)
+	go func() {
+		defer oe.done.Done()
+
+		ticker := time.NewTicker(oe.interval)
+		defer ticker.Stop()
+
+		batch := make([]*otlpSpan, 0, otlpBatchSize)
+		for {
+			select {
+			case span := <-oe.queue:
+				batch = append(batch, span)
+				if len(batch) >= otlpBatchSize {
+					oe.send(batch)
+					batch = batch[:0]
+				}
+			case <-ticker.C:
+				if len(batch) > 0 {
+					oe.send(batch)
+					batch = batch[:0]
+				}
+			case <-oe.quit:
+				for len(oe.queue) > 0 {
+					batch = append(batch, <-oe.queue)
+				}
+				if len(batch) > 0 {
+					oe.send(batch)
+				}
+				return
+			}
+		}
+	}()
+}
+
+//Close flushes all queued spans and stops the exporter
+func (oe *otlpExporter) Close() error {
+	close(oe.quit)
+	oe.done.Wait()
+	return nil
+}
+
+func (oe *otlpExporter) send(batch []*otlpSpan) {
+	spans := make([]otlpJSONSpan, len(batch))
+	for i, span := range batch {
+		spans[i] = span.toJSON()
+	}
+
+	request := otlpTraceRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: oe.resource,
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: "request-monitor"},
+				Spans: spans,
+			}},
+		}},
+	}
+
+	err := postOTLP(oe.client, oe.endpoint, oe.headers, request)
+	if err != nil {
+		log.Warnf("failed to export %d spans %+v", len(batch), err)
+		metrics.Add("request_monitor_spans_dropped_total", float64(len(batch)))
+		return
+	}
+	metrics.Add("request_monitor_spans_exported_total", float64(len(batch)))
+}
+
+//postOTLP sends a JSON encoded OTLP request to the collector
+func postOTLP(client *http.Client, endpoint string, headers map[string]string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("collector responded with %d - %s", resp.StatusCode, string(msg))
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	return nil
+}
+
+func (s *otlpSpan) toJSON() otlpJSONSpan {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	span := otlpJSONSpan{
+		TraceID:           hex.EncodeToString(s.context.traceID[:]),
+		SpanID:            hex.EncodeToString(s.context.spanID[:]),
+		Name:              s.name,
+		Kind:              s.kind(),
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		Attributes:        make([]otlpKeyValue, 0, len(s.tags)),
+	}
+
+	if s.parentID != [8]byte{} {
+		span.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+
+	for k, v := range s.tags {
+		if k == "span.kind" {
+			continue
+		}
+		span.Attributes = append(span.Attributes, otlpAttribute(k, v))
+	}
+
+	if isError, _ := s.tags["error"].(bool); isError {
+		span.Status.Code = 2
+	}
+
+	for _, event := range s.events {
+		jsonEvent := otlpJSONEvent{
+			TimeUnixNano: strconv.FormatInt(event.time.UnixNano(), 10),
+			Name:         "log",
+		}
+		for _, field := range event.fields {
+			if field.Key() == "event" {
+				jsonEvent.Name = fmt.Sprint(field.Value())
+				continue
+			}
+			if field.Key() == "error" && span.Status.Message == "" {
+				span.Status.Message = fmt.Sprint(field.Value())
+			}
+			jsonEvent.Attributes = append(jsonEvent.Attributes, otlpAttribute(field.Key(), field.Value()))
+		}
+		span.Events = append(span.Events, jsonEvent)
+	}
+
+	return span
+}
+
+//otlpAttribute converts a tag or log field into an OTLP attribute
+func otlpAttribute(key string, value interface{}) otlpKeyValue {
+	attr := otlpKeyValue{Key: key}
+	switch v := value.(type) {
+	case bool:
+		attr.Value.BoolValue = &v
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		str := fmt.Sprint(v)
+		attr.Value.IntValue = &str
+	case float32:
+		f := float64(v)
+		attr.Value.DoubleValue = &f
+	case float64:
+		attr.Value.DoubleValue = &v
+	case error:
+		str := v.Error()
+		attr.Value.StringValue = &str
+	default:
+		str := fmt.Sprint(v)
+		attr.Value.StringValue = &str
+	}
+	return attr
+}
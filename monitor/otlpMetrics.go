@@ -0,0 +1,255 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+package monitor
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//otlpMetrics aggregates the meters of all requests and exports them
+//as delta sums and histograms to an OTLP/HTTP collector
+type otlpMetrics struct {
+	endpoint string
+	headers  map[string]string
+	resource otlpResource
+	client   *http.Client
+	interval time.Duration
+
+	lock      sync.Mutex
+	start     time.Time
+	requests  map[otlpMetricKey]int64
+	durations map[otlpMetricKey]*otlpHistogram
+
+	quit chan bool
+	done sync.WaitGroup
+}
+
+type otlpMetricKey struct {
+	operationID string
+	statusCode  int
+}
+
+type otlpHistogram struct {
+	count   int64
+	sum     float64
+	buckets []int64
+}
+
+//request duration bounds in milliseconds
+var otlpDurationBounds = []float64{5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+
+type otlpMetricsRequest struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope    `json:"scope"`
+	Metrics []otlpMetric `json:"metrics"`
+}
+
+type otlpMetric struct {
+	Name      string             `json:"name"`
+	Unit      string             `json:"unit"`
+	Sum       *otlpSum           `json:"sum,omitempty"`
+	Histogram *otlpHistogramData `json:"histogram,omitempty"`
+}
+
+type otlpSum struct {
+	AggregationTemporality int                   `json:"aggregationTemporality"`
+	IsMonotonic            bool                  `json:"isMonotonic"`
+	DataPoints             []otlpNumberDataPoint `json:"dataPoints"`
+}
+
+type otlpNumberDataPoint struct {
+	Attributes        []otlpKeyValue `json:"attributes"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	TimeUnixNano      string         `json:"timeUnixNano"`
+	AsInt             string         `json:"asInt"`
+}
+
+type otlpHistogramData struct {
+	AggregationTemporality int                      `json:"aggregationTemporality"`
+	DataPoints             []otlpHistogramDataPoint `json:"dataPoints"`
+}
+
+type otlpHistogramDataPoint struct {
+	Attributes        []otlpKeyValue `json:"attributes"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	TimeUnixNano      string         `json:"timeUnixNano"`
+	Count             string         `json:"count"`
+	Sum               float64        `json:"sum"`
+	BucketCounts      []string       `json:"bucketCounts"`
+	ExplicitBounds    []float64      `json:"explicitBounds"`
+}
+
+//delta aggregation temporality
+const otlpDelta = 1
+
+func newOTLPMetrics(conf Configuration) *otlpMetrics {
+	interval := conf.OTLPExportInterval
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+
+	return &otlpMetrics{
+		endpoint:  strings.TrimSuffix(conf.OTLPEndpoint, "/") + "/v1/metrics",
+		headers:   conf.OTLPHeaders,
+		resource:  newOTLPResource(conf),
+		client:    &http.Client{Timeout: 10 * time.Second},
+		interval:  interval,
+		start:     time.Now(),
+		requests:  make(map[otlpMetricKey]int64),
+		durations: make(map[otlpMetricKey]*otlpHistogram),
+		quit:      make(chan bool),
+	}
+}
+
+//Record adds a completed request to the current aggregation
+func (om *otlpMetrics) Record(operationID string, statusCode int, duration time.Duration) {
+	key := otlpMetricKey{operationID: operationID, statusCode: statusCode}
+	ms := float64(duration) / float64(time.Millisecond)
+
+	om.lock.Lock()
+	defer om.lock.Unlock()
+
+	om.requests[key]++
+
+	histogram, ok := om.durations[key]
+	if !ok {
+		histogram = &otlpHistogram{buckets: make([]int64, len(otlpDurationBounds)+1)}
+		om.durations[key] = histogram
+	}
+	histogram.count++
+	histogram.sum += ms
+
+	bucket := len(otlpDurationBounds)
+	for i, bound := range otlpDurationBounds {
+		if ms <= bound {
+			bucket = i
+			break
+		}
+	}
+	histogram.buckets[bucket]++
+}
+
+//Start exports the aggregated metrics every interval until Stop is called
+func (om *otlpMetrics) Start() {
+	om.done.Add(1)
+	go func() {
+		defer om.done.Done()
+
+		ticker := time.NewTicker(om.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				om.export()
+			case <-om.quit:
+				om.export()
+				return
+			}
+		}
+	}()
+}
+
+//Stop exports the remaining metrics and terminates the exporter
+func (om *otlpMetrics) Stop() {
+	close(om.quit)
+	om.done.Wait()
+}
+
+func (om *otlpMetrics) export() {
+	om.lock.Lock()
+	start := om.start
+	now := time.Now()
+	requests := om.requests
+	durations := om.durations
+	om.start = now
+	om.requests = make(map[otlpMetricKey]int64)
+	om.durations = make(map[otlpMetricKey]*otlpHistogram)
+	om.lock.Unlock()
+
+	if len(requests) == 0 {
+		return
+	}
+
+	startNano := strconv.FormatInt(start.UnixNano(), 10)
+	nowNano := strconv.FormatInt(now.UnixNano(), 10)
+
+	sum := &otlpSum{AggregationTemporality: otlpDelta, IsMonotonic: true}
+	for key, count := range requests {
+		sum.DataPoints = append(sum.DataPoints, otlpNumberDataPoint{
+			Attributes:        key.attributes(),
+			StartTimeUnixNano: startNano,
+			TimeUnixNano:      nowNano,
+			AsInt:             strconv.FormatInt(count, 10),
+		})
+	}
+
+	histogram := &otlpHistogramData{AggregationTemporality: otlpDelta}
+	for key, h := range durations {
+		buckets := make([]string, len(h.buckets))
+		for i, b := range h.buckets {
+			buckets[i] = strconv.FormatInt(b, 10)
+		}
+		histogram.DataPoints = append(histogram.DataPoints, otlpHistogramDataPoint{
+			Attributes:        key.attributes(),
+			StartTimeUnixNano: startNano,
+			TimeUnixNano:      nowNano,
+			Count:             strconv.FormatInt(h.count, 10),
+			Sum:               h.sum,
+			BucketCounts:      buckets,
+			ExplicitBounds:    otlpDurationBounds,
+		})
+	}
+
+	request := otlpMetricsRequest{
+		ResourceMetrics: []otlpResourceMetrics{{
+			Resource: om.resource,
+			ScopeMetrics: []otlpScopeMetrics{{
+				Scope: otlpScope{Name: "request-monitor"},
+				Metrics: []otlpMetric{
+					{Name: "vdc.requests", Unit: "1", Sum: sum},
+					{Name: "vdc.request.duration", Unit: "ms", Histogram: histogram},
+				},
+			}},
+		}},
+	}
+
+	err := postOTLP(om.client, om.endpoint, om.headers, request)
+	if err != nil {
+		log.Warnf("failed to export metrics %+v", err)
+	}
+}
+
+func (key otlpMetricKey) attributes() []otlpKeyValue {
+	return []otlpKeyValue{
+		otlpAttribute("ditas.operationID", key.operationID),
+		otlpAttribute("http.status_code", key.statusCode),
+	}
+}
@@ -0,0 +1,377 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+package monitor
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	otlog "github.com/opentracing/opentracing-go/log"
+)
+
+//otlpTracer is an opentracing.Tracer that exports spans using OTLP/HTTP
+//and propagates the context using W3C trace context and/or B3 headers
+type otlpTracer struct {
+	exporter    *otlpExporter
+	sampler     *sampler
+	propagation []string
+}
+
+type otlpSpanContext struct {
+	traceID [16]byte
+	spanID  [8]byte
+	sampled bool
+	baggage map[string]string
+}
+
+func (c otlpSpanContext) ForeachBaggageItem(handler func(k, v string) bool) {
+	for k, v := range c.baggage {
+		if !handler(k, v) {
+			return
+		}
+	}
+}
+
+type otlpEvent struct {
+	time   time.Time
+	fields []otlog.Field
+}
+
+type otlpSpan struct {
+	tracer *otlpTracer
+
+	lock     sync.Mutex
+	context  otlpSpanContext
+	parentID [8]byte
+	name     string
+	start    time.Time
+	end      time.Time
+	tags     map[string]interface{}
+	events   []otlpEvent
+}
+
+func newOTLPTracer(exporter *otlpExporter, sampler *sampler, propagation []string) *otlpTracer {
+	if len(propagation) == 0 {
+		propagation = []string{"w3c", "b3"}
+	}
+	return &otlpTracer{
+		exporter:    exporter,
+		sampler:     sampler,
+		propagation: propagation,
+	}
+}
+
+//Close flushes all pending spans
+func (t *otlpTracer) Close() error {
+	return t.exporter.Close()
+}
+
+func (t *otlpTracer) StartSpan(operationName string, opts ...opentracing.StartSpanOption) opentracing.Span {
+	options := opentracing.StartSpanOptions{}
+	for _, opt := range opts {
+		opt.Apply(&options)
+	}
+
+	span := &otlpSpan{
+		tracer: t,
+		name:   operationName,
+		start:  options.StartTime,
+		tags:   make(map[string]interface{}),
+	}
+	if span.start.IsZero() {
+		span.start = time.Now()
+	}
+	for k, v := range options.Tags {
+		span.tags[k] = v
+	}
+
+	var parent *otlpSpanContext
+	for _, ref := range options.References {
+		if ctx, ok := ref.ReferencedContext.(otlpSpanContext); ok {
+			parent = &ctx
+			break
+		}
+	}
+
+	rand.Read(span.context.spanID[:])
+	if parent != nil {
+		span.context.traceID = parent.traceID
+		span.context.sampled = parent.sampled
+		span.parentID = parent.spanID
+		span.context.baggage = copyBaggage(parent.baggage)
+	} else {
+		rand.Read(span.context.traceID[:])
+		operationID, _ := options.Tags["ditas.operationID"].(string)
+		span.context.sampled = t.sampler.Sample(binary.BigEndian.Uint64(span.context.traceID[8:]), operationID)
+	}
+
+	if priority, ok := options.Tags[string(ext.SamplingPriority)].(uint16); ok {
+		span.context.sampled = priority > 0
+	}
+
+	return span
+}
+
+func copyBaggage(baggage map[string]string) map[string]string {
+	if baggage == nil {
+		return nil
+	}
+	c := make(map[string]string, len(baggage))
+	for k, v := range baggage {
+		c[k] = v
+	}
+	return c
+}
+
+func (t *otlpTracer) Inject(sm opentracing.SpanContext, format interface{}, carrier interface{}) error {
+	ctx, ok := sm.(otlpSpanContext)
+	if !ok {
+		return opentracing.ErrInvalidSpanContext
+	}
+	if format != opentracing.HTTPHeaders && format != opentracing.TextMap {
+		return opentracing.ErrUnsupportedFormat
+	}
+	writer, ok := carrier.(opentracing.TextMapWriter)
+	if !ok {
+		return opentracing.ErrInvalidCarrier
+	}
+
+	traceID := hex.EncodeToString(ctx.traceID[:])
+	spanID := hex.EncodeToString(ctx.spanID[:])
+	for _, propagation := range t.propagation {
+		switch strings.ToLower(propagation) {
+		case "w3c":
+			flags := "00"
+			if ctx.sampled {
+				flags = "01"
+			}
+			writer.Set("traceparent", fmt.Sprintf("00-%s-%s-%s", traceID, spanID, flags))
+		case "b3":
+			sampled := "0"
+			if ctx.sampled {
+				sampled = "1"
+			}
+			writer.Set("X-B3-TraceId", traceID)
+			writer.Set("X-B3-SpanId", spanID)
+			writer.Set("X-B3-Sampled", sampled)
+		}
+	}
+	return nil
+}
+
+func (t *otlpTracer) Extract(format interface{}, carrier interface{}) (opentracing.SpanContext, error) {
+	if format != opentracing.HTTPHeaders && format != opentracing.TextMap {
+		return nil, opentracing.ErrUnsupportedFormat
+	}
+	reader, ok := carrier.(opentracing.TextMapReader)
+	if !ok {
+		return nil, opentracing.ErrInvalidCarrier
+	}
+
+	headers := make(map[string]string)
+	reader.ForeachKey(func(key, val string) error {
+		headers[strings.ToLower(key)] = val
+		return nil
+	})
+
+	for _, propagation := range t.propagation {
+		switch strings.ToLower(propagation) {
+		case "w3c":
+			if ctx, ok := parseTraceParent(headers["traceparent"]); ok {
+				return ctx, nil
+			}
+		case "b3":
+			if ctx, ok := parseB3(headers); ok {
+				return ctx, nil
+			}
+		}
+	}
+	return nil, opentracing.ErrSpanContextNotFound
+}
+
+//parseTraceParent parses a W3C traceparent header: version-traceid-spanid-flags
+func parseTraceParent(value string) (otlpSpanContext, bool) {
+	ctx := otlpSpanContext{}
+	parts := strings.Split(value, "-")
+	if len(parts) < 4 || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return ctx, false
+	}
+
+	if !decodeID(ctx.traceID[:], parts[1]) || !decodeID(ctx.spanID[:], parts[2]) {
+		return ctx, false
+	}
+
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return ctx, false
+	}
+	ctx.sampled = flags[0]&0x01 == 0x01
+	return ctx, true
+}
+
+//parseB3 parses the multi header B3 format, 64bit trace ids are padded
+func parseB3(headers map[string]string) (otlpSpanContext, bool) {
+	ctx := otlpSpanContext{sampled: true}
+
+	traceID := headers["x-b3-traceid"]
+	if len(traceID) == 16 {
+		traceID = strings.Repeat("0", 16) + traceID
+	}
+	if len(traceID) != 32 || len(headers["x-b3-spanid"]) != 16 {
+		return ctx, false
+	}
+
+	if !decodeID(ctx.traceID[:], traceID) || !decodeID(ctx.spanID[:], headers["x-b3-spanid"]) {
+		return ctx, false
+	}
+
+	if sampled, ok := headers["x-b3-sampled"]; ok {
+		ctx.sampled = sampled == "1" || sampled == "true"
+	}
+	if headers["x-b3-flags"] == "1" {
+		ctx.sampled = true
+	}
+	return ctx, true
+}
+
+func decodeID(dst []byte, value string) bool {
+	data, err := hex.DecodeString(value)
+	if err != nil || len(data) != len(dst) {
+		return false
+	}
+	copy(dst, data)
+
+	//all zero ids are invalid
+	for _, b := range data {
+		if b != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *otlpSpan) Finish() {
+	s.FinishWithOptions(opentracing.FinishOptions{})
+}
+
+func (s *otlpSpan) FinishWithOptions(opts opentracing.FinishOptions) {
+	s.lock.Lock()
+	s.end = opts.FinishTime
+	if s.end.IsZero() {
+		s.end = time.Now()
+	}
+	for _, record := range opts.LogRecords {
+		s.events = append(s.events, otlpEvent{time: record.Timestamp, fields: record.Fields})
+	}
+	s.lock.Unlock()
+
+	if s.context.sampled {
+		s.tracer.exporter.Add(s)
+	}
+}
+
+func (s *otlpSpan) Context() opentracing.SpanContext {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.context
+}
+
+func (s *otlpSpan) SetOperationName(operationName string) opentracing.Span {
+	s.lock.Lock()
+	s.name = operationName
+	s.lock.Unlock()
+	return s
+}
+
+func (s *otlpSpan) SetTag(key string, value interface{}) opentracing.Span {
+	s.lock.Lock()
+	if priority, ok := value.(uint16); ok && key == string(ext.SamplingPriority) {
+		s.context.sampled = priority > 0
+	}
+	s.tags[key] = value
+	s.lock.Unlock()
+	return s
+}
+
+func (s *otlpSpan) LogFields(fields ...otlog.Field) {
+	s.lock.Lock()
+	s.events = append(s.events, otlpEvent{time: time.Now(), fields: fields})
+	s.lock.Unlock()
+}
+
+func (s *otlpSpan) LogKV(alternatingKeyValues ...interface{}) {
+	fields, err := otlog.InterleavedKVToFields(alternatingKeyValues...)
+	if err != nil {
+		s.LogFields(otlog.Error(err))
+		return
+	}
+	s.LogFields(fields...)
+}
+
+func (s *otlpSpan) SetBaggageItem(restrictedKey, value string) opentracing.Span {
+	s.lock.Lock()
+	baggage := copyBaggage(s.context.baggage)
+	if baggage == nil {
+		baggage = make(map[string]string)
+	}
+	baggage[restrictedKey] = value
+	s.context.baggage = baggage
+	s.lock.Unlock()
+	return s
+}
+
+func (s *otlpSpan) BaggageItem(restrictedKey string) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.context.baggage[restrictedKey]
+}
+
+func (s *otlpSpan) Tracer() opentracing.Tracer {
+	return s.tracer
+}
+
+func (s *otlpSpan) LogEvent(event string) {
+	s.LogFields(otlog.String("event", event))
+}
+
+func (s *otlpSpan) LogEventWithPayload(event string, payload interface{}) {
+	s.LogFields(otlog.String("event", event), otlog.Object("payload", payload))
+}
+
+func (s *otlpSpan) Log(data opentracing.LogData) {
+	s.LogFields(data.ToLogRecord().Fields...)
+}
+
+//kind maps the opentracing span.kind tag to the OTLP span kind
+func (s *otlpSpan) kind() int {
+	switch s.tags[string(ext.SpanKind)] {
+	case ext.SpanKindRPCServerEnum, "server":
+		return 2
+	case ext.SpanKindRPCClientEnum, "client":
+		return 3
+	}
+	return 1
+}
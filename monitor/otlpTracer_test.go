@@ -0,0 +1,149 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+package monitor
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	opentracing "github.com/opentracing/opentracing-go"
+)
+
+//collectorStandIn records all OTLP requests it receives
+type collectorStandIn struct {
+	lock     sync.Mutex
+	requests map[string][][]byte
+}
+
+func (c *collectorStandIn) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var body json.RawMessage
+	json.NewDecoder(req.Body).Decode(&body)
+
+	c.lock.Lock()
+	c.requests[req.URL.Path] = append(c.requests[req.URL.Path], body)
+	c.lock.Unlock()
+}
+
+func TestOTLPTracer(t *testing.T) {
+	collector := &collectorStandIn{requests: make(map[string][][]byte)}
+	server := httptest.NewServer(collector)
+	defer server.Close()
+
+	conf := Configuration{
+		VDCName:            "tubvdc",
+		OTLPEndpoint:       server.URL,
+		OTLPExportInterval: time.Hour,
+		TracingSampleRatio: 1,
+		TracingPropagation: []string{"w3c", "b3"},
+	}
+
+	exporter := newOTLPExporter(conf)
+	exporter.Start()
+	tracer := newOTLPTracer(exporter, newSampler(conf, nil), conf.TracingPropagation)
+	opentracing.SetGlobalTracer(tracer)
+	defer opentracing.SetGlobalTracer(opentracing.NoopTracer{})
+
+	req := httptest.NewRequest("GET", "/patient/1", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+	mon := RequestMonitor{}
+	serverSpan, clientSpan := mon.startSpans(req, "req-1", "getPatientBiographicalData")
+
+	if id := traceID(serverSpan); id != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Fatalf("trace was not continued, got %s", id)
+	}
+	if req.Header.Get("X-B3-TraceId") != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Fatalf("b3 headers were not injected %v", req.Header)
+	}
+
+	rec := newResponseRecorder(httptest.NewRecorder())
+	rec.WriteHeader(http.StatusOK)
+	finishSpans(serverSpan, clientSpan, rec)
+	tracer.Close()
+
+	if len(collector.requests["/v1/traces"]) != 1 {
+		t.Fatalf("expected one export got %d", len(collector.requests["/v1/traces"]))
+	}
+
+	var request otlpTraceRequest
+	json.Unmarshal(collector.requests["/v1/traces"][0], &request)
+	spans := request.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans got %d", len(spans))
+	}
+
+	client, srv := spans[0], spans[1]
+	if srv.ParentSpanID != "00f067aa0ba902b7" || srv.Kind != 2 {
+		t.Fatalf("unexpected server span %+v", srv)
+	}
+	if client.ParentSpanID != srv.SpanID || client.Kind != 3 {
+		t.Fatalf("unexpected client span %+v", client)
+	}
+}
+
+func TestSampler(t *testing.T) {
+	s := newSampler(Configuration{
+		TracingSampleRatio:          0,
+		TracingOperationSampleRatio: map[string]float64{"getPatientBiographicalData": 1},
+	}, nil)
+
+	if s.Sample(42, "getBloodTestComponentAverage") {
+		t.Fatal("expected operations without ratio to use the default ratio")
+	}
+	if !s.Sample(42, "getPatientBiographicalData") {
+		t.Fatal("expected the operation ratio to be used")
+	}
+
+	s = &sampler{ratio: 0.5}
+	if !s.Sample(1, "") || s.Sample(^uint64(0), "") {
+		t.Fatal("expected a decision based on the trace id")
+	}
+}
+
+func TestOTLPMetrics(t *testing.T) {
+	collector := &collectorStandIn{requests: make(map[string][][]byte)}
+	server := httptest.NewServer(collector)
+	defer server.Close()
+
+	om := newOTLPMetrics(Configuration{OTLPEndpoint: server.URL, OTLPExportInterval: time.Hour})
+	om.Start()
+	om.Record("getPatientBiographicalData", 200, 30*time.Millisecond)
+	om.Record("getPatientBiographicalData", 200, 20*time.Second)
+	om.Stop()
+
+	if len(collector.requests["/v1/metrics"]) != 1 {
+		t.Fatalf("expected one export got %d", len(collector.requests["/v1/metrics"]))
+	}
+
+	var request otlpMetricsRequest
+	json.Unmarshal(collector.requests["/v1/metrics"][0], &request)
+	exported := request.ResourceMetrics[0].ScopeMetrics[0].Metrics
+	if exported[0].Sum.DataPoints[0].AsInt != "2" {
+		t.Fatalf("unexpected request count %+v", exported[0].Sum.DataPoints)
+	}
+
+	buckets := exported[1].Histogram.DataPoints[0].BucketCounts
+	if buckets[3] != "1" || buckets[len(buckets)-1] != "1" {
+		t.Fatalf("unexpected buckets %v", buckets)
+	}
+}
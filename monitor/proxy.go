@@ -20,8 +20,11 @@ package monitor
 
 import (
 	"bytes"
+	"context"
 	"io/ioutil"
 	"net/http"
+	"path"
+	"strings"
 	"time"
 
 	opentracing "github.com/opentracing/opentracing-go"
@@ -30,10 +33,34 @@ import (
 func (mon *RequestMonitor) serve(w http.ResponseWriter, req *http.Request) {
 	var requestID = mon.generateRequestID(req.RemoteAddr)
 
+	method := req.URL.Path
+
+	//the upstream may resolve dot segments after the operation was matched, so only clean paths are accepted
+	if !isCleanPath(method) {
+		log.Infof("rejected %s %s - path is not clean", req.Method, method)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+
+		meter := MeterMessage{
+			Client:        req.RemoteAddr,
+			Method:        method,
+			Kind:          req.Method,
+			RequestLenght: req.ContentLength,
+			ResponseCode:  http.StatusBadRequest,
+		}
+		mon.push(requestID, meter)
+		mon.logAccess(requestID, newAccessLogEntry(req, meter, http.StatusBadRequest, 0))
+		return
+	}
+
+	operationID := mon.extractOperationId(method, req.Method)
+	mirrored := mon.mirror != nil && mon.mirror.Selects(operationID)
+
 	var exchange exchangeMessage
+	var body []byte
 	//read payload
-	if mon.conf.ForwardTraffic {
-		body, err := ioutil.ReadAll(req.Body)
+	if mon.conf.ForwardTraffic || mon.conf.RecordOutput != "" || mirrored {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
 
 		if err != nil {
 			log.Printf("Error reading body: %v", err)
@@ -46,34 +73,185 @@ func (mon *RequestMonitor) serve(w http.ResponseWriter, req *http.Request) {
 		req.Body = ioutil.NopCloser(bytes.NewReader(body))
 
 		exchange = exchangeMessage{
+			RequestURI:    req.RequestURI,
 			RequestBody:   string(body),
 			RequestHeader: req.Header,
 		}
 
 	}
-	method := req.URL.Path
-	req.URL = mon.conf.endpointURL
 
-	operationID := mon.extractOperationId(req.URL.Path, req.Method)
+	//the recorded exchange is completed by the responseInterceptor
+	var recorded *exchangeMessage
+	if mon.recording(operationID) {
+		recorded = &exchangeMessage{
+			RequestURI:    req.RequestURI,
+			RequestBody:   exchange.RequestBody,
+			RequestHeader: mon.recordedHeader(req.Header),
+		}
+		req = req.WithContext(context.WithValue(req.Context(), recordKey{}, recorded))
+	}
+
+	//select the upstream, the version is passed on to the responseInterceptor
+	target, upstream, version := mon.route(req)
+	req.URL = target
+	if version != "" {
+		req = req.WithContext(context.WithValue(req.Context(), versionKey{}, version))
+	}
+
+	//authenticate and authorize the caller
+	var caller string
+	if mon.auth != nil {
+		//the operation must match the whole path, not only a part of it
+		exactID, _ := mon.cache.MatchExact(method, req.Method)
+		p, status, err := mon.auth.Check(req, exactID)
+		if p != nil {
+			caller = p.Name
+		}
+
+		if err != nil {
+			log.Infof("rejected %s %s - %+v", req.Method, method, err)
+			if status == http.StatusUnauthorized {
+				mon.auth.Challenge(w)
+			}
+			http.Error(w, http.StatusText(status), status)
+
+			meter := MeterMessage{
+				OperationID:   operationID,
+				Client:        req.RemoteAddr,
+				Method:        method,
+				Kind:          req.Method,
+				RequestLenght: req.ContentLength,
+				ResponseCode:  status,
+				Principal:     caller,
+			}
+			mon.push(requestID, meter)
+			mon.logAccess(requestID, newAccessLogEntry(req, meter, status, 0))
+			return
+		}
+	}
+
+	//compress the response toward the client, everything below it observes the response of the upstream
+	if cw := mon.compress.Wrap(w, req); cw != nil {
+		w = cw
+	}
+
+	//answer from the cache, the response of a miss is stored once the client received it
+	lookup, cached := mon.responses.Lookup(req, operationID, caller, version)
+	if cached != nil {
+		w.Header().Set("X-Cache", "HIT")
+		mon.serveCached(w, req, requestID, cached, time.Now(), MeterMessage{
+			OperationID:   operationID,
+			Client:        req.RemoteAddr,
+			Method:        method,
+			Kind:          req.Method,
+			RequestLenght: req.ContentLength,
+			Principal:     caller,
+			Version:       version,
+			Cache:         lookup.status,
+		})
+		return
+	}
+
+	//identical concurrent requests wait for the leader of their flight and get its response
+	var leading *flight
+	var flightKey string
+	if mon.coalescer.Selects(req, operationID) {
+		flightKey = cacheKey(req, operationID, caller, version)
+		f, leader := mon.coalescer.Join(flightKey)
+		if leader {
+			leading = f
+			//the followers forward their requests themselves if the leader does not land
+			defer mon.coalescer.Land(flightKey, leading, nil)
+		} else {
+			waiting := time.Now()
+			if shared := f.Await(req); shared != nil {
+				metrics.Add("request_monitor_coalesced_total", 1)
+				mon.serveCached(w, req, requestID, shared, waiting, MeterMessage{
+					OperationID:   operationID,
+					Client:        req.RemoteAddr,
+					Method:        method,
+					Kind:          req.Method,
+					RequestLenght: req.ContentLength,
+					Principal:     caller,
+					Version:       version,
+					Cache:         lookup.status,
+					Coalesced:     true,
+				})
+				return
+			}
+			if req.Context().Err() != nil {
+				return
+			}
+		}
+	}
 
-	//inject tracing header
+	//start tracing and inject the tracing header
+	var serverSpan, clientSpan opentracing.Span
+	var trace string
 	if mon.conf.Opentracing {
-		opentracing.GlobalTracer().Inject(
-			opentracing.StartSpan("VDC-Request").Context(),
-			opentracing.HTTPHeaders,
-			opentracing.HTTPHeadersCarrier(req.Header),
-		)
+		serverSpan, clientSpan = mon.startSpans(req, requestID, operationID)
+		req = req.WithContext(opentracing.ContextWithSpan(req.Context(), clientSpan))
+		trace = traceID(serverSpan)
 	}
 
 	//inject looging header
 	req.Header.Set("X-DITAS-RequestID", requestID)
 	req.Header.Set("X-DITAS-OperationID", operationID)
+	req.Header.Del("X-DITAS-Principal")
+	if caller != "" {
+		req.Header.Set("X-DITAS-Principal", caller)
+	}
 
-	//forward the request
+	//send a copy to the mirror, its response is compared with the one the client gets
+	rec := newResponseRecorder(w)
+	var mirror *mirroredRequest
+	if mirrored {
+		mirror = mon.mirror.Send(req, body, requestID, MeterMessage{
+			OperationID:   operationID,
+			Client:        req.RemoteAddr,
+			Method:        method,
+			Kind:          req.Method,
+			RequestLenght: req.ContentLength,
+			Principal:     caller,
+			TraceID:       trace,
+			Mirrored:      true,
+		})
+		if mirror != nil {
+			rec.keepBody(maxMirrorBody)
+		}
+	}
+
+	if lookup.status != "" {
+		rec.Header().Set("X-Cache", "MISS")
+		rec.keepBody(mon.responses.maxBody)
+	}
+	if leading != nil {
+		rec.keepBody(mon.coalescer.maxBody)
+	}
+
+	//forward the request, handleError marks the recorder if the upstream call fails
+	req = req.WithContext(context.WithValue(req.Context(), recorderKey{}, rec))
 	start := time.Now()
-	mon.oxy.ServeHTTP(w, req)
+	upstream.ServeHTTP(rec, req)
 	end := time.Now().Sub(start)
 
+	if mirror != nil {
+		mirror.Complete(rec)
+	}
+	mon.responses.Store(lookup, rec)
+	if leading != nil {
+		//only responses of the upstream are shared, not the errors of a leader whose client went away
+		if req.Context().Err() == nil && !rec.Failed() {
+			mon.coalescer.Land(flightKey, leading, rec)
+		} else {
+			mon.coalescer.Land(flightKey, leading, nil)
+		}
+	}
+
+	if serverSpan != nil {
+		finishSpans(serverSpan, clientSpan, rec)
+	}
+
 	//report all logging information
 	meter := MeterMessage{
 		OperationID:   operationID,
@@ -82,9 +260,38 @@ func (mon *RequestMonitor) serve(w http.ResponseWriter, req *http.Request) {
 		Kind:          req.Method,
 		RequestLenght: req.ContentLength,
 		RequestTime:   end,
+		Principal:     caller,
+		TraceID:       trace,
+		Version:       version,
+		Cache:         lookup.status,
 	}
+	compressed(w, &meter)
 
 	mon.push(requestID, meter)
+	mon.logAccess(requestID, newAccessLogEntry(req, meter, rec.StatusCode(), written(w, rec)))
+
+	if mon.otlpMetrics != nil {
+		mon.otlpMetrics.Record(operationID, rec.StatusCode(), end)
+	}
+
+	if recorded != nil {
+		recorded.OperationID = operationID
+		recorded.Client = req.RemoteAddr
+		recorded.Method = method
+		recorded.Kind = req.Method
+		recorded.RequestLenght = req.ContentLength
+		recorded.RequestTime = end
+		recorded.Principal = caller
+		recorded.TraceID = trace
+		recorded.Version = version
+		recorded.Timestamp = start
+		if recorded.ResponseCode == 0 {
+			//the upstream did not answer, record what the client got
+			recorded.ResponseCode = rec.StatusCode()
+		}
+
+		mon.record(requestID, *recorded)
+	}
 
 	if mon.conf.ForwardTraffic {
 		exchange.OperationID = operationID
@@ -93,18 +300,51 @@ func (mon *RequestMonitor) serve(w http.ResponseWriter, req *http.Request) {
 		exchange.Kind = req.Method
 		exchange.RequestLenght = req.ContentLength
 		exchange.RequestTime = end
+		exchange.Principal = caller
+		exchange.TraceID = trace
+		exchange.Version = version
 		exchange.RequestID = requestID
 
 		mon.forward(requestID, exchange)
 	}
 }
 
+//serveCached answers a request with a cached or shared response, the request time is measured from start
+func (mon *RequestMonitor) serveCached(w http.ResponseWriter, req *http.Request, requestID string, cached *cachedResponse, start time.Time, meter MeterMessage) {
+	rec := newResponseRecorder(w)
+	cached.WriteTo(rec)
+	compressed(w, &meter)
+
+	meter.RequestTime = time.Now().Sub(start)
+	meter.ResponseCode = rec.StatusCode()
+	meter.ResponseLength = rec.Written()
+
+	mon.push(requestID, meter)
+	mon.logAccess(requestID, newAccessLogEntry(req, meter, rec.StatusCode(), written(w, rec)))
+
+	if mon.otlpMetrics != nil {
+		mon.otlpMetrics.Record(meter.OperationID, rec.StatusCode(), meter.RequestTime)
+	}
+}
+
+//isCleanPath tells if a path has no dot segments or empty segments, a trailing slash is allowed
+func isCleanPath(p string) bool {
+	if p == "" || p == "*" {
+		return true
+	}
+	cleaned := path.Clean(p)
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned == p
+}
+
 func (mon *RequestMonitor) extractOperationId(path string, method string) string {
 
 	optID, err := mon.cache.Match(path, method)
 
 	if err != nil {
-		log.Debug("failed to match %s %s - %+v", path, method, err)
+		log.Debugf("failed to match %s %s - %+v", path, method, err)
 	}
 
 	return optID
@@ -121,10 +361,14 @@ func (mon *RequestMonitor) responseInterceptor(resp *http.Response) error {
 	//extract requestID
 	var requestID string
 	var operationID string
+	var caller string
+	var trace string
 
 	if resp.Request != nil {
 		requestID = resp.Request.Header.Get("X-DITAS-RequestID")
 		operationID = resp.Request.Header.Get("X-DITAS-OperationID")
+		caller = resp.Request.Header.Get("X-DITAS-Principal")
+		trace = traceIDFromHeaders(resp.Request.Header)
 	}
 
 	if resp.Request == nil {
@@ -143,10 +387,19 @@ func (mon *RequestMonitor) responseInterceptor(resp *http.Response) error {
 		RequestID:      requestID,
 		ResponseCode:   resp.StatusCode,
 		ResponseLength: resp.ContentLength,
+		Principal:      caller,
+		TraceID:        trace,
 	}
+	meter.Version, _ = resp.Request.Context().Value(versionKey{}).(string)
+
+	if resp.TLS != nil {
+		meter.UpstreamTLSVersion = tlsVersionName(resp.TLS.Version)
+	}
+
 	mon.push(requestID, meter)
 
-	if !mon.conf.ForwardTraffic {
+	recorded, _ := resp.Request.Context().Value(recordKey{}).(*exchangeMessage)
+	if !mon.conf.ForwardTraffic && recorded == nil {
 		return nil
 	}
 
@@ -158,22 +411,47 @@ func (mon *RequestMonitor) responseInterceptor(resp *http.Response) error {
 		return err
 	}
 
-	log.Infof("%s", string(body))
-
 	resp.ContentLength = int64(len(body))
 	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
 
-	//report logging information
-	exchange := exchangeMessage{
-		ResponseBody:   string(body),
-		ResponseHeader: resp.Header,
+	if recorded != nil {
+		recorded.ResponseBody, recorded.ResponseHeader = decodedResponse(string(body), resp.Header)
+		recorded.ResponseCode = resp.StatusCode
+		recorded.ResponseLength = resp.ContentLength
+	}
+
+	if !mon.conf.ForwardTraffic {
+		return nil
 	}
 
+	//report logging information
+	var exchange exchangeMessage
+	exchange.ResponseBody, exchange.ResponseHeader = decodedResponse(string(body), resp.Header)
+
 	exchange.OperationID = operationID
 	exchange.RequestID = requestID
 	exchange.ResponseCode = resp.StatusCode
 	exchange.ResponseLength = resp.ContentLength
+	exchange.Principal = caller
+	exchange.TraceID = trace
 
 	mon.forward(requestID, exchange)
 	return nil
 }
+
+//recordKey is the context key of the exchange that is recorded for a request
+type recordKey struct{}
+
+//versionKey is the context key of the version of the upstream that serves a request
+type versionKey struct{}
+
+//recorderKey is the context key of the recorder of the response that is sent to the client
+type recorderKey struct{}
+
+func cloneHeader(header http.Header) http.Header {
+	clone := make(http.Header, len(header))
+	for key, values := range header {
+		clone[key] = append([]string(nil), values...)
+	}
+	return clone
+}
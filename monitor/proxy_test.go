@@ -21,6 +21,8 @@ package monitor
 import (
 	"fmt"
 	"math/rand"
+	"net/http"
+	"net/url"
 	"path/filepath"
 	"regexp"
 	"testing"
@@ -92,6 +94,54 @@ func create(blueprint *spec.BlueprintType) RequestMonitor {
 	}
 }
 
+//newProxyStandIn creates a monitor that forwards to the upstream without starting any reporter,
+//meters of served requests are dropped once the queues are full
+func newProxyStandIn(t *testing.T, conf Configuration, upstream string) *RequestMonitor {
+	blueprint, err := spec.ReadBlueprint(filepath.Join("..", "resources", "blueprint.json"))
+	if err != nil {
+		t.Fatalf("could not prepare test %+v", err)
+	}
+
+	conf.Endpoint = upstream
+	conf.endpointURL, err = url.Parse(upstream)
+	if err != nil {
+		t.Fatalf("could not prepare test %+v", err)
+	}
+	conf.QueueOverflowPolicy = overflowDropNewest
+
+	mon := &RequestMonitor{
+		conf:           conf,
+		blueprint:      blueprint,
+		cache:          NewResoruceCache(blueprint),
+		monitorQueue:   make(chan MeterMessage, 10),
+		exchangeQueue:  make(chan exchangeMessage, 10),
+		accessLogQueue: make(chan accessLogEntry, 10),
+		busQueue:       make(chan busMessage, 10),
+		recordQueue:    make(chan exchangeMessage, 10),
+		queues:         make(map[string]*reporterQueue),
+	}
+
+	for name, queue := range map[string]interface{}{
+		"monitor":   mon.monitorQueue,
+		"exchange":  mon.exchangeQueue,
+		"accesslog": mon.accessLogQueue,
+		"bus":       mon.busQueue,
+		"record":    mon.recordQueue,
+	} {
+		mon.queues[name], err = newReporterQueue(conf, name, queue)
+		if err != nil {
+			t.Fatalf("could not prepare test %+v", err)
+		}
+	}
+
+	mon.oxy, err = mon.newForwarder(http.DefaultTransport)
+	if err != nil {
+		t.Fatalf("could not prepare test %+v", err)
+	}
+
+	return mon
+}
+
 func test(b *testing.T, blueprint *spec.BlueprintType, testData map[string][]testURI) {
 
 	//create monitor object
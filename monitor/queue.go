@@ -0,0 +1,323 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+
+package monitor
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//overflow policies of the reporter queues
+const (
+	overflowBlock      = "block"
+	overflowDropNewest = "drop-newest"
+	overflowDropOldest = "drop-oldest"
+	overflowSpill      = "spill"
+)
+
+//reporterQueue applies an overflow policy to the channel of a reporter, so that a slow
+//reporter does not stall the requests passing through the monitor
+type reporterQueue struct {
+	name   string
+	queue  reflect.Value
+	policy string
+
+	spillFile    string
+	spillMaxSize int64
+	apiKeyHeader string
+	redact       bool //redact the credentials of spilled exchanges
+
+	lock      sync.Mutex
+	spill     *os.File
+	spillSize int64
+
+	QuitChan chan bool
+}
+
+//newReporterQueue wraps the given channel with the configured overflow policy
+func newReporterQueue(conf Configuration, name string, queue interface{}) (*reporterQueue, error) {
+	policy := conf.QueueOverflowPolicy
+	if policy == "" {
+		policy = overflowBlock
+	}
+
+	switch policy {
+	case overflowBlock, overflowDropNewest, overflowDropOldest, overflowSpill:
+	default:
+		return nil, fmt.Errorf("unknown queue overflow policy %s", policy)
+	}
+
+	rq := &reporterQueue{
+		name:         name,
+		queue:        reflect.ValueOf(queue),
+		policy:       policy,
+		spillMaxSize: int64(conf.QueueSpillMaxSize) * 1024 * 1024,
+		apiKeyHeader: conf.AuthAPIKeyHeader,
+		//recorded exchanges keep their credentials only if they are recorded with them
+		redact:   name != "record" || !conf.RecordCredentials,
+		QuitChan: make(chan bool),
+	}
+
+	if policy == overflowSpill {
+		//spill files are not shared with other monitors on the same host
+		dir := conf.QueueSpillDir
+		if dir == "" {
+			dir = filepath.Join(conf.configDir, "spill", conf.VDCName)
+		}
+
+		err := os.MkdirAll(dir, 0700)
+		if err != nil {
+			log.Errorf("could not create spill directory %+v", err)
+			return nil, err
+		}
+		rq.spillFile = filepath.Join(dir, name+".spill")
+	}
+
+	metrics.Set(fmt.Sprintf("request_monitor_queue_capacity{queue=%q}", name), float64(rq.queue.Cap()))
+	return rq, nil
+}
+
+//queueSize returns the configured capacity of a reporter queue
+func queueSize(conf Configuration, name string) int {
+	if size, ok := conf.QueueSizes[name]; ok && size > 0 {
+		return size
+	}
+	if conf.QueueSize > 0 {
+		return conf.QueueSize
+	}
+	return 10
+}
+
+//Offer adds the item to the queue, if the queue is full the overflow policy is applied
+func (rq *reporterQueue) Offer(item interface{}) {
+	value := reflect.ValueOf(item)
+
+	if rq.queue.TrySend(value) {
+		return
+	}
+
+	switch rq.policy {
+	case overflowDropNewest:
+		rq.dropped(1)
+
+	case overflowDropOldest:
+		for !rq.queue.TrySend(value) {
+			if _, ok := rq.queue.TryRecv(); ok {
+				rq.dropped(1)
+			}
+		}
+
+	case overflowSpill:
+		err := rq.write(item)
+		if err != nil {
+			log.Debugf("could not spill %s message %+v", rq.name, err)
+			rq.dropped(1)
+		}
+
+	default:
+		rq.queue.Send(value)
+	}
+}
+
+func (rq *reporterQueue) dropped(count int) {
+	metrics.Add(fmt.Sprintf("request_monitor_queue_dropped_total{queue=%q}", rq.name), float64(count))
+}
+
+//write appends an item to the spill file, the credentials of exchanges are redacted
+func (rq *reporterQueue) write(item interface{}) error {
+	if exchange, ok := item.(exchangeMessage); ok && rq.redact {
+		exchange.RequestHeader = cloneHeader(exchange.RequestHeader)
+		redactCredentials(exchange.RequestHeader, rq.apiKeyHeader)
+		item = exchange
+	}
+
+	data, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	rq.lock.Lock()
+	defer rq.lock.Unlock()
+
+	if rq.spillMaxSize > 0 && rq.spillSize+int64(len(data)) > rq.spillMaxSize {
+		return fmt.Errorf("spill file %s is full", rq.spillFile)
+	}
+
+	if rq.spill == nil {
+		file, err := os.OpenFile(rq.spillFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return err
+		}
+		rq.spill = file
+		rq.spillSize = info.Size()
+	}
+
+	n, err := rq.spill.Write(data)
+	rq.spillSize += int64(n)
+	if err != nil {
+		return err
+	}
+
+	metrics.Add(fmt.Sprintf("request_monitor_queue_spilled_total{queue=%q}", rq.name), 1)
+	return nil
+}
+
+//Start will create a worker process that moves spilled messages back into the queue,
+//messages left over from a previous run are replayed as well
+func (rq *reporterQueue) Start() {
+	if rq.policy != overflowSpill {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+
+		for {
+			stopped := rq.drain()
+
+			if !stopped {
+				select {
+				case <-ticker.C:
+					continue
+				case <-rq.QuitChan:
+				}
+			}
+
+			rq.lock.Lock()
+			if rq.spill != nil {
+				rq.spill.Close()
+				rq.spill = nil
+			}
+			rq.lock.Unlock()
+			log.Infof("%s queue stopping", rq.name)
+			return
+		}
+	}()
+}
+
+//Stop will terminate any running worker process
+func (rq *reporterQueue) Stop() {
+	if rq.policy != overflowSpill {
+		return
+	}
+
+	go func() {
+		rq.QuitChan <- true
+	}()
+}
+
+//drain replays the current spill file into the queue, new messages are spilled to a fresh file meanwhile.
+//It reports if the queue was stopped while draining, the next run then continues after the last replayed message
+func (rq *reporterQueue) drain() bool {
+	draining := rq.spillFile + ".draining"
+	offsetFile := draining + ".offset"
+
+	if _, err := os.Stat(draining); os.IsNotExist(err) {
+		rq.lock.Lock()
+		if rq.spill != nil {
+			rq.spill.Close()
+			rq.spill = nil
+		}
+		rq.spillSize = 0
+		os.Remove(offsetFile)
+		err = os.Rename(rq.spillFile, draining)
+		rq.lock.Unlock()
+
+		if err != nil {
+			//nothing was spilled
+			return false
+		}
+	}
+
+	file, err := os.Open(draining)
+	if err != nil {
+		log.Errorf("could not open spill file %+v", err)
+		return false
+	}
+	defer file.Close()
+
+	var offset int64
+	if data, err := ioutil.ReadFile(offsetFile); err == nil {
+		offset, _ = strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		log.Errorf("could not seek spill file %+v", err)
+		return false
+	}
+
+	cases := []reflect.SelectCase{
+		{Dir: reflect.SelectSend, Chan: rq.queue},
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(rq.QuitChan)},
+	}
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	replayed := 0
+	for scanner.Scan() {
+		line := int64(len(scanner.Bytes())) + 1
+		item := reflect.New(rq.queue.Type().Elem())
+		err := json.Unmarshal(scanner.Bytes(), item.Interface())
+		if err != nil {
+			log.Debugf("skipping invalid spilled %s message %+v", rq.name, err)
+			rq.dropped(1)
+			offset += line
+			continue
+		}
+
+		cases[0].Send = item.Elem()
+		if chosen, _, _ := reflect.Select(cases); chosen == 1 {
+			//remember the messages that were replayed already
+			err := ioutil.WriteFile(offsetFile, []byte(strconv.FormatInt(offset, 10)), 0600)
+			if err != nil {
+				log.Errorf("could not store the spill file offset %+v", err)
+			}
+			return true
+		}
+		offset += line
+		replayed++
+	}
+
+	if err := scanner.Err(); err != nil {
+		log.Errorf("could not read spill file %+v", err)
+		return false
+	}
+
+	log.Debugf("replayed %d spilled %s messages", replayed, rq.name)
+	os.Remove(offsetFile)
+	os.Remove(draining)
+	return false
+}
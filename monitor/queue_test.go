@@ -0,0 +1,215 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+
+package monitor
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReporterQueueDrop(t *testing.T) {
+	for _, policy := range []string{overflowDropNewest, overflowDropOldest} {
+		queue := make(chan MeterMessage, 2)
+		rq, err := newReporterQueue(Configuration{QueueOverflowPolicy: policy}, "test-"+policy, queue)
+		if err != nil {
+			t.Fatalf("could not create queue %+v", err)
+		}
+
+		dropped := `request_monitor_queue_dropped_total{queue="test-` + policy + `"}`
+		before := metrics.Get(dropped)
+		for _, id := range []string{"a", "b", "c"} {
+			rq.Offer(MeterMessage{RequestID: id})
+		}
+
+		first, second := <-queue, <-queue
+		expected := []string{"a", "b"}
+		if policy == overflowDropOldest {
+			expected = []string{"b", "c"}
+		}
+		if first.RequestID != expected[0] || second.RequestID != expected[1] {
+			t.Errorf("%s kept %s,%s expected %v", policy, first.RequestID, second.RequestID, expected)
+		}
+
+		if metrics.Get(dropped) != before+1 {
+			t.Errorf("%s did not count the dropped message", policy)
+		}
+	}
+}
+
+func TestReporterQueueSpill(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spill")
+	if err != nil {
+		t.Fatalf("could not prepare test %+v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	queue := make(chan MeterMessage, 1)
+	rq, err := newReporterQueue(Configuration{
+		QueueOverflowPolicy: overflowSpill,
+		QueueSpillDir:       dir,
+	}, "spill", queue)
+	if err != nil {
+		t.Fatalf("could not create queue %+v", err)
+	}
+
+	for _, id := range []string{"a", "b", "c"} {
+		rq.Offer(MeterMessage{RequestID: id})
+	}
+
+	rq.Start()
+	defer rq.Stop()
+
+	for _, id := range []string{"a", "b", "c"} {
+		msg := <-queue
+		if msg.RequestID != id {
+			t.Errorf("expected %s got %s", id, msg.RequestID)
+		}
+	}
+
+	if _, err := newReporterQueue(Configuration{QueueOverflowPolicy: "unknown"}, "x", queue); err == nil {
+		t.Errorf("unknown policies should be rejected")
+	}
+}
+
+func TestReporterQueueSpillDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spill")
+	if err != nil {
+		t.Fatalf("could not prepare test %+v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	rq, err := newReporterQueue(Configuration{
+		configDir:           dir,
+		VDCName:             "vdc-a",
+		QueueOverflowPolicy: overflowSpill,
+	}, "monitor", make(chan MeterMessage, 1))
+	if err != nil {
+		t.Fatalf("could not create queue %+v", err)
+	}
+
+	if expected := filepath.Join(dir, "spill", "vdc-a", "monitor.spill"); rq.spillFile != expected {
+		t.Fatalf("expected the spill file %s got %s", expected, rq.spillFile)
+	}
+}
+
+func TestReporterQueueSpillCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spill")
+	if err != nil {
+		t.Fatalf("could not prepare test %+v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, recordCredentials := range []bool{false, true} {
+		queue := make(chan exchangeMessage, 1)
+		rq, err := newReporterQueue(Configuration{
+			QueueOverflowPolicy: overflowSpill,
+			QueueSpillDir:       dir,
+			AuthAPIKeyHeader:    "X-Token",
+			RecordCredentials:   recordCredentials,
+		}, "record", queue)
+		if err != nil {
+			t.Fatalf("could not create queue %+v", err)
+		}
+
+		header := http.Header{}
+		header.Set("Authorization", "Bearer secret-token")
+		header.Set("X-Token", "secret-key")
+		header.Set("Accept", "application/json")
+		rq.Offer(exchangeMessage{RequestID: "a"})
+		rq.Offer(exchangeMessage{RequestID: "b", RequestHeader: header})
+
+		if header.Get("Authorization") != "Bearer secret-token" {
+			t.Fatal("expected the offered message to be left unchanged")
+		}
+
+		data, err := ioutil.ReadFile(rq.spillFile)
+		if err != nil {
+			t.Fatalf("could not read spill file %+v", err)
+		}
+		spilled := string(data)
+		if recordCredentials != strings.Contains(spilled, "secret-token") || recordCredentials != strings.Contains(spilled, "secret-key") {
+			t.Fatalf("expected credentials to be spilled only if they are recorded, got %s", spilled)
+		}
+		if !strings.Contains(spilled, "application/json") {
+			t.Fatalf("expected other headers to be spilled, got %s", spilled)
+		}
+		os.Remove(rq.spillFile)
+	}
+}
+
+func TestReporterQueueSpillResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spill")
+	if err != nil {
+		t.Fatalf("could not prepare test %+v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	conf := Configuration{
+		QueueOverflowPolicy: overflowSpill,
+		QueueSpillDir:       dir,
+	}
+	queue := make(chan MeterMessage, 1)
+	rq, err := newReporterQueue(conf, "resume", queue)
+	if err != nil {
+		t.Fatalf("could not create queue %+v", err)
+	}
+
+	for _, id := range []string{"a", "b", "c"} {
+		rq.Offer(MeterMessage{RequestID: id})
+	}
+
+	//stop the queue while it waits to replay c
+	rq.Start()
+	if msg := <-queue; msg.RequestID != "a" {
+		t.Fatalf("expected a got %s", msg.RequestID)
+	}
+	waitFor(t, func() bool { return len(queue) == 1 })
+	rq.Stop()
+	waitFor(t, func() bool {
+		_, err := os.Stat(rq.spillFile + ".draining.offset")
+		return err == nil
+	})
+	if msg := <-queue; msg.RequestID != "b" {
+		t.Fatalf("expected b got %s", msg.RequestID)
+	}
+
+	//the next run only replays what is left
+	rq, err = newReporterQueue(conf, "resume", queue)
+	if err != nil {
+		t.Fatalf("could not create queue %+v", err)
+	}
+	rq.Start()
+	defer rq.Stop()
+
+	if msg := <-queue; msg.RequestID != "c" {
+		t.Fatalf("expected c got %s", msg.RequestID)
+	}
+	waitFor(t, func() bool {
+		_, err := os.Stat(rq.spillFile + ".draining")
+		return os.IsNotExist(err)
+	})
+	if len(queue) != 0 {
+		t.Fatalf("expected no message to be replayed twice, got %+v", <-queue)
+	}
+}
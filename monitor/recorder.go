@@ -0,0 +1,120 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+package monitor
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"net/http"
+)
+
+//responseRecorder wraps the client ResponseWriter to observe the status code and size of a response
+type responseRecorder struct {
+	http.ResponseWriter
+	statusCode int
+	written    int64
+	failed     bool //the response was written by handleError, not by the upstream
+
+	body      *bytes.Buffer
+	bodyLimit int
+	truncated bool
+}
+
+func newResponseRecorder(w http.ResponseWriter) *responseRecorder {
+	return &responseRecorder{ResponseWriter: w}
+}
+
+func (rr *responseRecorder) WriteHeader(statusCode int) {
+	if rr.statusCode == 0 {
+		rr.statusCode = statusCode
+	}
+	rr.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (rr *responseRecorder) Write(data []byte) (int, error) {
+	if rr.statusCode == 0 {
+		rr.statusCode = http.StatusOK
+	}
+	n, err := rr.ResponseWriter.Write(data)
+	rr.written += int64(n)
+
+	if rr.body != nil && !rr.truncated {
+		if rr.body.Len()+n > rr.bodyLimit {
+			rr.truncated = true
+			rr.body.Reset()
+		} else {
+			rr.body.Write(data[:n])
+		}
+	}
+	return n, err
+}
+
+//Failed tells if the upstream did not produce the response, e.g., because it was not reachable
+func (rr *responseRecorder) Failed() bool {
+	return rr.failed
+}
+
+//keepBody keeps a copy of the response body send to the client, up to limit bytes,
+//the largest limit applies if it is called more than once
+func (rr *responseRecorder) keepBody(limit int) {
+	if rr.body == nil {
+		rr.body = new(bytes.Buffer)
+	}
+	if limit > rr.bodyLimit {
+		rr.bodyLimit = limit
+	}
+}
+
+//Body returns the kept response body, complete is false if it exceeded the limit
+func (rr *responseRecorder) Body() (body string, complete bool) {
+	if rr.body == nil || rr.truncated {
+		return "", false
+	}
+	return rr.body.String(), true
+}
+
+//StatusCode returns the status code send to the client
+func (rr *responseRecorder) StatusCode() int {
+	if rr.statusCode == 0 {
+		return http.StatusOK
+	}
+	return rr.statusCode
+}
+
+//Written returns the number of body bytes send to the client
+func (rr *responseRecorder) Written() int64 {
+	return rr.written
+}
+
+//Flush is needed for streamed responses
+func (rr *responseRecorder) Flush() {
+	if flusher, ok := rr.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+//Hijack is needed for websocket connections
+func (rr *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hijacker, ok := rr.ResponseWriter.(http.Hijacker); ok {
+		return hijacker.Hijack()
+	}
+	return nil, nil, errors.New("connection can't be hijacked")
+}
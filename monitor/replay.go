@@ -0,0 +1,411 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+
+package monitor
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+//ReplayOptions configure how recorded exchanges are replayed
+type ReplayOptions struct {
+	Target  string        //VDC the requests are send to directly, if empty they are fed through the monitor
+	Ignore  []string      //paths of JSON response fields that are not compared, e.g., $.meta.created or items[*].id
+	Timeout time.Duration //timeout of a single request to the Target
+}
+
+//maxDiffs limits the differences printed per exchange
+const maxDiffs = 10
+
+//Replay re-sends recorded exchanges and compares the responses with the recording.
+//Without a Target the requests are fed through the monitor as if the proxy received them,
+//so they are forwarded to the Endpoint and reported like live traffic.
+//It returns the number of exchanges whose response differs from the recording.
+func Replay(file string, opts ReplayOptions, out io.Writer) (int, error) {
+	records, err := readExchanges(file)
+	if err != nil {
+		log.Errorf("could not read recorded exchanges %+v", err)
+		return 0, err
+	}
+
+	var send func(req *http.Request) (*replayResponse, error)
+	if opts.Target != "" {
+		target, err := url.Parse(opts.Target)
+		if err != nil || target.Host == "" {
+			return 0, fmt.Errorf("invalid replay target %q", opts.Target)
+		}
+		send = directSender(target, opts.Timeout)
+	} else {
+		conf, err := readConfig()
+		if err != nil {
+			return 0, err
+		}
+
+		mon, err := newManager(replayConfiguration(conf))
+		if err != nil {
+			return 0, err
+		}
+
+		stop := mon.start()
+		defer mon.drain(stop, 30*time.Second)
+
+		send = func(req *http.Request) (*replayResponse, error) {
+			w := newReplayResponse()
+			mon.serve(w, req)
+			return w, nil
+		}
+	}
+
+	differing := 0
+	for _, record := range records {
+		req, err := record.request()
+		if err != nil {
+			fmt.Fprintf(out, "%s skipped: %v\n", record.RequestID, err)
+			continue
+		}
+
+		resp, err := send(req)
+		if err != nil {
+			fmt.Fprintf(out, "%s %s failed: %v\n", req.Method, record.requestURI(), err)
+			differing++
+			continue
+		}
+
+		diffs := record.diff(resp, opts.Ignore)
+		if len(diffs) == 0 {
+			fmt.Fprintf(out, "%s %s -> %d ok\n", req.Method, record.requestURI(), resp.status)
+			continue
+		}
+
+		differing++
+		fmt.Fprintf(out, "%s %s -> %d differs\n", req.Method, record.requestURI(), resp.status)
+		for i, diff := range diffs {
+			if i == maxDiffs {
+				fmt.Fprintf(out, "    ... %d more\n", len(diffs)-maxDiffs)
+				break
+			}
+			fmt.Fprintf(out, "    %s\n", diff)
+		}
+	}
+	fmt.Fprintf(out, "replayed %d exchanges, %d differ\n", len(records), differing)
+
+	return differing, nil
+}
+
+//replayConfiguration adapts the configuration of the monitor for replays. The replayed traffic must not
+//be recorded again, which would also truncate a HAR archive that is replayed, nor be forwarded or mirrored,
+//and it is answered by the Endpoint instead of the cache.
+func replayConfiguration(conf Configuration) Configuration {
+	conf.RecordOutput = ""
+	conf.ForwardTraffic = false
+	conf.MirrorEndpoint = ""
+	conf.CacheTTL = nil
+	return conf
+}
+
+//directSender sends the requests to the target instead of the monitor
+func directSender(target *url.URL, timeout time.Duration) func(req *http.Request) (*replayResponse, error) {
+	client := &http.Client{Timeout: timeout}
+	return func(req *http.Request) (*replayResponse, error) {
+		u := *target
+		u.Path = strings.TrimSuffix(target.Path, "/") + req.URL.Path
+		u.RawQuery = req.URL.RawQuery
+
+		req.URL = &u
+		req.Host = u.Host
+		req.RequestURI = ""
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+
+		w := newReplayResponse()
+		w.header = resp.Header
+		w.status = resp.StatusCode
+		_, err = io.Copy(&w.body, resp.Body)
+		return w, err
+	}
+}
+
+//readExchanges reads a HAR archive or exchange messages of a NDJSON file, one message per line.
+//Request and response messages with the same id, as send by the exchange reporter, are merged.
+func readExchanges(file string) ([]exchangeMessage, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var har harFile
+	if json.Unmarshal(data, &har) == nil && har.Log != nil {
+		records := make([]exchangeMessage, 0, len(har.Log.Entries))
+		for i, entry := range har.Log.Entries {
+			record, err := entry.exchange()
+			if err != nil {
+				return nil, fmt.Errorf("entry %d: %v", i, err)
+			}
+			records = append(records, record)
+		}
+		return records, nil
+	}
+
+	records := make([]exchangeMessage, 0)
+	index := make(map[string]int)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), len(data)+1)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+
+		var record exchangeMessage
+		err := json.Unmarshal(scanner.Bytes(), &record)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+
+		if i, ok := index[record.RequestID]; ok && record.RequestID != "" {
+			records[i] = records[i].merge(record)
+			continue
+		}
+		index[record.RequestID] = len(records)
+		records = append(records, record)
+	}
+
+	return records, scanner.Err()
+}
+
+//merge completes the exchange with the fields of another part of it
+func (ex exchangeMessage) merge(part exchangeMessage) exchangeMessage {
+	fill := func(field *string, value string) {
+		if *field == "" {
+			*field = value
+		}
+	}
+	fill(&ex.OperationID, part.OperationID)
+	fill(&ex.Kind, part.Kind)
+	fill(&ex.Method, part.Method)
+	fill(&ex.Client, part.Client)
+	fill(&ex.Principal, part.Principal)
+	fill(&ex.RequestURI, part.RequestURI)
+	fill(&ex.RequestBody, part.RequestBody)
+	fill(&ex.ResponseBody, part.ResponseBody)
+
+	if ex.RequestHeader == nil {
+		ex.RequestHeader = part.RequestHeader
+	}
+	if ex.ResponseHeader == nil {
+		ex.ResponseHeader = part.ResponseHeader
+	}
+	if ex.ResponseCode == 0 {
+		ex.ResponseCode = part.ResponseCode
+		ex.ResponseLength = part.ResponseLength
+	}
+	return ex
+}
+
+//request recreates the request of a recorded exchange as it was received by the proxy
+func (ex exchangeMessage) request() (*http.Request, error) {
+	method := ex.Kind
+	if method == "" {
+		method = "GET"
+	}
+
+	uri := ex.requestURI()
+	req, err := http.NewRequest(method, uri, strings.NewReader(ex.RequestBody))
+	if err != nil {
+		return nil, err
+	}
+
+	for key, values := range ex.RequestHeader {
+		//credentials are redacted unless RecordCredentials was set
+		if len(values) == 1 && values[0] == redactedValue {
+			continue
+		}
+		req.Header[key] = values
+	}
+	req.RequestURI = uri
+	req.RemoteAddr = ex.Client
+	if req.RemoteAddr == "" {
+		req.RemoteAddr = "127.0.0.1:0"
+	}
+
+	return req, nil
+}
+
+//diff lists the differences of a replayed response to the recorded one,
+//exchanges without a recorded response are not compared
+func (ex exchangeMessage) diff(resp *replayResponse, ignore []string) []string {
+	if ex.ResponseCode == 0 {
+		return nil
+	}
+
+	//recorded bodies are decoded
+	return diffResponse(ex.ResponseCode, ex.ResponseBody, resp.status, decodedBody(resp.body.String(), resp.header), ignore)
+}
+
+//diffResponse lists the differences of a response to the expected one
+func diffResponse(expectedStatus int, expectedBody string, status int, body string, ignore []string) []string {
+	diffs := make([]string, 0)
+	if status != expectedStatus {
+		diffs = append(diffs, fmt.Sprintf("status %d, expected %d", status, expectedStatus))
+	}
+	return append(diffs, diffBody(expectedBody, body, ignore)...)
+}
+
+//diffBody compares a body with the expected one, JSON bodies are compared
+//field by field so that formatting and key order do not matter
+func diffBody(expectedBody string, body string, ignore []string) []string {
+	var expected, actual interface{}
+	if json.Unmarshal([]byte(expectedBody), &expected) == nil && json.Unmarshal([]byte(body), &actual) == nil {
+		diffs := make([]string, 0)
+		diffJSON("$", expected, actual, ignore, &diffs)
+		return diffs
+	}
+
+	if expectedBody != body {
+		return []string{fmt.Sprintf("body of %d bytes differs from the expected %d bytes", len(body), len(expectedBody))}
+	}
+	return nil
+}
+
+var arrayIndex = regexp.MustCompile(`\[\d+\]`)
+
+//ignored tells if a path matches one of the ignored paths, indices match [*]
+func ignored(path string, ignore []string) bool {
+	wildcard := arrayIndex.ReplaceAllString(path, "[*]")
+	for _, i := range ignore {
+		if !strings.HasPrefix(i, "$") {
+			i = "$." + i
+		}
+		if i == path || i == wildcard {
+			return true
+		}
+	}
+	return false
+}
+
+func diffJSON(path string, expected interface{}, actual interface{}, ignore []string, diffs *[]string) {
+	if ignored(path, ignore) {
+		return
+	}
+
+	switch e := expected.(type) {
+	case map[string]interface{}:
+		a, ok := actual.(map[string]interface{})
+		if !ok {
+			break
+		}
+
+		keys := make([]string, 0, len(e))
+		for key := range e {
+			keys = append(keys, key)
+		}
+		for key := range a {
+			if _, ok := e[key]; !ok {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			field := path + "." + key
+			ev, inExpected := e[key]
+			av, inActual := a[key]
+			switch {
+			case ignored(field, ignore):
+			case !inActual:
+				*diffs = append(*diffs, fmt.Sprintf("%s missing", field))
+			case !inExpected:
+				*diffs = append(*diffs, fmt.Sprintf("%s unexpected", field))
+			default:
+				diffJSON(field, ev, av, ignore, diffs)
+			}
+		}
+		return
+	case []interface{}:
+		a, ok := actual.([]interface{})
+		if !ok {
+			break
+		}
+
+		if len(a) != len(e) {
+			*diffs = append(*diffs, fmt.Sprintf("%s has %d elements, expected %d", path, len(a), len(e)))
+		}
+		for i := 0; i < len(a) && i < len(e); i++ {
+			diffJSON(fmt.Sprintf("%s[%d]", path, i), e[i], a[i], ignore, diffs)
+		}
+		return
+	default:
+		if reflect.DeepEqual(expected, actual) {
+			return
+		}
+	}
+
+	*diffs = append(*diffs, fmt.Sprintf("%s is %s, expected %s", path, compactJSON(actual), compactJSON(expected)))
+}
+
+func compactJSON(value interface{}) string {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprintf("%v", value)
+	}
+	if len(data) > 80 {
+		return string(data[:77]) + "..."
+	}
+	return string(data)
+}
+
+//replayResponse is a ResponseWriter that keeps the response for the comparison
+type replayResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newReplayResponse() *replayResponse {
+	return &replayResponse{header: make(http.Header), status: http.StatusOK}
+}
+
+func (rr *replayResponse) Header() http.Header {
+	return rr.header
+}
+
+func (rr *replayResponse) Write(data []byte) (int, error) {
+	return rr.body.Write(data)
+}
+
+func (rr *replayResponse) WriteHeader(status int) {
+	rr.status = status
+}
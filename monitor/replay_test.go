@@ -0,0 +1,195 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+
+package monitor
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadExchanges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replay")
+	if err != nil {
+		t.Fatalf("could not prepare test %+v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	//the exchange reporter sends requests and responses as separate messages
+	file := filepath.Join(dir, "exchanges.ndjson")
+	err = ioutil.WriteFile(file, []byte(`{"id":"1","request.method":"POST","request.path":"/patients","request.uri":"/patients?limit=1","request.body":"{}","request.header":{"Content-Type":["application/json"]},"request.client":"10.0.0.1:4000"}
+
+{"id":"2","request.path":"/patients/42"}
+{"id":"1","response.code":201,"response.body":"{\"id\":1}"}
+`), 0644)
+	if err != nil {
+		t.Fatalf("could not prepare test %+v", err)
+	}
+
+	records, err := readExchanges(file)
+	if err != nil {
+		t.Fatalf("could not read exchanges %+v", err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("expected 2 records, got %d", len(records))
+	}
+	if records[0].ResponseCode != 201 || records[0].ResponseBody != `{"id":1}` {
+		t.Fatalf("expected the response to be merged, got %+v", records[0])
+	}
+
+	req, err := records[0].request()
+	if err != nil {
+		t.Fatalf("could not build request %+v", err)
+	}
+	if req.Method != "POST" || req.URL.Path != "/patients" || req.RequestURI != "/patients?limit=1" {
+		t.Fatalf("unexpected request %s %s", req.Method, req.RequestURI)
+	}
+	if req.Header.Get("Content-Type") != "application/json" || req.RemoteAddr != "10.0.0.1:4000" {
+		t.Fatalf("request header or client not restored %v %s", req.Header, req.RemoteAddr)
+	}
+
+	req, err = records[1].request()
+	if err != nil {
+		t.Fatalf("could not build request %+v", err)
+	}
+	if req.Method != "GET" || req.RequestURI != "/patients/42" {
+		t.Fatalf("expected the method to default to GET, got %s %s", req.Method, req.RequestURI)
+	}
+
+	err = ioutil.WriteFile(file, []byte("{\"id\":\"1\"}\nnot json\n"), 0644)
+	if err != nil {
+		t.Fatalf("could not prepare test %+v", err)
+	}
+	if _, err := readExchanges(file); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Fatalf("expected an error for line 2, got %v", err)
+	}
+}
+
+func TestReplayAgainstTarget(t *testing.T) {
+	var received []string
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = append(received, r.Method+" "+r.URL.RequestURI())
+		switch r.URL.Path {
+		case "/vdc/patient/1":
+			w.Write([]byte(`{"created":"today","name":"a","tests":[1,2]}`))
+		default:
+			w.Write([]byte(`{"created":"today","name":"b","tests":[1]}`))
+		}
+	}))
+	defer target.Close()
+
+	dir, err := ioutil.TempDir("", "replay")
+	if err != nil {
+		t.Fatalf("could not prepare test %+v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "exchanges.ndjson")
+	err = ioutil.WriteFile(file, []byte(`{"id":"1","request.method":"GET","request.uri":"/patient/1?x=1","response.code":200,"response.body":"{\"name\":\"a\",\"tests\":[1,2],\"created\":\"yesterday\"}"}
+{"id":"2","request.method":"GET","request.uri":"/patient/2","response.code":200,"response.body":"{\"name\":\"a\",\"tests\":[1,2],\"created\":\"yesterday\"}"}
+`), 0644)
+	if err != nil {
+		t.Fatalf("could not prepare test %+v", err)
+	}
+
+	var out bytes.Buffer
+	differing, err := Replay(file, ReplayOptions{Target: target.URL + "/vdc/", Ignore: []string{"created"}}, &out)
+	if err != nil {
+		t.Fatalf("replay failed %+v", err)
+	}
+
+	if differing != 1 {
+		t.Fatalf("expected 1 differing exchange, got %d:\n%s", differing, out.String())
+	}
+	if len(received) != 2 || received[0] != "GET /vdc/patient/1?x=1" {
+		t.Fatalf("unexpected requests %v", received)
+	}
+	for _, expected := range []string{`$.name is "b", expected "a"`, "$.tests has 1 elements, expected 2", "replayed 2 exchanges, 1 differ"} {
+		if !strings.Contains(out.String(), expected) {
+			t.Fatalf("expected %q in the output:\n%s", expected, out.String())
+		}
+	}
+}
+
+func TestDiffBody(t *testing.T) {
+	if diffs := diffBody(`{"a":1,"b":[{"id":1,"v":2}]}`, "{\n \"b\":[{\"v\":2,\"id\":7}],\"a\":1}", []string{"$.b[*].id"}); len(diffs) != 0 {
+		t.Fatalf("expected no differences, got %v", diffs)
+	}
+
+	diffs := diffBody(`{"a":1,"c":true}`, `{"a":"1","d":null}`, nil)
+	if len(diffs) != 3 {
+		t.Fatalf("expected 3 differences, got %v", diffs)
+	}
+
+	if diffs := diffBody("plain", "plain", nil); len(diffs) != 0 {
+		t.Fatalf("expected equal bodies, got %v", diffs)
+	}
+	if diffs := diffBody("plain", "other", nil); len(diffs) != 1 {
+		t.Fatalf("expected different bodies, got %v", diffs)
+	}
+}
+
+func TestReplayConfiguration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replay")
+	if err != nil {
+		t.Fatalf("could not prepare test %+v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	archive := filepath.Join(dir, "exchanges.har")
+	recorded := `{"log":{"version":"1.2","entries":[]}}`
+	if err := ioutil.WriteFile(archive, []byte(recorded), 0600); err != nil {
+		t.Fatalf("could not prepare test %+v", err)
+	}
+
+	conf := replayConfiguration(Configuration{
+		configDir:           dir,
+		Endpoint:            "http://localhost:8080",
+		ElasticSearchURL:    "http://localhost:9200",
+		RecordOutput:        archive,
+		RecordFormat:        "har",
+		ForwardTraffic:      true,
+		ExchangeReporterURL: "http://localhost:8081",
+		MirrorEndpoint:      "http://localhost:8082",
+		CacheTTL:            map[string]time.Duration{"getpatientbiographicaldata": time.Minute},
+	})
+	if conf.RecordOutput != "" || conf.ForwardTraffic || conf.MirrorEndpoint != "" || len(conf.CacheTTL) > 0 {
+		t.Fatalf("expected recording, forwarding, mirroring and caching to be disabled, got %+v", conf)
+	}
+
+	mon, err := newManager(conf)
+	if err != nil {
+		t.Fatalf("could not create monitor %+v", err)
+	}
+	if mon.mirror != nil || mon.responses != nil {
+		t.Fatal("expected no mirror and no cache")
+	}
+
+	data, err := ioutil.ReadFile(archive)
+	if err != nil || string(data) != recorded {
+		t.Fatalf("expected the replayed archive to stay untouched, got %s %+v", data, err)
+	}
+}
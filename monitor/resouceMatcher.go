@@ -23,6 +23,7 @@ import (
 	"fmt"
 	"regexp"
 	"sort"
+	"strings"
 
 	spec "github.com/DITAS-Project/blueprint-go"
 	lru "github.com/hashicorp/golang-lru"
@@ -67,6 +68,7 @@ func NewResoruceCache(blueprint *spec.BlueprintType) ResouceCache {
 
 type matcher struct {
 	base   *regexp.Regexp
+	exact  *regexp.Regexp
 	soruce string
 }
 type sorter []matcher
@@ -78,8 +80,15 @@ func (a sorter) Less(i, j int) bool { return len(a[i].soruce) > len(a[j].soruce)
 var templateMatcher = regexp.MustCompile("{[a-zA-Z0-9\\-_]*}")
 
 func compile(path string) matcher {
+	//the exact matcher only accepts the whole path, with the literal parts escaped
+	literals := templateMatcher.Split(path, -1)
+	for i, literal := range literals {
+		literals[i] = regexp.QuoteMeta(literal)
+	}
+
 	return matcher{
 		base:   regexp.MustCompile(templateMatcher.ReplaceAllString(path, "([a-zA-Z0-9\\-_%]*)")),
+		exact:  regexp.MustCompile("^" + strings.Join(literals, "([a-zA-Z0-9\\-_%]*)") + "/?$"),
 		soruce: path,
 	}
 }
@@ -88,6 +97,11 @@ func (m *matcher) Match(path string) bool {
 	return m.base.MatchString(path)
 }
 
+//MatchExact tells if the whole path matches the template of the operation
+func (m *matcher) MatchExact(path string) bool {
+	return m.exact.MatchString(path)
+}
+
 func (rc *ResouceCache) Get(path string, method string) (string, bool) {
 	if rc.cache != nil {
 		val, ok := rc.cache.Get(fmt.Sprintf("%s%s", method, path))
@@ -121,3 +135,22 @@ func (rc *ResouceCache) Match(path string, method string) (string, error) {
 
 	return "", errors.New("no match found in cache")
 }
+
+//MatchExact returns the operation whose path template matches the whole path, as used for authorization
+func (rc *ResouceCache) MatchExact(path string, method string) (string, error) {
+	key := "^" + path
+	if val, ok := rc.Get(key, method); ok {
+		return val, nil
+	}
+
+	for _, m := range rc.pathMatcher {
+		if m.MatchExact(path) {
+			if optID, ok := rc.schema[m.soruce][method]; ok {
+				rc.Add(key, method, optID)
+				return optID, nil
+			}
+		}
+	}
+
+	return "", errors.New("no exact match found in cache")
+}
@@ -0,0 +1,173 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+
+package monitor
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+//Credential fields of the Configuration are tagged with `secret:"true"`, or `secret:"url"`
+//for URLs that may carry credentials. Their values may reference environment variables
+//as ${NAME} or files as file://path, e.g., a kubernetes secret mount, and are redacted
+//whenever the configuration is logged or served.
+
+const redactedValue = "<redacted>"
+
+var envReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+//resolveSecrets replaces the environment and file references of all secret fields.
+//If ElasticPassword or ElasticAPIKey are not set, they are read from ElasticPasswordFile
+//and ElasticAPIKeyFile, or else from ELASTIC_PASSWORD and ELASTIC_API_KEY.
+func (conf *Configuration) resolveSecrets() error {
+	v := reflect.ValueOf(conf).Elem()
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Tag.Get("secret") == "" {
+			continue
+		}
+
+		field := v.Field(i)
+		switch field.Kind() {
+		case reflect.String:
+			value, err := conf.resolveSecret(field.String())
+			if err != nil {
+				return fmt.Errorf("%s: %v", t.Field(i).Name, err)
+			}
+			field.SetString(value)
+
+		case reflect.Map:
+			for _, key := range field.MapKeys() {
+				value, err := conf.resolveSecret(field.MapIndex(key).String())
+				if err != nil {
+					return fmt.Errorf("%s.%s: %v", t.Field(i).Name, key.String(), err)
+				}
+				field.SetMapIndex(key, reflect.ValueOf(value))
+			}
+		}
+	}
+
+	err := conf.fallbackSecret(&conf.ElasticPassword, conf.ElasticPasswordFile, "ELASTIC_PASSWORD")
+	if err != nil {
+		return fmt.Errorf("ElasticPasswordFile: %v", err)
+	}
+	err = conf.fallbackSecret(&conf.ElasticAPIKey, conf.ElasticAPIKeyFile, "ELASTIC_API_KEY")
+	if err != nil {
+		return fmt.Errorf("ElasticAPIKeyFile: %v", err)
+	}
+	return nil
+}
+
+//fallbackSecret sets an empty secret to the content of the file or else to the environment variable
+func (conf Configuration) fallbackSecret(secret *string, file string, env string) error {
+	if *secret != "" {
+		return nil
+	}
+
+	if file != "" {
+		value, err := conf.resolveSecret("file://" + file)
+		if err != nil {
+			return err
+		}
+		*secret = value
+		return nil
+	}
+
+	*secret = os.Getenv(env)
+	return nil
+}
+
+//resolveSecret reads file://path references, relative to the config directory,
+//and replaces ${NAME} with the value of the environment variable
+func (conf Configuration) resolveSecret(value string) (string, error) {
+	if strings.HasPrefix(value, "file://") {
+		data, err := ioutil.ReadFile(conf.configPath(strings.TrimPrefix(value, "file://")))
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+
+	var err error
+	resolved := envReference.ReplaceAllStringFunc(value, func(reference string) string {
+		name := envReference.FindStringSubmatch(reference)[1]
+		env, ok := os.LookupEnv(name)
+		if !ok && err == nil {
+			err = fmt.Errorf("environment variable %s is not set", name)
+		}
+		return env
+	})
+	return resolved, err
+}
+
+//redacted returns a copy of the configuration without secrets, for logging and the admin endpoint
+func (conf Configuration) redacted() Configuration {
+	v := reflect.ValueOf(&conf).Elem()
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		field := v.Field(i)
+
+		switch t.Field(i).Tag.Get("secret") {
+		case "true":
+			switch field.Kind() {
+			case reflect.String:
+				if field.String() != "" {
+					field.SetString(redactedValue)
+				}
+			case reflect.Map:
+				if field.Len() > 0 {
+					//the map is shared with the original configuration
+					masked := reflect.MakeMap(field.Type())
+					for _, key := range field.MapKeys() {
+						masked.SetMapIndex(key, reflect.ValueOf(redactedValue))
+					}
+					field.Set(masked)
+				}
+			}
+
+		case "url":
+			field.SetString(redactURL(field.String()))
+		}
+	}
+
+	return conf
+}
+
+//redactURL removes the password, or a token given as user, from a URL
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.User == nil {
+		return raw
+	}
+
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), "xxxxx")
+	} else {
+		u.User = url.User("xxxxx")
+	}
+	return u.String()
+}
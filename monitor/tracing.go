@@ -0,0 +1,253 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+package monitor
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	otlog "github.com/opentracing/opentracing-go/log"
+	zipkin "github.com/openzipkin/zipkin-go-opentracing"
+)
+
+//sampler decides if a new trace is recorded, either by a global ratio
+//or by a ratio configured for the operation of the request
+type sampler struct {
+	ratio      float64
+	operations map[string]float64
+}
+
+//newSampler creates the sampler for the configuration, if TracingFromBlueprint is set
+//all operations with a Tracing attribute in the blueprint are always sampled
+func newSampler(conf Configuration, blueprint *rawBlueprint) *sampler {
+	s := &sampler{
+		ratio:      conf.TracingSampleRatio,
+		operations: make(map[string]float64),
+	}
+
+	//viper lowercases the keys of TracingOperationSampleRatio, so operations are matched case-insensitively
+	if conf.TracingFromBlueprint {
+		for _, operationID := range blueprint.TracedOperations() {
+			s.operations[strings.ToLower(operationID)] = 1
+		}
+	}
+
+	for operationID, ratio := range conf.TracingOperationSampleRatio {
+		s.operations[strings.ToLower(operationID)] = ratio
+	}
+	return s
+}
+
+//Forced returns the sampling decision for operations that are always or never traced
+func (s *sampler) Forced(operationID string) (bool, bool) {
+	ratio, ok := s.operations[strings.ToLower(operationID)]
+	if !ok || (ratio > 0 && ratio < 1) {
+		return false, false
+	}
+	return ratio >= 1, true
+}
+
+//Sample makes a deterministic decision based on the (random) trace id
+func (s *sampler) Sample(id uint64, operationID string) bool {
+	ratio := s.ratio
+	if r, ok := s.operations[strings.ToLower(operationID)]; ok {
+		ratio = r
+	}
+
+	if ratio >= 1 {
+		return true
+	}
+	if ratio <= 0 {
+		return false
+	}
+	return id < uint64(ratio*math.MaxUint64)
+}
+
+func (mon *RequestMonitor) initTracing() error {
+	if !mon.conf.Opentracing {
+		return nil
+	}
+
+	mon.sampler = newSampler(mon.conf, mon.rawBlueprint)
+
+	switch strings.ToLower(mon.conf.TracingBackend) {
+	case "", "zipkin":
+		return mon.initZipkin()
+	case "otlp":
+		return mon.initOTLP()
+	}
+	return fmt.Errorf("unknown tracing backend %s", mon.conf.TracingBackend)
+}
+
+func (mon *RequestMonitor) initZipkin() error {
+	log.Info("opentracing active")
+	// Create our HTTP collector.
+	collector, err := zipkin.NewHTTPCollector(mon.conf.ZipkinEndpoint)
+	if err != nil {
+		log.Errorf("unable to create Zipkin HTTP collector: %+v\n", err)
+		return err
+	}
+
+	mon.tracingCollector = collector
+
+	// Create our recorder.
+	recorder := zipkin.NewRecorder(collector, false, "0.0.0.0:0", "request-monitor")
+
+	// Create our tracer.
+	traceSampler := mon.sampler
+	tracer, err := zipkin.NewTracer(
+		recorder,
+		zipkin.ClientServerSameSpan(true),
+		zipkin.TraceID128Bit(true),
+		zipkin.WithSampler(func(id uint64) bool {
+			return traceSampler.Sample(id, "")
+		}),
+	)
+	if err != nil {
+		log.Errorf("unable to create Zipkin tracer: %+v\n", err)
+		return err
+	}
+
+	// Explicitly set our tracer to be the default tracer.
+	opentracing.InitGlobalTracer(tracer)
+	return nil
+}
+
+func (mon *RequestMonitor) initOTLP() error {
+	log.Infof("opentracing active, exporting to %s", mon.conf.OTLPEndpoint)
+
+	exporter := newOTLPExporter(mon.conf)
+	exporter.Start()
+
+	tracer := newOTLPTracer(exporter, mon.sampler, mon.conf.TracingPropagation)
+	mon.tracingCollector = tracer
+
+	opentracing.InitGlobalTracer(tracer)
+	return nil
+}
+
+//startSpans creates a server span for the incoming request, continuing any trace
+//the client started, and a client span for the call to the VDC that is injected into the request
+func (mon *RequestMonitor) startSpans(req *http.Request, requestID string, operationID string) (opentracing.Span, opentracing.Span) {
+	tracer := opentracing.GlobalTracer()
+
+	parent, err := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(req.Header))
+	if err != nil && err != opentracing.ErrSpanContextNotFound {
+		log.Debugf("could not extract incoming trace context %+v", err)
+	}
+
+	opts := []opentracing.StartSpanOption{
+		ext.RPCServerOption(parent),
+		opentracing.Tag{Key: "ditas.operationID", Value: operationID},
+	}
+
+	//operations that must (not) be traced override the decision of the client
+	var priority *uint16
+	if mon.sampler != nil {
+		if sampled, forced := mon.sampler.Forced(operationID); forced {
+			p := uint16(0)
+			if sampled {
+				p = 1
+			}
+			priority = &p
+			opts = append(opts, opentracing.Tag{Key: string(ext.SamplingPriority), Value: p})
+		}
+	}
+
+	if tags := mon.rawBlueprint.Tags(operationID); len(tags) > 0 {
+		opts = append(opts, opentracing.Tag{Key: "ditas.tags", Value: strings.Join(tags, ",")})
+	}
+
+	serverSpan := tracer.StartSpan("VDC-Request", opts...)
+	//zipkin ignores the priority in the start options, it only changes the decision if the tag is set on the span
+	if priority != nil {
+		ext.SamplingPriority.Set(serverSpan, *priority)
+	}
+	ext.Component.Set(serverSpan, "request-monitor")
+	ext.HTTPMethod.Set(serverSpan, req.Method)
+	//the URL of the request already points to the upstream, so the URI the client requested is used
+	uri := req.RequestURI
+	if uri == "" {
+		uri = req.URL.String()
+	}
+	ext.HTTPUrl.Set(serverSpan, uri)
+	serverSpan.SetTag("peer.address", req.RemoteAddr)
+	serverSpan.SetTag("ditas.requestID", requestID)
+	serverSpan.SetTag("http.request_size", req.ContentLength)
+
+	clientSpan := tracer.StartSpan("VDC-Upstream", opentracing.ChildOf(serverSpan.Context()))
+	ext.SpanKindRPCClient.Set(clientSpan)
+	ext.Component.Set(clientSpan, "request-monitor")
+	ext.HTTPMethod.Set(clientSpan, req.Method)
+	clientSpan.SetTag("ditas.operationID", operationID)
+
+	err = tracer.Inject(clientSpan.Context(), opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(req.Header))
+	if err != nil {
+		log.Debugf("could not inject trace context %+v", err)
+	}
+
+	return serverSpan, clientSpan
+}
+
+//finishSpans tags both spans with the outcome of the request and finishes them
+func finishSpans(serverSpan opentracing.Span, clientSpan opentracing.Span, rec *responseRecorder) {
+	for _, span := range []opentracing.Span{clientSpan, serverSpan} {
+		ext.HTTPStatusCode.Set(span, uint16(rec.StatusCode()))
+		span.SetTag("http.response_size", rec.Written())
+		if rec.StatusCode() >= http.StatusInternalServerError {
+			ext.Error.Set(span, true)
+		}
+		span.Finish()
+	}
+}
+
+//spanError records a proxy error on the span of the request, if any
+func spanError(req *http.Request, err error) {
+	if span := opentracing.SpanFromContext(req.Context()); span != nil {
+		ext.Error.Set(span, true)
+		span.LogFields(otlog.Error(err))
+	}
+}
+
+//traceIDFromHeaders returns the trace id of a propagated trace context
+func traceIDFromHeaders(header http.Header) string {
+	if id := header.Get("X-B3-TraceId"); id != "" {
+		return id
+	}
+
+	//W3C trace context: version-traceid-spanid-flags
+	if parent := header.Get("traceparent"); len(parent) >= 35 {
+		return parent[3:35]
+	}
+	return ""
+}
+
+//traceID returns the id of the trace a span belongs to
+func traceID(span opentracing.Span) string {
+	header := make(http.Header)
+	err := span.Tracer().Inject(span.Context(), opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(header))
+	if err != nil {
+		return ""
+	}
+	return traceIDFromHeaders(header)
+}
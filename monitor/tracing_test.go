@@ -0,0 +1,209 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+package monitor
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	zipkin "github.com/openzipkin/zipkin-go-opentracing"
+)
+
+func TestRequestMonitor_startSpans(t *testing.T) {
+	tracer := mocktracer.New()
+	opentracing.SetGlobalTracer(tracer)
+	defer opentracing.SetGlobalTracer(opentracing.NoopTracer{})
+
+	//simulate a client that already started a trace
+	parent := tracer.StartSpan("client")
+	req := httptest.NewRequest("GET", "/patient/1?fields=name", nil)
+	tracer.Inject(parent.Context(), opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(req.Header))
+	//serve routes the request to the upstream before the spans are started
+	req.URL, _ = url.Parse("http://vdc:8080")
+
+	mon := RequestMonitor{}
+	serverSpan, clientSpan := mon.startSpans(req, "req-1", "getPatientBiographicalData")
+
+	rec := newResponseRecorder(httptest.NewRecorder())
+	rec.WriteHeader(http.StatusBadGateway)
+	rec.Write([]byte("Bad Gateway"))
+	finishSpans(serverSpan, clientSpan, rec)
+
+	spans := tracer.FinishedSpans()
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 finished spans got %d", len(spans))
+	}
+
+	client, server := spans[0], spans[1]
+	parentCtx := parent.Context().(mocktracer.MockSpanContext)
+	if server.ParentID != parentCtx.SpanID || server.SpanContext.TraceID != parentCtx.TraceID {
+		t.Fatal("server span does not continue the incoming trace")
+	}
+	if client.ParentID != server.SpanContext.SpanID {
+		t.Fatal("client span is not a child of the server span")
+	}
+
+	if server.Tag("ditas.operationID") != "getPatientBiographicalData" {
+		t.Fatalf("missing operationID tag %v", server.Tags())
+	}
+	if server.Tag("http.url") != "/patient/1?fields=name" {
+		t.Fatalf("expected the requested URI to be tagged, got %v", server.Tag("http.url"))
+	}
+	if client.Tag("http.status_code") != uint16(http.StatusBadGateway) || client.Tag("error") != true {
+		t.Fatalf("missing status tags %v", client.Tags())
+	}
+	if server.Tag("http.response_size") != int64(11) {
+		t.Fatalf("missing size tag %v", server.Tags())
+	}
+}
+
+func TestTraceIDFromHeaders(t *testing.T) {
+	header := make(http.Header)
+	header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if id := traceIDFromHeaders(header); id != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Fatalf("unexpected trace id %s", id)
+	}
+
+	header.Set("X-B3-TraceId", "463ac35c9f6413ad")
+	if id := traceIDFromHeaders(header); id != "463ac35c9f6413ad" {
+		t.Fatalf("unexpected trace id %s", id)
+	}
+}
+
+func TestBlueprintSampling(t *testing.T) {
+	raw, err := readRawBlueprint(filepath.Join("..", "resources", "blueprint.json"))
+	if err != nil {
+		t.Fatalf("could not read blueprint %+v", err)
+	}
+
+	conf := Configuration{
+		TracingSampleRatio:          0.1,
+		TracingFromBlueprint:        true,
+		TracingOperationSampleRatio: map[string]float64{"getBloodTestComponentAverage": 0},
+	}
+
+	tracer := mocktracer.New()
+	opentracing.SetGlobalTracer(tracer)
+	defer opentracing.SetGlobalTracer(opentracing.NoopTracer{})
+
+	mon := RequestMonitor{conf: conf, rawBlueprint: raw, sampler: newSampler(conf, raw)}
+
+	tests := []struct {
+		operationID string
+		priority    interface{}
+	}{
+		{"getPatientBiographicalData", uint16(1)},
+		{"getBloodTestComponentAverage", uint16(0)},
+		{"unknownOperation", nil},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		serverSpan, _ := mon.startSpans(req, "req-1", test.operationID)
+		span := serverSpan.(*mocktracer.MockSpan)
+		if span.Tag("sampling.priority") != test.priority {
+			t.Fatalf("%s: expected priority %v got %v", test.operationID, test.priority, span.Tag("sampling.priority"))
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	serverSpan, _ := mon.startSpans(req, "req-1", "getLastValuesForBloodTest")
+	if tags := serverSpan.(*mocktracer.MockSpan).Tag("ditas.tags"); tags != "OSR,patient,hospital,blood,test" {
+		t.Fatalf("unexpected blueprint tags %v", tags)
+	}
+}
+
+func TestZipkinSampling(t *testing.T) {
+	conf := Configuration{
+		TracingSampleRatio:          0.5,
+		TracingOperationSampleRatio: map[string]float64{"getBloodTestComponentAverage": 0, "getPatientBiographicalData": 1},
+	}
+	mon := RequestMonitor{conf: conf, sampler: newSampler(conf, nil)}
+	defer opentracing.SetGlobalTracer(opentracing.NoopTracer{})
+
+	tests := []struct {
+		operationID string
+		sampleNew   bool
+		sampled     bool
+	}{
+		{"getPatientBiographicalData", false, true},
+		{"getBloodTestComponentAverage", true, false},
+		{"getLastValuesForBloodTest", true, true},
+		{"getLastValuesForBloodTest", false, false},
+	}
+
+	for _, test := range tests {
+		sampleNew := test.sampleNew
+		tracer, err := zipkin.NewTracer(
+			zipkin.NewInMemoryRecorder(),
+			zipkin.ClientServerSameSpan(true),
+			zipkin.TraceID128Bit(true),
+			zipkin.WithSampler(func(id uint64) bool { return sampleNew }),
+		)
+		if err != nil {
+			t.Fatalf("could not create tracer %+v", err)
+		}
+		opentracing.SetGlobalTracer(tracer)
+
+		serverSpan, clientSpan := mon.startSpans(httptest.NewRequest("GET", "/", nil), "req-1", test.operationID)
+		if sampled := serverSpan.Context().(zipkin.SpanContext).Sampled; sampled != test.sampled {
+			t.Fatalf("%s: expected the server span sampled to be %t got %t", test.operationID, test.sampled, sampled)
+		}
+		if sampled := clientSpan.Context().(zipkin.SpanContext).Sampled; sampled != test.sampled {
+			t.Fatalf("%s: expected the client span sampled to be %t got %t", test.operationID, test.sampled, sampled)
+		}
+	}
+}
+
+func TestSamplerFromConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tracing")
+	if err != nil {
+		t.Fatalf("could not prepare test %+v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	//viper lowercases the operationIDs of the config file
+	conf, err := loadConfig(t, dir, `{
+		"Endpoint": "http://localhost:8080",
+		"ElasticSearchURL": "http://localhost:9200",
+		"TracingSampleRatio": 0.5,
+		"TracingOperationSampleRatio": {"getBloodTestComponentAverage": 0, "getPatientBiographicalData": 1}
+	}`)
+	if err != nil {
+		t.Fatalf("could not read config %+v", err)
+	}
+
+	s := newSampler(conf, nil)
+	if sampled, forced := s.Forced("getBloodTestComponentAverage"); !forced || sampled {
+		t.Fatal("expected getBloodTestComponentAverage never to be sampled")
+	}
+	if sampled, forced := s.Forced("getPatientBiographicalData"); !forced || !sampled {
+		t.Fatal("expected getPatientBiographicalData always to be sampled")
+	}
+	if s.Sample(1, "getBloodTestComponentAverage") || !s.Sample(^uint64(0), "getPatientBiographicalData") {
+		t.Fatal("expected the ratios of the config to apply")
+	}
+}
@@ -0,0 +1,423 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+
+package monitor
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/sirupsen/logrus"
+)
+
+//trafficRecorder writes complete exchanges to a local archive, so they can be replayed against another VDC
+type trafficRecorder struct {
+	Queue   chan exchangeMessage
+	Archive exchangeArchive
+	pool    *workerPool
+}
+
+//exchangeArchive is a file format for recorded exchanges
+type exchangeArchive interface {
+	Write(exchange exchangeMessage) error
+	Close() error
+}
+
+//newTrafficRecorder creates a recorder that writes to RecordOutput, NDJSON archives are appended to,
+//HAR archives are a single document and therefore replaced
+func newTrafficRecorder(conf Configuration, queue chan exchangeMessage) (trafficRecorder, error) {
+	path := conf.configPath(conf.RecordOutput)
+
+	var archive exchangeArchive
+	switch strings.ToLower(conf.RecordFormat) {
+	case "", "ndjson":
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			log.Errorf("could not open record archive %+v", err)
+			return trafficRecorder{}, err
+		}
+		archive = newNDJSONArchive(file)
+	case "har":
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+		if err != nil {
+			log.Errorf("could not open record archive %+v", err)
+			return trafficRecorder{}, err
+		}
+		archive, err = newHARArchive(file, conf.endpointURL)
+		if err != nil {
+			file.Close()
+			return trafficRecorder{}, err
+		}
+	default:
+		return trafficRecorder{}, fmt.Errorf("unknown record format %s", conf.RecordFormat)
+	}
+
+	pool, err := newWorkerPool(conf, "record")
+	if err != nil {
+		archive.Close()
+		return trafficRecorder{}, err
+	}
+
+	return trafficRecorder{
+		Queue:   queue,
+		Archive: archive,
+		pool:    pool,
+	}, nil
+}
+
+//Start creates the worker processes that write the archive,
+//the archive is closed once all workers stopped
+func (tr *trafficRecorder) Start() {
+	tr.pool.Start(tr.Queue, func(queue interface{}, wlog *logrus.Entry) {
+		tr.work(queue.(chan exchangeMessage), wlog)
+	}, func() {
+		err := tr.Archive.Close()
+		if err != nil {
+			log.Errorf("could not close record archive %+v", err)
+		}
+	})
+}
+
+func (tr *trafficRecorder) work(queue chan exchangeMessage, wlog *logrus.Entry) {
+	for {
+		select {
+		case exchange := <-queue:
+			err := tr.Archive.Write(exchange)
+			if err != nil {
+				wlog.Errorf("failed to record exchange %+v", err)
+				metrics.Add("request_monitor_record_failed_total", 1)
+				continue
+			}
+			metrics.Add("request_monitor_record_written_total", 1)
+		case <-tr.pool.Done():
+			wlog.Info("recorder worker stopping")
+			return
+		}
+	}
+}
+
+//Stop terminates this Worker
+func (tr *trafficRecorder) Stop() {
+	tr.pool.Stop()
+}
+
+//ndjsonArchive stores one exchange message per line, the same format the exchange reporter sends
+type ndjsonArchive struct {
+	lock    sync.Mutex
+	output  io.WriteCloser
+	encoder *json.Encoder
+}
+
+func newNDJSONArchive(output io.WriteCloser) *ndjsonArchive {
+	return &ndjsonArchive{output: output, encoder: json.NewEncoder(output)}
+}
+
+func (na *ndjsonArchive) Write(exchange exchangeMessage) error {
+	na.lock.Lock()
+	defer na.lock.Unlock()
+	return na.encoder.Encode(exchange)
+}
+
+func (na *ndjsonArchive) Close() error {
+	na.lock.Lock()
+	defer na.lock.Unlock()
+	return na.output.Close()
+}
+
+//harArchive streams the exchanges as HTTP Archive 1.2, the entries are only
+//a valid document after Close wrote the end of the entry list
+type harArchive struct {
+	lock    sync.Mutex
+	output  io.WriteCloser
+	base    *url.URL
+	entries int
+}
+
+func newHARArchive(output io.WriteCloser, base *url.URL) (*harArchive, error) {
+	_, err := fmt.Fprintf(output, `{"log":{"version":"1.2","creator":{"name":"request-monitor","version":"1.0"},"entries":[`)
+	if err != nil {
+		return nil, err
+	}
+	return &harArchive{output: output, base: base}, nil
+}
+
+func (ha *harArchive) Write(exchange exchangeMessage) error {
+	data, err := json.Marshal(newHAREntry(exchange, ha.base))
+	if err != nil {
+		return err
+	}
+
+	ha.lock.Lock()
+	defer ha.lock.Unlock()
+	if ha.entries > 0 {
+		data = append([]byte(",\n"), data...)
+	} else {
+		data = append([]byte("\n"), data...)
+	}
+	_, err = ha.output.Write(data)
+	if err == nil {
+		ha.entries++
+	}
+	return err
+}
+
+func (ha *harArchive) Close() error {
+	ha.lock.Lock()
+	defer ha.lock.Unlock()
+
+	_, err := fmt.Fprint(ha.output, "\n]}}\n")
+	if err != nil {
+		ha.output.Close()
+		return err
+	}
+	return ha.output.Close()
+}
+
+type harFile struct {
+	Log *harLog `json:"log"`
+}
+
+type harLog struct {
+	Version string     `json:"version"`
+	Entries []harEntry `json:"entries"`
+}
+
+//harEntry is a HAR 1.2 entry, monitor specific fields start with an underscore as required by the spec
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+
+	RequestID   string `json:"_requestID,omitempty"`
+	OperationID string `json:"_operationID,omitempty"`
+	Client      string `json:"_client,omitempty"`
+	Principal   string `json:"_principal,omitempty"`
+	TraceID     string `json:"_traceID,omitempty"`
+}
+
+type harRequest struct {
+	Method      string       `json:"method"`
+	URL         string       `json:"url"`
+	HTTPVersion string       `json:"httpVersion"`
+	Cookies     []harPair    `json:"cookies"`
+	Headers     []harPair    `json:"headers"`
+	QueryString []harPair    `json:"queryString"`
+	PostData    *harPostData `json:"postData,omitempty"`
+	HeadersSize int          `json:"headersSize"`
+	BodySize    int64        `json:"bodySize"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Encoding string `json:"_encoding,omitempty"`
+}
+
+type harResponse struct {
+	Status      int        `json:"status"`
+	StatusText  string     `json:"statusText"`
+	HTTPVersion string     `json:"httpVersion"`
+	Cookies     []harPair  `json:"cookies"`
+	Headers     []harPair  `json:"headers"`
+	Content     harContent `json:"content"`
+	RedirectURL string     `json:"redirectURL"`
+	HeadersSize int        `json:"headersSize"`
+	BodySize    int64      `json:"bodySize"`
+}
+
+type harContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+type harPair struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+//newHAREntry converts an exchange, the URL is the one the request was forwarded to
+func newHAREntry(exchange exchangeMessage, base *url.URL) harEntry {
+	uri := exchange.requestURI()
+	target := uri
+	if base != nil {
+		target = fmt.Sprintf("%s://%s%s", base.Scheme, base.Host, uri)
+	}
+
+	query := make([]harPair, 0)
+	if u, err := url.Parse(uri); err == nil {
+		for name, values := range u.Query() {
+			for _, value := range values {
+				query = append(query, harPair{Name: name, Value: value})
+			}
+		}
+	}
+	sort.Slice(query, func(i, j int) bool { return query[i].Name < query[j].Name })
+
+	duration := float64(exchange.RequestTime) / float64(time.Millisecond)
+	entry := harEntry{
+		StartedDateTime: exchange.Timestamp.Format(time.RFC3339Nano),
+		Time:            duration,
+		Request: harRequest{
+			Method:      exchange.Kind,
+			URL:         target,
+			HTTPVersion: "HTTP/1.1",
+			Cookies:     make([]harPair, 0),
+			Headers:     harHeaders(exchange.RequestHeader),
+			QueryString: query,
+			HeadersSize: -1,
+			BodySize:    int64(len(exchange.RequestBody)),
+		},
+		Response: harResponse{
+			Status:      exchange.ResponseCode,
+			StatusText:  http.StatusText(exchange.ResponseCode),
+			HTTPVersion: "HTTP/1.1",
+			Cookies:     make([]harPair, 0),
+			Headers:     harHeaders(exchange.ResponseHeader),
+			Content: harContent{
+				Size:     int64(len(exchange.ResponseBody)),
+				MimeType: exchange.ResponseHeader.Get("Content-Type"),
+			},
+			HeadersSize: -1,
+			BodySize:    int64(len(exchange.ResponseBody)),
+		},
+		Timings: harTimings{
+			Wait: duration,
+		},
+		RequestID:   exchange.RequestID,
+		OperationID: exchange.OperationID,
+		Client:      exchange.Client,
+		Principal:   exchange.Principal,
+		TraceID:     exchange.TraceID,
+	}
+
+	if exchange.RequestBody != "" {
+		text, encoding := encodeBody(exchange.RequestBody)
+		entry.Request.PostData = &harPostData{
+			MimeType: exchange.RequestHeader.Get("Content-Type"),
+			Text:     text,
+			Encoding: encoding,
+		}
+	}
+	entry.Response.Content.Text, entry.Response.Content.Encoding = encodeBody(exchange.ResponseBody)
+
+	return entry
+}
+
+//exchange converts the entry back into the exchange it was recorded from
+func (entry harEntry) exchange() (exchangeMessage, error) {
+	u, err := url.Parse(entry.Request.URL)
+	if err != nil {
+		return exchangeMessage{}, err
+	}
+
+	exchange := exchangeMessage{
+		RequestID:      entry.RequestID,
+		RequestURI:     u.RequestURI(),
+		RequestHeader:  fromHARHeaders(entry.Request.Headers),
+		ResponseHeader: fromHARHeaders(entry.Response.Headers),
+	}
+	exchange.Timestamp, _ = time.Parse(time.RFC3339Nano, entry.StartedDateTime)
+	exchange.OperationID = entry.OperationID
+	exchange.Kind = entry.Request.Method
+	exchange.Method = u.Path
+	exchange.Client = entry.Client
+	exchange.Principal = entry.Principal
+	exchange.TraceID = entry.TraceID
+	exchange.RequestTime = time.Duration(entry.Time * float64(time.Millisecond))
+	exchange.ResponseCode = entry.Response.Status
+
+	if entry.Request.PostData != nil {
+		exchange.RequestBody, err = decodeBody(entry.Request.PostData.Text, entry.Request.PostData.Encoding)
+		if err != nil {
+			return exchangeMessage{}, err
+		}
+		exchange.RequestLenght = int64(len(exchange.RequestBody))
+	}
+	exchange.ResponseBody, err = decodeBody(entry.Response.Content.Text, entry.Response.Content.Encoding)
+	if err != nil {
+		return exchangeMessage{}, err
+	}
+	exchange.ResponseLength = int64(len(exchange.ResponseBody))
+
+	return exchange, nil
+}
+
+//requestURI returns the path and query of the request, older messages only contain the path
+func (ex exchangeMessage) requestURI() string {
+	if ex.RequestURI != "" {
+		return ex.RequestURI
+	}
+	return ex.Method
+}
+
+func harHeaders(header http.Header) []harPair {
+	pairs := make([]harPair, 0, len(header))
+	for name, values := range header {
+		for _, value := range values {
+			pairs = append(pairs, harPair{Name: name, Value: value})
+		}
+	}
+	sort.SliceStable(pairs, func(i, j int) bool { return pairs[i].Name < pairs[j].Name })
+	return pairs
+}
+
+func fromHARHeaders(pairs []harPair) http.Header {
+	header := make(http.Header)
+	for _, pair := range pairs {
+		header.Add(pair.Name, pair.Value)
+	}
+	return header
+}
+
+//encodeBody returns the HAR text of a body, binary bodies are base64 encoded
+func encodeBody(body string) (string, string) {
+	if utf8.ValidString(body) {
+		return body, ""
+	}
+	return base64.StdEncoding.EncodeToString([]byte(body)), "base64"
+}
+
+func decodeBody(text string, encoding string) (string, error) {
+	if encoding != "base64" {
+		return text, nil
+	}
+	body, err := base64.StdEncoding.DecodeString(text)
+	return string(body), err
+}
@@ -0,0 +1,165 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+
+package monitor
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTrafficRecorder(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"ssn":"42"}`))
+	}))
+	defer upstream.Close()
+
+	dir, err := ioutil.TempDir("", "record")
+	if err != nil {
+		t.Fatalf("could not prepare test %+v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, format := range []string{"ndjson", "har"} {
+		mon := newProxyStandIn(t, Configuration{
+			configDir:        dir,
+			RecordOutput:     "record." + format,
+			RecordFormat:     format,
+			RecordOperations: []string{"getpatientbiographicaldata"},
+		}, upstream.URL)
+
+		recorder, err := newTrafficRecorder(mon.conf, mon.recordQueue)
+		if err != nil {
+			t.Fatalf("could not create recorder %+v", err)
+		}
+		recorder.Start()
+
+		req := httptest.NewRequest("GET", "/patient/42?fields=name", nil)
+		req.Header.Set("Accept", "application/json")
+		mon.serve(httptest.NewRecorder(), req)
+
+		//not a recorded operation
+		mon.serve(httptest.NewRecorder(), httptest.NewRequest("GET", "/unknown", nil))
+
+		for i := 0; i < 100 && len(mon.recordQueue) > 0; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		recorder.Stop()
+		recorder.pool.Wait(time.Second)
+
+		records, err := readExchanges(filepath.Join(dir, "record."+format))
+		if err != nil {
+			t.Fatalf("%s: could not read archive %+v", format, err)
+		}
+		if len(records) != 1 {
+			t.Fatalf("%s: expected 1 recorded exchange, got %d", format, len(records))
+		}
+
+		record := records[0]
+		if record.OperationID != "getPatientBiographicalData" || record.Kind != "GET" || record.requestURI() != "/patient/42?fields=name" {
+			t.Fatalf("%s: unexpected request %s %s %s", format, record.OperationID, record.Kind, record.requestURI())
+		}
+		if record.RequestHeader.Get("Accept") != "application/json" || record.RequestHeader.Get("X-DITAS-RequestID") != "" {
+			t.Fatalf("%s: expected the request header as received by the proxy, got %v", format, record.RequestHeader)
+		}
+		if record.ResponseCode != http.StatusCreated || record.ResponseBody != `{"ssn":"42"}` || record.ResponseHeader.Get("Content-Type") != "application/json" {
+			t.Fatalf("%s: unexpected response %d %s %v", format, record.ResponseCode, record.ResponseBody, record.ResponseHeader)
+		}
+		if record.RequestID == "" || record.Timestamp.IsZero() {
+			t.Fatalf("%s: expected id and timestamp to be recorded", format)
+		}
+	}
+}
+
+func TestHAREntryBinaryBody(t *testing.T) {
+	exchange := exchangeMessage{
+		RequestURI:   "/upload?name=a",
+		RequestBody:  "\xff\x00binary",
+		ResponseBody: "ok",
+	}
+	exchange.Kind = "POST"
+	exchange.ResponseCode = 200
+
+	entry := newHAREntry(exchange, nil)
+	if entry.Request.PostData == nil || entry.Request.PostData.Encoding != "base64" {
+		t.Fatalf("expected a base64 encoded body, got %+v", entry.Request.PostData)
+	}
+	if len(entry.Request.QueryString) != 1 || entry.Request.QueryString[0].Value != "a" {
+		t.Fatalf("expected the query string, got %+v", entry.Request.QueryString)
+	}
+
+	restored, err := entry.exchange()
+	if err != nil {
+		t.Fatalf("could not restore exchange %+v", err)
+	}
+	if restored.RequestBody != exchange.RequestBody || restored.ResponseBody != "ok" || !strings.HasPrefix(restored.RequestURI, "/upload") {
+		t.Fatalf("exchange not restored %+v", restored)
+	}
+}
+
+func TestRecordedCredentials(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{}`))
+	}))
+	defer upstream.Close()
+
+	record := func(conf Configuration) exchangeMessage {
+		conf.RecordOutput = "exchanges.ndjson"
+		conf.AuthAPIKeyHeader = "X-Token"
+		mon := newProxyStandIn(t, conf, upstream.URL)
+
+		req := httptest.NewRequest("GET", "/patient/42", nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		req.Header.Set("X-Token", "key-1")
+		req.Header.Set("Accept", "application/json")
+		mon.serve(httptest.NewRecorder(), req)
+
+		if len(mon.recordQueue) != 1 {
+			t.Fatalf("expected one recorded exchange, got %d", len(mon.recordQueue))
+		}
+		return <-mon.recordQueue
+	}
+
+	recorded := record(Configuration{})
+	header := recorded.RequestHeader
+	if header.Get("Authorization") != redactedValue || header.Get("X-Token") != redactedValue || header.Get("Accept") != "application/json" {
+		t.Fatalf("expected the credentials to be redacted, got %v", header)
+	}
+
+	req, err := recorded.request()
+	if err != nil {
+		t.Fatalf("could not recreate request %+v", err)
+	}
+	if _, ok := req.Header["Authorization"]; ok || req.Header.Get("Accept") != "application/json" {
+		t.Fatalf("expected redacted credentials not to be replayed, got %v", req.Header)
+	}
+
+	header = record(Configuration{RecordCredentials: true}).RequestHeader
+	if header.Get("Authorization") != "Bearer secret" || header.Get("X-Token") != "key-1" {
+		t.Fatalf("expected the credentials to be kept, got %v", header)
+	}
+}
@@ -0,0 +1,149 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+package monitor
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"time"
+)
+
+//newUpstreamTransport creates the transport used by oxy to reach the VDC,
+//using the upstream TLS settings of the configuration
+func newUpstreamTransport(conf Configuration) (*http.Transport, error) {
+	tlsConfig, err := upstreamTLSConfig(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		TLSClientConfig:       tlsConfig,
+	}, nil
+}
+
+//newSecondaryTransport creates the transport to another VDC, e.g., a canary, using the
+//upstream TLS settings except UpstreamServerName, which only applies to the Endpoint
+func newSecondaryTransport(conf Configuration) (*http.Transport, error) {
+	transport, err := newUpstreamTransport(conf)
+	if err != nil {
+		return nil, err
+	}
+	transport.TLSClientConfig.ServerName = ""
+	return transport, nil
+}
+
+func upstreamTLSConfig(conf Configuration) (*tls.Config, error) {
+	tlsConfig, err := loadTLSConfig(conf, conf.UpstreamCAFile, conf.UpstreamClientCert, conf.UpstreamClientKey)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.ServerName = conf.UpstreamServerName
+
+	if conf.UpstreamMinTLSVersion != "" {
+		version, err := parseTLSVersion(conf.UpstreamMinTLSVersion)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.MinVersion = version
+	}
+
+	return tlsConfig, nil
+}
+
+//loadTLSConfig creates a client tls config with an optional CA file and client certificate,
+//relative paths are resolved against the config directory
+func loadTLSConfig(conf Configuration, caFile string, certFile string, keyFile string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(conf.configPath(caFile))
+		if err != nil {
+			log.Errorf("could not read CA file %+v", err)
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return nil, fmt.Errorf("client certificate and key must be set together")
+		}
+
+		cert, err := tls.LoadX509KeyPair(conf.configPath(certFile), conf.configPath(keyFile))
+		if err != nil {
+			log.Errorf("could not load client certificate %+v", err)
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+//parseTLSVersion converts a version string like "1.2" to the crypto/tls constant
+func parseTLSVersion(version string) (uint16, error) {
+	if v, ok := tlsVersions[version]; ok {
+		return v, nil
+	}
+	return 0, fmt.Errorf("unknown TLS version %s", version)
+}
+
+//tlsVersionName converts a crypto/tls version constant into a string like "1.2"
+func tlsVersionName(version uint16) string {
+	for name, v := range tlsVersions {
+		if v == version {
+			return name
+		}
+	}
+	return fmt.Sprintf("0x%04x", version)
+}
+
+//configPath resolves relative file names against the config directory
+func (conf Configuration) configPath(file string) string {
+	if file == "" || filepath.IsAbs(file) {
+		return file
+	}
+	return filepath.Join(conf.configDir, file)
+}
@@ -0,0 +1,71 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+package monitor
+
+import (
+	"crypto/tls"
+	"path/filepath"
+	"testing"
+)
+
+func TestUpstreamTLSConfig(t *testing.T) {
+	conf := Configuration{
+		configDir:             filepath.Join("..", ".config"),
+		UpstreamCAFile:        "cert.pem",
+		UpstreamClientCert:    "cert.pem",
+		UpstreamClientKey:     "key.pem",
+		UpstreamServerName:    "vdc.local",
+		UpstreamMinTLSVersion: "1.2",
+	}
+
+	tlsConfig, err := upstreamTLSConfig(conf)
+	if err != nil {
+		t.Fatalf("could not build upstream tls config %+v", err)
+	}
+
+	if tlsConfig.MinVersion != tls.VersionTLS12 {
+		t.Fatalf("expected min version 1.2 got %s", tlsVersionName(tlsConfig.MinVersion))
+	}
+
+	if tlsConfig.ServerName != "vdc.local" {
+		t.Fatalf("expected server name vdc.local got %s", tlsConfig.ServerName)
+	}
+
+	if tlsConfig.RootCAs == nil || len(tlsConfig.Certificates) != 1 {
+		t.Fatal("expected CA pool and client certificate to be loaded")
+	}
+}
+
+func TestUpstreamTLSConfigErrors(t *testing.T) {
+	conf := Configuration{
+		configDir:             filepath.Join("..", ".config"),
+		UpstreamMinTLSVersion: "2.0",
+	}
+	if _, err := upstreamTLSConfig(conf); err == nil {
+		t.Fatal("expected an error for an unknown TLS version")
+	}
+
+	conf = Configuration{
+		configDir:          filepath.Join("..", ".config"),
+		UpstreamClientCert: "cert.pem",
+	}
+	if _, err := upstreamTLSConfig(conf); err == nil {
+		t.Fatal("expected an error for a client cert without key")
+	}
+}
@@ -0,0 +1,259 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+
+package monitor
+
+import (
+	"fmt"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+//settingKeys are read from the config file but are not part of the Configuration
+var settingKeys = []string{"verbose"}
+
+//configErrors collects all problems of a configuration
+type configErrors []string
+
+func (ce configErrors) Error() string {
+	return "invalid configuration:\n  " + strings.Join(ce, "\n  ")
+}
+
+func (ce *configErrors) add(format string, args ...interface{}) {
+	*ce = append(*ce, fmt.Sprintf(format, args...))
+}
+
+//oneOf checks that value is empty or one of the allowed values
+func (ce *configErrors) oneOf(name string, value string, allowed ...string) {
+	if value == "" {
+		return
+	}
+	for _, a := range allowed {
+		if strings.EqualFold(value, a) {
+			return
+		}
+	}
+	ce.add("%s must be one of %s, got %q", name, strings.Join(allowed, ", "), value)
+}
+
+//pair checks that a certificate is configured together with its key
+func (ce *configErrors) pair(certName string, cert string, keyName string, key string) {
+	if (cert == "") != (key == "") {
+		ce.add("%s and %s must be set together", certName, keyName)
+	}
+}
+
+//checkConfigKeys rejects keys of the config file that are not part of the Configuration,
+//viper would otherwise silently ignore typos
+func checkConfigKeys(file string) error {
+	v := viper.New()
+	v.SetConfigFile(file)
+	err := v.ReadInConfig()
+	if err != nil {
+		return err
+	}
+
+	known := configKeys()
+	var errs configErrors
+	for _, key := range v.AllKeys() {
+		top := strings.SplitN(key, ".", 2)[0]
+		if _, ok := known[top]; ok {
+			continue
+		}
+
+		if suggestion := closestKey(top, known); suggestion != "" {
+			errs.add("unknown key %q, did you mean %q?", top, suggestion)
+		} else {
+			errs.add("unknown key %q", top)
+		}
+	}
+
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return errs
+	}
+	return nil
+}
+
+//configKeys maps the lower case keys of the config file to the field names
+func configKeys() map[string]string {
+	keys := make(map[string]string)
+	t := reflect.TypeOf(Configuration{})
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).PkgPath == "" {
+			keys[strings.ToLower(t.Field(i).Name)] = t.Field(i).Name
+		}
+	}
+	for _, key := range settingKeys {
+		keys[key] = key
+	}
+	return keys
+}
+
+//closestKey returns a known key within an edit distance of two
+func closestKey(key string, known map[string]string) string {
+	best, bestDistance := "", 3
+	for lower, name := range known {
+		if d := editDistance(key, lower); d < bestDistance || (d == bestDistance && name < best) {
+			best, bestDistance = name, d
+		}
+	}
+	return best
+}
+
+func editDistance(a string, b string) int {
+	previous := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		current := make([]int, len(b)+1)
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min3(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous = current
+	}
+	return previous[len(b)]
+}
+
+func min3(a int, b int, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+//Validate checks the values of the configuration and the dependencies between them
+func (conf Configuration) Validate() error {
+	var errs configErrors
+
+	if u, err := url.Parse(conf.Endpoint); err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		errs.add("Endpoint must be an absolute http(s) URL, got %q", conf.Endpoint)
+	}
+	if conf.ElasticSearchURL == "" {
+		errs.add("ElasticSearchURL is required")
+	}
+
+	if conf.ForwardTraffic && conf.ExchangeReporterURL == "" {
+		errs.add("ForwardTraffic requires ExchangeReporterURL")
+	}
+	errs.pair("ExchangeClientCert", conf.ExchangeClientCert, "ExchangeClientKey", conf.ExchangeClientKey)
+
+	errs.oneOf("TracingBackend", conf.TracingBackend, "zipkin", "otlp")
+	if conf.Opentracing && strings.ToLower(conf.TracingBackend) == "zipkin" && conf.ZipkinEndpoint == "" {
+		errs.add("Opentracing with the zipkin backend requires ZipkinEndpoint")
+	}
+	if conf.Opentracing && strings.ToLower(conf.TracingBackend) == "otlp" && conf.OTLPEndpoint == "" {
+		errs.add("Opentracing with the otlp backend requires OTLPEndpoint")
+	}
+	for _, propagation := range conf.TracingPropagation {
+		errs.oneOf("TracingPropagation", propagation, "w3c", "b3")
+	}
+	if conf.TracingSampleRatio < 0 || conf.TracingSampleRatio > 1 {
+		errs.add("TracingSampleRatio must be between 0 and 1, got %g", conf.TracingSampleRatio)
+	}
+	for operation, ratio := range conf.TracingOperationSampleRatio {
+		if ratio < 0 || ratio > 1 {
+			errs.add("TracingOperationSampleRatio of %s must be between 0 and 1, got %g", operation, ratio)
+		}
+	}
+
+	errs.oneOf("CertKeyType", conf.CertKeyType, "ecdsa", "rsa")
+
+	errs.pair("UpstreamClientCert", conf.UpstreamClientCert, "UpstreamClientKey", conf.UpstreamClientKey)
+	if conf.UpstreamMinTLSVersion != "" {
+		if _, err := parseTLSVersion(conf.UpstreamMinTLSVersion); err != nil {
+			errs.add("UpstreamMinTLSVersion %v", err)
+		}
+	}
+
+	if conf.ElasticRollover && (conf.ElasticIndex == "" || strings.Contains(conf.ElasticIndex, "{date}")) {
+		errs.add("ElasticRollover requires an ElasticIndex alias without {date}")
+	}
+	if conf.ElasticUsername != "" && (conf.ElasticAPIKey != "" || conf.ElasticAPIKeyFile != "") {
+		errs.add("ElasticUsername and ElasticAPIKey are exclusive")
+	}
+	errs.pair("ElasticClientCert", conf.ElasticClientCert, "ElasticClientKey", conf.ElasticClientKey)
+
+	errs.oneOf("AccessLogFormat", conf.AccessLogFormat, "ecs", "common", "combined")
+
+	errs.oneOf("RecordFormat", conf.RecordFormat, "ndjson", "har")
+
+	if conf.MirrorEndpoint != "" {
+		if u, err := url.Parse(conf.MirrorEndpoint); err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			errs.add("MirrorEndpoint must be an absolute http(s) URL, got %q", redactURL(conf.MirrorEndpoint))
+		}
+	}
+	if conf.CanaryEndpoint != "" {
+		if u, err := url.Parse(conf.CanaryEndpoint); err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			errs.add("CanaryEndpoint must be an absolute http(s) URL, got %q", redactURL(conf.CanaryEndpoint))
+		}
+	}
+	if conf.CanaryWeight < 0 || conf.CanaryWeight > 100 {
+		errs.add("CanaryWeight must be between 0 and 100, got %g", conf.CanaryWeight)
+	}
+	for operation, ttl := range conf.CacheTTL {
+		if ttl <= 0 {
+			errs.add("CacheTTL of %s must be positive, got %s", operation, ttl)
+		}
+	}
+	if len(conf.CacheTTL) > 0 && conf.CacheMaxEntries <= 0 && conf.CacheDir == "" {
+		errs.add("CacheTTL requires CacheMaxEntries or CacheDir")
+	}
+	if conf.MirrorPercentage < 0 || conf.MirrorPercentage > 100 {
+		errs.add("MirrorPercentage must be between 0 and 100, got %g", conf.MirrorPercentage)
+	}
+
+	errs.oneOf("MessageBusType", conf.MessageBusType, "nats", "kafka-rest")
+	errs.oneOf("MessageBusDelivery", conf.MessageBusDelivery, "at-most-once", "at-least-once")
+	if conf.MessageBusType != "" && conf.MessageBusURL == "" {
+		errs.add("MessageBusType requires MessageBusURL")
+	}
+
+	errs.oneOf("QueueOverflowPolicy", conf.QueueOverflowPolicy, overflowBlock, overflowDropNewest, overflowDropOldest, overflowSpill)
+	errs.oneOf("ReporterDelivery", conf.ReporterDelivery, "ordered", "unordered")
+	for name := range conf.QueueSizes {
+		errs.oneOf("QueueSizes", name, "monitor", "exchange", "accesslog", "bus", "record")
+	}
+	for name := range conf.ReporterWorkerCounts {
+		errs.oneOf("ReporterWorkerCounts", name, "monitor", "exchange", "accesslog", "bus", "record")
+	}
+
+	for _, method := range conf.AuthMethods {
+		errs.oneOf("AuthMethods", method, "jwt", "apikey", "basic")
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
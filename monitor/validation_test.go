@@ -0,0 +1,138 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+
+package monitor
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+//loadConfig reads a monitor.json with the given content from dir the way the monitor does
+func loadConfig(t *testing.T, dir string, content string) (Configuration, error) {
+	file := filepath.Join(dir, "monitor.json")
+	err := ioutil.WriteFile(file, []byte(content), 0600)
+	if err != nil {
+		t.Fatalf("could not prepare test %+v", err)
+	}
+
+	viper.Reset()
+	defer viper.Reset()
+	viper.SetConfigFile(file)
+	return readConfig()
+}
+
+func TestCheckConfigKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatalf("could not prepare test %+v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "monitor.json")
+	err = ioutil.WriteFile(file, []byte(`{
+		"Endpiont": "http://localhost:8080",
+		"verbose": true,
+		"OTLPHeaders": {"Authorization": "Bearer token"}
+	}`), 0600)
+	if err != nil {
+		t.Fatalf("could not prepare test %+v", err)
+	}
+
+	err = checkConfigKeys(file)
+	if err == nil {
+		t.Fatalf("unknown keys should be rejected")
+	}
+	if errs := err.(configErrors); len(errs) != 1 || !strings.Contains(errs[0], `did you mean "Endpoint"`) {
+		t.Errorf("unexpected errors %+v", err)
+	}
+
+	if err := checkConfigKeys("../resources/monitor.json"); err != nil {
+		t.Errorf("example config should be valid %+v", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	conf := Configuration{
+		Endpoint:         "http://localhost:8080",
+		ElasticSearchURL: "http://localhost:9200",
+		TracingBackend:   "zipkin",
+	}
+	if err := conf.Validate(); err != nil {
+		t.Errorf("config should be valid %+v", err)
+	}
+
+	conf.ForwardTraffic = true
+	conf.QueueOverflowPolicy = "drop-all"
+	conf.UpstreamClientCert = "client.pem"
+
+	err := conf.Validate()
+	if err == nil {
+		t.Fatalf("config should be invalid")
+	}
+	for _, expected := range []string{"ForwardTraffic requires ExchangeReporterURL", "QueueOverflowPolicy must be one of", "UpstreamClientCert and UpstreamClientKey"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected %q in %s", expected, err)
+		}
+	}
+}
+
+func TestConfigSchema(t *testing.T) {
+	data, err := ioutil.ReadFile("../resources/monitor.schema.json")
+	if err != nil {
+		t.Fatalf("could not read schema %+v", err)
+	}
+
+	var schema struct {
+		Properties map[string]interface{} `json:"properties"`
+	}
+	err = json.Unmarshal(data, &schema)
+	if err != nil {
+		t.Fatalf("invalid schema %+v", err)
+	}
+
+	expected := make(map[string]bool)
+	for _, name := range configKeys() {
+		expected[name] = true
+	}
+	documented := make(map[string]bool)
+	for name := range schema.Properties {
+		documented[name] = true
+	}
+
+	if !reflect.DeepEqual(expected, documented) {
+		for name := range expected {
+			if !documented[name] {
+				t.Errorf("%s is missing in the schema", name)
+			}
+		}
+		for name := range documented {
+			if !expected[name] {
+				t.Errorf("%s is not part of the configuration", name)
+			}
+		}
+	}
+}
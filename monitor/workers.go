@@ -0,0 +1,186 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+
+package monitor
+
+import (
+	"fmt"
+	"hash/fnv"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+//operationRecord is implemented by all records passed to the reporters,
+//ordered delivery keeps the records of each operation in order
+type operationRecord interface {
+	operation() string
+}
+
+func (m MeterMessage) operation() string {
+	return m.OperationID
+}
+
+func (m busMessage) operation() string {
+	return m.OperationID
+}
+
+//workerPool runs the workers of a reporter. Unordered workers share the reporter queue,
+//ordered workers get their own queue fed with the records of the operations assigned to them
+type workerPool struct {
+	name    string
+	size    int
+	ordered bool
+
+	quit    chan struct{}
+	stopped chan struct{}
+	once    sync.Once
+	wg      sync.WaitGroup
+}
+
+//newWorkerPool creates the worker pool of the named reporter
+func newWorkerPool(conf Configuration, name string) (*workerPool, error) {
+	size := conf.ReporterWorkers
+	if count, ok := conf.ReporterWorkerCounts[name]; ok && count > 0 {
+		size = count
+	}
+	if size <= 0 {
+		size = 1
+	}
+
+	ordered := true
+	switch strings.ToLower(conf.ReporterDelivery) {
+	case "", "ordered":
+	case "unordered":
+		ordered = false
+	default:
+		return nil, fmt.Errorf("unknown reporter delivery %s", conf.ReporterDelivery)
+	}
+
+	return &workerPool{
+		name:    name,
+		size:    size,
+		ordered: ordered,
+		quit:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}, nil
+}
+
+//Start runs work once per worker with the queue of that worker, which has the type of
+//the given queue. done is called after all workers have stopped
+func (wp *workerPool) Start(queue interface{}, work func(queue interface{}, log *logrus.Entry), done func()) {
+	queues := wp.partition(reflect.ValueOf(queue))
+
+	for id, q := range queues {
+		wp.wg.Add(1)
+		go func(id int, q interface{}) {
+			defer wp.wg.Done()
+			work(q, log.WithField("worker", fmt.Sprintf("%s-%d", wp.name, id)))
+		}(id, q)
+	}
+
+	go func() {
+		wp.wg.Wait()
+		if done != nil {
+			done()
+		}
+		close(wp.stopped)
+	}()
+}
+
+//Wait waits until all workers have stopped and done returned, at most for the given timeout
+func (wp *workerPool) Wait(timeout time.Duration) {
+	select {
+	case <-wp.stopped:
+	case <-time.After(timeout):
+		log.Warnf("%s workers did not stop in time", wp.name)
+	}
+}
+
+//Done is closed once the pool is stopped
+func (wp *workerPool) Done() <-chan struct{} {
+	return wp.quit
+}
+
+//Stop terminates all workers of this pool
+func (wp *workerPool) Stop() {
+	wp.once.Do(func() {
+		close(wp.quit)
+	})
+}
+
+//partition returns the queue of each worker and, for ordered delivery, starts
+//the dispatcher that distributes the records by their operation
+func (wp *workerPool) partition(queue reflect.Value) []interface{} {
+	queues := make([]interface{}, wp.size)
+
+	if !wp.ordered || wp.size == 1 {
+		for i := range queues {
+			queues[i] = queue.Interface()
+		}
+		return queues
+	}
+
+	partitions := make([]reflect.Value, wp.size)
+	for i := range partitions {
+		partitions[i] = reflect.MakeChan(queue.Type(), 1)
+		queues[i] = partitions[i].Interface()
+	}
+
+	go func() {
+		receive := []reflect.SelectCase{
+			{Dir: reflect.SelectRecv, Chan: queue},
+			{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(wp.quit)},
+		}
+		send := []reflect.SelectCase{
+			{Dir: reflect.SelectSend},
+			{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(wp.quit)},
+		}
+
+		for {
+			chosen, record, _ := reflect.Select(receive)
+			if chosen == 1 {
+				return
+			}
+
+			send[0].Chan = partitions[wp.partitionOf(record.Interface())]
+			send[0].Send = record
+			if chosen, _, _ := reflect.Select(send); chosen == 1 {
+				return
+			}
+		}
+	}()
+
+	return queues
+}
+
+//partitionOf returns the worker of a record
+func (wp *workerPool) partitionOf(record interface{}) int {
+	op, ok := record.(operationRecord)
+	if !ok {
+		return 0
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(op.operation()))
+	return int(h.Sum32() % uint32(wp.size))
+}
@@ -0,0 +1,108 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+
+package monitor
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestWorkerPoolOrdered(t *testing.T) {
+	pool, err := newWorkerPool(Configuration{ReporterWorkers: 4}, "test")
+	if err != nil {
+		t.Fatalf("could not create pool %+v", err)
+	}
+
+	var lock sync.Mutex
+	received := make(map[string][]int)
+	workers := make(map[string]string)
+	stopped := make(chan bool)
+
+	queue := make(chan MeterMessage, 10)
+	pool.Start(queue, func(q interface{}, wlog *logrus.Entry) {
+		for {
+			select {
+			case msg := <-q.(chan MeterMessage):
+				lock.Lock()
+				received[msg.OperationID] = append(received[msg.OperationID], msg.ResponseCode)
+				worker := wlog.Data["worker"].(string)
+				if w, ok := workers[msg.OperationID]; ok && w != worker {
+					t.Errorf("%s was handled by %s and %s", msg.OperationID, w, worker)
+				}
+				workers[msg.OperationID] = worker
+				lock.Unlock()
+			case <-pool.Done():
+				return
+			}
+		}
+	}, func() {
+		close(stopped)
+	})
+
+	for i := 0; i < 100; i++ {
+		queue <- MeterMessage{OperationID: fmt.Sprintf("op%d", i%7), ResponseCode: i}
+	}
+
+	waitFor(t, func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		total := 0
+		for _, codes := range received {
+			total += len(codes)
+		}
+		return total == 100
+	})
+
+	lock.Lock()
+	for op, codes := range received {
+		for i := 1; i < len(codes); i++ {
+			if codes[i] < codes[i-1] {
+				t.Errorf("records of %s are out of order %v", op, codes)
+				break
+			}
+		}
+	}
+	lock.Unlock()
+
+	pool.Stop()
+	pool.Stop()
+	<-stopped
+}
+
+func TestWorkerPoolConfig(t *testing.T) {
+	pool, err := newWorkerPool(Configuration{
+		ReporterWorkers:      2,
+		ReporterWorkerCounts: map[string]int{"exchange": 8},
+		ReporterDelivery:     "unordered",
+	}, "exchange")
+	if err != nil {
+		t.Fatalf("could not create pool %+v", err)
+	}
+	if pool.size != 8 || pool.ordered {
+		t.Errorf("unexpected pool %d workers, ordered %v", pool.size, pool.ordered)
+	}
+
+	if _, err := newWorkerPool(Configuration{ReporterDelivery: "sometimes"}, "bus"); err == nil {
+		t.Errorf("unknown delivery should be rejected")
+	}
+}